@@ -0,0 +1,408 @@
+/*
+@Time :    2022/3/21 21:00
+@Author :  liuzhi
+@File :    archive
+@Software: GoLand
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PAX 格式中保存扩展属性的前缀，和 GNU tar、docker 一致
+const xattrPrefix = "SCHILY.xattr."
+
+// Tar 把 root 中的 src 打包写入 w，包中的路径以 name 开头，name 为空时只打包 src 目录下的内容
+// src 按照 SecureJoin 的规则在 root 中解析，软链接原样打包，不会跟随，idMap 不为空时把文件的属主转换成容器中的 id
+// 和 Untar 一样所有文件都相对于已经打开的目录 fd 逐级打开，打包期间容器把路径换成软链接也读不到 root 之外的文件
+func Tar(w io.Writer, root, src, name string, idMap *IDMap) error {
+	rfd, err := openRootFd(root)
+	if err != nil {
+		return err
+	}
+	defer func(rfd *rootFd) {
+		_ = rfd.Close()
+	}(rfd)
+	fd, err := rfd.openPath(src)
+	if err != nil {
+		return err
+	}
+	defer func(fd int) {
+		_ = unix.Close(fd)
+	}(fd)
+	t := &tarWalker{tw: tar.NewWriter(w), idMap: idMap, seen: map[[2]uint64]string{}}
+	if err := t.walk(fd, name, name == ""); err != nil {
+		return err
+	}
+	return t.tw.Close()
+}
+
+// tarWalker 从打开的 fd 开始递归打包
+type tarWalker struct {
+	tw    *tar.Writer
+	idMap *IDMap
+	// 同一个 inode 的多个硬链接只打包一次，后面的打包成 TypeLink
+	seen map[[2]uint64]string
+}
+
+// walk 打包 fd 对应的文件，fd 是 O_PATH 打开的，目录按名字顺序打包其中的内容，skipSelf 为 true 时不写目录本身
+func (t *tarWalker) walk(fd int, entryName string, skipSelf bool) error {
+	// 先 fstat 已经打开的 fd，头部信息和之后读取的内容对应同一个 inode
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("stat %s error: %v", entryName, err)
+	}
+	if !skipSelf {
+		hdr, err := t.header(fd, &st, entryName)
+		if err != nil {
+			return err
+		}
+		if hdr == nil {
+			return nil
+		}
+		if err := t.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return t.copyContent(fd, hdr)
+		}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil
+	}
+	names, err := readDirNames(fd)
+	if err != nil {
+		return fmt.Errorf("read directory %s error: %v", entryName, err)
+	}
+	for _, child := range names {
+		childFd, err := unix.Openat(fd, child, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT {
+			// 打包期间被删除的文件直接跳过
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "open", Path: filepath.Join(entryName, child), Err: err}
+		}
+		err = t.walk(childFd, filepath.Join(entryName, child), false)
+		_ = unix.Close(childFd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// header 根据 fstat 的结果生成 tar 头部，socket 不打包时返回 nil
+func (t *tarWalker) header(fd int, st *unix.Stat_t, entryName string) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:    entryName,
+		Mode:    int64(st.Mode & 07777),
+		ModTime: time.Unix(st.Mtim.Unix()),
+	}
+	hdr.Uid, hdr.Gid = t.idMap.ToContainer(int(st.Uid), int(st.Gid))
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case unix.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = st.Size
+		if st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if first, ok := t.seen[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				t.seen[key] = entryName
+			}
+		}
+	case unix.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		// 空路径的 readlinkat 读取 O_PATH 打开的软链接本身
+		link, err := readlinkat(fd, "")
+		if err != nil {
+			return nil, fmt.Errorf("readlink %s error: %v", entryName, err)
+		}
+		hdr.Linkname = link
+		// 软链接上只能有 trusted 和 security 属性，不读取
+		return hdr, nil
+	case unix.S_IFCHR, unix.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(st.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(st.Rdev)))
+	case unix.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		log.Warnf("skip socket %s", entryName)
+		return nil, nil
+	}
+	xattrs, err := readXattrs(fd)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[xattrPrefix+k] = v
+	}
+	return hdr, nil
+}
+
+// copyContent 通过 /proc/self/fd 重新打开 O_PATH fd 读取文件内容，打开的还是同一个 inode
+// 只写入头部记录的大小，打包期间文件变大时多出的内容被忽略
+func (t *tarWalker) copyContent(fd int, hdr *tar.Header) error {
+	f, err := os.OpenFile(fdPath(fd), os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err := io.CopyN(t.tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("read %s error: %v", hdr.Name, err)
+	}
+	return nil
+}
+
+// readDirNames 按名字顺序返回 O_PATH 打开的目录中的文件
+func readDirNames(fd int) ([]string, error) {
+	dir, err := os.OpenFile(fdPath(fd), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func(dir *os.File) {
+		_ = dir.Close()
+	}(dir)
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Untar 把 tar 流解压到 root 下的 dest 目录中
+// 路径按照 SecureJoin 的规则在 root 中解析，包中的 ".." 和已有的软链接都不会导致写到 root 之外；
+// 所有操作都相对于逐级打开的目录 fd 进行，解压期间 root 中的目录被替换成软链接也不会逃逸
+// idMap 不为空时把包中容器的 id 转换成宿主机的 id，非 root 用户不修改属主
+func Untar(r io.Reader, root, dest string, idMap *IDMap) error {
+	rfd, err := openRootFd(root)
+	if err != nil {
+		return err
+	}
+	defer func(rfd *rootFd) {
+		_ = rfd.Close()
+	}(rfd)
+	tr := tar.NewReader(r)
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	// 目录的修改时间要等目录中的文件都解压之后再设置
+	var dirs []dirTimes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		target := filepath.Join(dest, name)
+		dirFd, base, err := rfd.openParent(target, true)
+		if err != nil {
+			return fmt.Errorf("extract %s error: %v", hdr.Name, err)
+		}
+		err = extractEntry(tr, hdr, rfd, dest, dirFd, base)
+		if err == nil {
+			err = setMetadata(hdr, dirFd, base, idMap)
+		}
+		_ = unix.Close(dirFd)
+		if err != nil {
+			return fmt.Errorf("extract %s error: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: target, mtime: hdr.ModTime})
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dirFd, base, err := rfd.openParent(dirs[i].path, false)
+		if err != nil {
+			return err
+		}
+		err = setTimes(dirFd, base, dirs[i].mtime)
+		_ = unix.Close(dirFd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractEntry 在 dirFd 目录中创建 base，可以是文件、目录、链接或者设备，已经存在时目录保留，其他类型先删除
+func extractEntry(tr *tar.Reader, hdr *tar.Header, rfd *rootFd, dest string, dirFd int, base string) error {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirFd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+		if isDir && hdr.Typeflag == tar.TypeDir {
+			return nil
+		}
+		if isDir {
+			return fmt.Errorf("cannot overwrite directory %s with non-directory", base)
+		}
+		if err := unix.Unlinkat(dirFd, base, 0); err != nil {
+			return err
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return unix.Mkdirat(dirFd, base, mode)
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(dirFd, base, unix.O_CREAT|unix.O_WRONLY|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), base)
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case tar.TypeSymlink:
+		// 软链接的目标原样保留，在容器中使用时才解析
+		return unix.Symlinkat(hdr.Linkname, dirFd, base)
+	case tar.TypeLink:
+		sourceFd, sourceBase, err := rfd.openParent(filepath.Join(dest, filepath.Clean("/"+hdr.Linkname)), false)
+		if err != nil {
+			return err
+		}
+		defer func(fd int) {
+			_ = unix.Close(fd)
+		}(sourceFd)
+		// flags 为 0 时 linkat 不跟随软链接
+		return unix.Linkat(sourceFd, sourceBase, dirFd, base, 0)
+	case tar.TypeChar:
+		return unix.Mknodat(dirFd, base, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeBlock:
+		return unix.Mknodat(dirFd, base, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeFifo:
+		return unix.Mknodat(dirFd, base, unix.S_IFIFO|mode, 0)
+	}
+	return fmt.Errorf("unsupported file type %c", hdr.Typeflag)
+}
+
+// setMetadata 设置属主、扩展属性、权限和修改时间，软链接只设置属主和时间
+func setMetadata(hdr *tar.Header, dirFd int, base string, idMap *IDMap) error {
+	if os.Geteuid() == 0 {
+		uid, gid, err := idMap.ToHost(hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+		if err := unix.Fchownat(dirFd, base, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, xattrPrefix) {
+			continue
+		}
+		// 目标文件系统不一定支持扩展属性，比如 tmpfs 不支持 user.*
+		if err := unix.Lsetxattr(filepath.Join(fdPath(dirFd), base), strings.TrimPrefix(k, xattrPrefix), []byte(v), 0); err != nil {
+			log.Debugf("set xattr %s on %s error %v", k, base, err)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+		ts := []unix.Timespec{mtime, mtime}
+		return unix.UtimesNanoAt(dirFd, base, ts, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	// fchmodat 会跟随软链接，先用 O_NOFOLLOW 打开，再通过 /proc/self/fd 修改打开的文件
+	fd, err := unix.Openat(dirFd, base, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer func(fd int) {
+		_ = unix.Close(fd)
+	}(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return fmt.Errorf("%s was replaced with a symlink", base)
+	}
+	// chown 会清除 setuid 位，权限要在 chown 之后设置，包括 setuid、setgid 和 sticky
+	if err := unix.Chmod(fdPath(fd), uint32(hdr.Mode&07777)); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, fdPath(fd), []unix.Timespec{mtime, mtime}, 0)
+}
+
+// setTimes 设置 dirFd 中 base 的修改时间，不跟随软链接
+func setTimes(dirFd int, base string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	return unix.UtimesNanoAt(dirFd, base, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// readXattrs 通过 /proc/self/fd 读取已经打开的文件的扩展属性，文件系统不支持时返回空
+func readXattrs(fd int) (map[string]string, error) {
+	path := fdPath(fd)
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list xattrs of %s error: %v", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, fmt.Errorf("list xattrs of %s error: %v", path, err)
+	}
+	xattrs := map[string]string{}
+	for _, key := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if key == "" {
+			continue
+		}
+		valueSize, err := unix.Getxattr(path, key, nil)
+		if err != nil {
+			log.Debugf("get xattr %s of %s error %v", key, path, err)
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Getxattr(path, key, value); err != nil {
+			log.Debugf("get xattr %s of %s error %v", key, path, err)
+			continue
+		}
+		xattrs[key] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
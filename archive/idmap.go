@@ -0,0 +1,74 @@
+/*
+@Time :    2022/3/21 20:30
+@Author :  liuzhi
+@File :    idmap
+@Software: GoLand
+*/
+
+package archive
+
+import "fmt"
+
+// 没有映射的 id 在容器中显示为 nobody，和内核的 overflowuid 一致
+const overflowID = 65534
+
+// IDMapping user namespace 的一段 id 映射
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// IDMap 容器的 uid 和 gid 映射，nil 或者为空表示没有使用 user namespace
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// ToContainer 宿主机上的 id 转换成容器中的 id，没有映射的 id 转换成 65534
+func (m *IDMap) ToContainer(uid, gid int) (int, int) {
+	if m == nil {
+		return uid, gid
+	}
+	return toContainer(uid, m.UIDs), toContainer(gid, m.GIDs)
+}
+
+// ToHost 容器中的 id 转换成宿主机上的 id，没有映射的 id 返回错误
+func (m *IDMap) ToHost(uid, gid int) (int, int, error) {
+	if m == nil {
+		return uid, gid, nil
+	}
+	hostUid, err := toHost(uid, m.UIDs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("uid %v", err)
+	}
+	hostGid, err := toHost(gid, m.GIDs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("gid %v", err)
+	}
+	return hostUid, hostGid, nil
+}
+
+func toContainer(id int, mappings []IDMapping) int {
+	if len(mappings) == 0 {
+		return id
+	}
+	for _, m := range mappings {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return overflowID
+}
+
+func toHost(id int, mappings []IDMapping) (int, error) {
+	if len(mappings) == 0 {
+		return id, nil
+	}
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+	return 0, fmt.Errorf("%d is not mapped in the container user namespace", id)
+}
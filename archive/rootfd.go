@@ -0,0 +1,174 @@
+/*
+@Time :    2022/3/22 20:30
+@Author :  liuzhi
+@File :    rootfd
+@Software: GoLand
+*/
+
+package archive
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 打开路径中间目录使用的标记，O_NOFOLLOW 保证每一级都不会跟随软链接
+const dirOpenFlags = unix.O_PATH | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+
+// rootFd 持有 root 目录的 fd，所有的文件操作都相对于打开的目录 fd 进行
+// 解压到运行中容器的 /proc/<pid>/root 时，容器可以在路径解析完成之后把某一级目录换成软链接，
+// 按路径操作会跟着软链接写到宿主机上；逐级 openat 并且带上 O_NOFOLLOW 就不会有这个问题
+type rootFd struct {
+	fd int
+}
+
+func openRootFd(root string) (*rootFd, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return &rootFd{fd: fd}, nil
+}
+
+func (r *rootFd) Close() error {
+	return unix.Close(r.fd)
+}
+
+// openDir 打开 root 中的目录，软链接按照 SecureJoin 的规则在 root 中解析，返回的 fd 由调用方关闭
+// mkdir 为 true 时创建不存在的目录，和 MkdirAll 一样使用 0755 权限
+func (r *rootFd) openDir(unsafePath string, mkdir bool) (int, error) {
+	fd, err := unix.Dup(r.fd)
+	if err != nil {
+		return -1, err
+	}
+	// current 是已经打开的各级目录，".." 和绝对路径的软链接需要从 root 重新打开
+	var current []string
+	links := 0
+	for unsafePath != "" {
+		var component string
+		if i := strings.IndexByte(unsafePath, '/'); i >= 0 {
+			component, unsafePath = unsafePath[:i], unsafePath[i+1:]
+		} else {
+			component, unsafePath = unsafePath, ""
+		}
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			// ".." 最多回到 root，不使用 openat("..")，避免目录被移走之后回到 root 之外
+			if len(current) > 0 {
+				current = current[:len(current)-1]
+			}
+			if fd, err = r.reopen(fd, current); err != nil {
+				return -1, err
+			}
+			continue
+		}
+
+		next, err := unix.Openat(fd, component, dirOpenFlags, 0)
+		if err == unix.ENOENT && mkdir {
+			if err := unix.Mkdirat(fd, component, 0755); err != nil && err != unix.EEXIST {
+				_ = unix.Close(fd)
+				return -1, &os.PathError{Op: "mkdir", Path: component, Err: err}
+			}
+			next, err = unix.Openat(fd, component, dirOpenFlags, 0)
+		}
+		if err == unix.ENOTDIR || err == unix.ELOOP {
+			// 不是目录，如果是软链接就读取链接内容继续解析
+			target, linkErr := readlinkat(fd, component)
+			if linkErr != nil {
+				_ = unix.Close(fd)
+				return -1, &os.PathError{Op: "open", Path: component, Err: err}
+			}
+			links++
+			if links > maxSymlinks {
+				_ = unix.Close(fd)
+				return -1, &os.PathError{Op: "open", Path: component, Err: syscall.ELOOP}
+			}
+			if filepath.IsAbs(target) {
+				current = nil
+				if fd, err = r.reopen(fd, current); err != nil {
+					return -1, err
+				}
+			}
+			unsafePath = target + "/" + unsafePath
+			continue
+		}
+		_ = unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: component, Err: err}
+		}
+		fd = next
+		current = append(current, component)
+	}
+	return fd, nil
+}
+
+// reopen 关闭 fd，从 root 开始重新逐级打开 components，这些目录都已经解析过，不再处理软链接
+func (r *rootFd) reopen(fd int, components []string) (int, error) {
+	_ = unix.Close(fd)
+	fd, err := unix.Dup(r.fd)
+	if err != nil {
+		return -1, err
+	}
+	for _, component := range components {
+		next, err := unix.Openat(fd, component, dirOpenFlags, 0)
+		_ = unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: component, Err: err}
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// openParent 打开 unsafePath 的父目录，返回父目录的 fd 和最后一级的名字，最后一级不解析软链接
+// 和 SecureParent 对应，调用方通过 *at 系统调用操作最后一级
+func (r *rootFd) openParent(unsafePath string, mkdir bool) (int, string, error) {
+	clean := filepath.Clean("/" + unsafePath)
+	if clean == "/" {
+		return -1, "", fmt.Errorf("path %s has no parent", unsafePath)
+	}
+	fd, err := r.openDir(filepath.Dir(clean), mkdir)
+	if err != nil {
+		return -1, "", err
+	}
+	return fd, filepath.Base(clean), nil
+}
+
+// openPath 以 O_PATH 打开 root 中的 unsafePath，最后一级不跟随软链接，返回的 fd 由调用方关闭
+func (r *rootFd) openPath(unsafePath string) (int, error) {
+	if filepath.Clean("/"+unsafePath) == "/" {
+		return unix.Dup(r.fd)
+	}
+	dirFd, base, err := r.openParent(unsafePath, false)
+	if err != nil {
+		return -1, err
+	}
+	defer func(fd int) {
+		_ = unix.Close(fd)
+	}(dirFd)
+	fd, err := unix.Openat(dirFd, base, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: unsafePath, Err: err}
+	}
+	return fd, nil
+}
+
+func readlinkat(dirFd int, name string) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirFd, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// fdPath 通过 /proc/self/fd 访问已经打开的文件，用于没有 *at 版本或者不支持 O_PATH fd 的系统调用
+func fdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
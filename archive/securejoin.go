@@ -0,0 +1,91 @@
+/*
+@Time :    2022/3/21 20:05
+@Author :  liuzhi
+@File :    securejoin
+@Software: GoLand
+*/
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 解析软链接的最大次数，超过认为出现了循环
+const maxSymlinks = 255
+
+// SecureJoin 把 unsafePath 拼接到 root 下，逐级解析路径中的软链接
+// 绝对路径的软链接相对于 root 解析，".." 最多回到 root，保证结果不会逃逸出 root
+// 路径中不存在的部分原样保留
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	// current 是已经解析过的部分，以 / 开头，相对于 root
+	current := "/"
+	links := 0
+	for unsafePath != "" {
+		var component string
+		if i := strings.IndexByte(unsafePath, '/'); i >= 0 {
+			component, unsafePath = unsafePath[:i], unsafePath[i+1:]
+		} else {
+			component, unsafePath = unsafePath, ""
+		}
+		if component == "" || component == "." {
+			continue
+		}
+		// 以 / 为根做词法上的拼接，".." 不会越过根
+		next := filepath.Join(current, component)
+		fullPath := filepath.Join(root, next)
+		fi, err := os.Lstat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) || isNotDir(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "securejoin", Path: unsafePath, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", err
+		}
+		// 相对路径的软链接相对于链接所在的目录，也就是 current
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		unsafePath = target + "/" + unsafePath
+	}
+	return filepath.Join(root, current), nil
+}
+
+func isNotDir(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// SecureParent 安全地解析 unsafePath 的父目录，最后一级不解析软链接
+// 用于需要操作软链接本身的场景，比如复制和覆盖软链接
+func SecureParent(root, unsafePath string) (string, error) {
+	clean := filepath.Clean("/" + unsafePath)
+	if clean == "/" {
+		return "", fmt.Errorf("path %s has no parent", unsafePath)
+	}
+	parent, err := SecureJoin(root, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
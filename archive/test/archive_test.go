@@ -0,0 +1,234 @@
+/*
+@Time :    2022/3/21 22:40
+@Author :  liuzhi
+@File :    archive_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"my-container/archive"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 绝对路径、".." 和相对路径的软链接都不能逃逸出 root
+	links := map[string]string{
+		"abs":    "/etc",
+		"dotdot": "../../../../etc",
+		"loop":   "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[string]string{
+		"/abs/passwd":       filepath.Join(root, "etc/passwd"),
+		"dotdot/passwd":     filepath.Join(root, "etc/passwd"),
+		"../../etc/passwd":  filepath.Join(root, "etc/passwd"),
+		"/etc/../../../tmp": filepath.Join(root, "tmp"),
+		"missing/a/../b":    filepath.Join(root, "missing/b"),
+	}
+	for path, want := range cases {
+		got, err := archive.SecureJoin(root, path)
+		if err != nil {
+			t.Fatalf("SecureJoin(%s): %v", path, err)
+		}
+		if got != want {
+			t.Fatalf("SecureJoin(%s) = %s, want %s", path, got, want)
+		}
+	}
+	if _, err := archive.SecureJoin(root, "loop/a"); err == nil {
+		t.Fatalf("expected error for symlink loop")
+	}
+}
+
+func TestTarUntar(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dir/sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "dir/sub/file"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "dir/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "dir/sub/file"), filepath.Join(src, "dir/hard")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Tar(&buf, src, "/dir", "copy", nil); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := archive.Untar(&buf, root, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "copy/sub/file"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected file content %q, %v", data, err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "copy/sub/file"))
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected file mode %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "copy/sub")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("unexpected dir mode %v, %v", fi, err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "copy/link")); err != nil || target != "/etc/passwd" {
+		t.Fatalf("symlink should be kept as is, got %s, %v", target, err)
+	}
+	a, _ := os.Stat(filepath.Join(root, "copy/sub/file"))
+	b, _ := os.Stat(filepath.Join(root, "copy/hard"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Fatalf("hard link should be restored")
+	}
+}
+
+func TestUntarThroughSymlink(t *testing.T) {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "evil"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := archive.Tar(&buf, src, "/evil", "escape/evil", nil); err != nil {
+		t.Fatal(err)
+	}
+	// 容器中的 escape 是指向宿主机目录的软链接，解压时应该在 root 中解析
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Untar(&buf, root, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Fatalf("file escaped the root through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(root, outside, "evil")); err != nil {
+		t.Fatalf("file should be extracted inside the root: %v", err)
+	}
+}
+
+// TestTarThroughSymlink 打包容器中的路径时，指向宿主机的软链接在 root 中解析，不能读到 root 之外的文件
+func TestTarThroughSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := archive.Tar(&buf, root, "/escape/secret", "secret", nil); err == nil {
+		t.Fatalf("file outside the root should not be found")
+	}
+	if err := os.MkdirAll(filepath.Join(root, outside), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, outside, "secret"), []byte("inside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := archive.Tar(&buf, root, "/escape/secret", "secret", nil); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	if _, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "inside" {
+		t.Fatalf("unexpected content %q, %v", data, err)
+	}
+
+	// 打包整个 root 时软链接原样打包，不跟随
+	buf.Reset()
+	if err := archive.Tar(&buf, root, "/", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	tr = tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "escape" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != outside) {
+			t.Fatalf("symlink should be kept as is, got %+v", hdr)
+		}
+	}
+}
+
+// TestUntarSymlinkInArchive 包中先创建指向宿主机目录的软链接，后面的文件经过这个软链接时也要在 root 中解析
+func TestUntarSymlinkInArchive(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: outside, Mode: 0777}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "up", Linkname: "../../..", Mode: 0777}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"link/evil", "up" + outside + "/evil2"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Untar(&buf, root, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"evil", "evil2"} {
+		if _, err := os.Stat(filepath.Join(outside, name)); err == nil {
+			t.Fatalf("%s escaped the root through a symlink", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, outside, name)); err != nil {
+			t.Fatalf("%s should be extracted inside the root: %v", name, err)
+		}
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	m := &archive.IDMap{
+		UIDs: []archive.IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDs: []archive.IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	if uid, gid := m.ToContainer(100001, 100002); uid != 1 || gid != 2 {
+		t.Fatalf("ToContainer = %d:%d", uid, gid)
+	}
+	if uid, _ := m.ToContainer(0, 0); uid != 65534 {
+		t.Fatalf("unmapped host id should be 65534, got %d", uid)
+	}
+	if uid, gid, err := m.ToHost(1, 2); err != nil || uid != 100001 || gid != 100002 {
+		t.Fatalf("ToHost = %d:%d, %v", uid, gid, err)
+	}
+	if _, _, err := m.ToHost(70000, 0); err == nil {
+		t.Fatalf("expected error for unmapped container id")
+	}
+}
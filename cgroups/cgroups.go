@@ -0,0 +1,261 @@
+/*
+@Time :    2022/3/15 20:10
+@Author :  liuzhi
+@File :    cgroups
+@Software: GoLand
+*/
+
+package cgroups
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 只支持 cgroup v2(unified hierarchy)
+const (
+	// MountPoint cgroup v2 的挂载点
+	MountPoint = "/sys/fs/cgroup"
+	// DefaultParent 容器 cgroup 的默认父目录
+	DefaultParent = "/my-container"
+)
+
+// 需要在父 cgroup 中开启的控制器
+var controllers = []string{"cpu", "cpuset", "io", "memory", "pids"}
+
+// Resources 资源限制，nil 或者 0 表示不限制
+type Resources struct {
+	Memory     int64  // 内存上限，字节
+	MemorySwap int64  // 内存 + swap 上限，字节，-1 表示不限制
+	CpuShares  uint64 // cpu 相对权重，v1 的取值范围 2-262144
+	CpuQuota   int64  // 每个周期内可以使用的 cpu 时间，微秒
+	CpuPeriod  uint64 // 周期，微秒
+	CpusetCpus string // 可以使用的 cpu，比如 0-2
+	CpusetMems string // 可以使用的内存节点
+	PidsLimit  int64  // 最大进程数
+}
+
+// Manager 管理一个容器的 cgroup
+type Manager struct {
+	// Path 相对于 cgroup 挂载点的路径，比如 /my-container/<id>
+	Path string
+}
+
+func NewManager(cgroupPath string) *Manager {
+	return &Manager{Path: path.Clean("/" + cgroupPath)}
+}
+
+// Dir cgroup 在宿主机上的绝对路径
+func (m *Manager) Dir() string {
+	return path.Join(MountPoint, m.Path)
+}
+
+// Apply 创建 cgroup 并把进程加入，创建之前在各级父目录开启需要的控制器
+func (m *Manager) Apply(pid int) error {
+	if err := m.enableControllers(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir(), 0755); err != nil {
+		return fmt.Errorf("create cgroup %s error: %v", m.Path, err)
+	}
+	return m.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// enableControllers 从根开始在每一级的 cgroup.subtree_control 中开启控制器
+// 内核不支持的控制器忽略，写入失败只打印日志
+func (m *Manager) enableControllers() error {
+	available, err := ioutil.ReadFile(path.Join(MountPoint, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 is not available: %v", err)
+	}
+	var enable []string
+	for _, c := range controllers {
+		if strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+c+" ") {
+			enable = append(enable, "+"+c)
+		}
+	}
+	dir := MountPoint
+	for _, elem := range strings.Split(strings.Trim(path.Dir(m.Path), "/"), "/") {
+		if elem != "" {
+			dir = path.Join(dir, elem)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		for _, c := range enable {
+			if err := ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte(c), 0644); err != nil {
+				log.Debugf("enable controller %s in %s error: %v", c, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Set 写入资源限制
+func (m *Manager) Set(res *Resources) error {
+	if res == nil {
+		return nil
+	}
+	if res.Memory != 0 {
+		if err := m.write("memory.max", limitString(res.Memory)); err != nil {
+			return err
+		}
+	}
+	if res.MemorySwap != 0 {
+		// v2 的 memory.swap.max 只限制 swap，v1 语义的 memory+swap 需要减去内存上限
+		swap := res.MemorySwap
+		if swap > 0 && res.Memory > 0 {
+			swap -= res.Memory
+		}
+		if err := m.write("memory.swap.max", limitString(swap)); err != nil {
+			return err
+		}
+	}
+	if res.CpuShares != 0 {
+		if err := m.write("cpu.weight", strconv.FormatUint(convertCPUSharesToWeight(res.CpuShares), 10)); err != nil {
+			return err
+		}
+	}
+	if res.CpuQuota != 0 || res.CpuPeriod != 0 {
+		period := res.CpuPeriod
+		if period == 0 {
+			period = 100000
+		}
+		quota := "max"
+		if res.CpuQuota > 0 {
+			quota = strconv.FormatInt(res.CpuQuota, 10)
+		}
+		if err := m.write("cpu.max", fmt.Sprintf("%s %d", quota, period)); err != nil {
+			return err
+		}
+	}
+	if res.CpusetCpus != "" {
+		if err := m.write("cpuset.cpus", res.CpusetCpus); err != nil {
+			return err
+		}
+	}
+	if res.CpusetMems != "" {
+		if err := m.write("cpuset.mems", res.CpusetMems); err != nil {
+			return err
+		}
+	}
+	if res.PidsLimit != 0 {
+		if err := m.write("pids.max", limitString(res.PidsLimit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetResources 从 cgroup 文件中读取当前的资源限制，inspect 使用
+// cpu.weight 无法准确换算回 cpu.shares，不读取
+func (m *Manager) GetResources() (*Resources, error) {
+	res := &Resources{}
+	var err error
+	if res.Memory, err = m.readLimit("memory.max"); err != nil {
+		return nil, err
+	}
+	swap, err := m.readLimit("memory.swap.max")
+	if err != nil {
+		return nil, err
+	}
+	if swap > 0 && res.Memory > 0 {
+		res.MemorySwap = res.Memory + swap
+	}
+	cpuMax, err := m.readIfExists("cpu.max")
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(cpuMax); len(fields) == 2 {
+		if fields[0] != "max" {
+			res.CpuQuota, _ = strconv.ParseInt(fields[0], 10, 64)
+		}
+		res.CpuPeriod, _ = strconv.ParseUint(fields[1], 10, 64)
+	}
+	if cpus, err := m.readIfExists("cpuset.cpus"); err == nil {
+		res.CpusetCpus = strings.TrimSpace(cpus)
+	}
+	if mems, err := m.readIfExists("cpuset.mems"); err == nil {
+		res.CpusetMems = strings.TrimSpace(mems)
+	}
+	if res.PidsLimit, err = m.readLimit("pids.max"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readLimit 读取限制值，"max" 和文件不存在都返回 0
+func (m *Manager) readLimit(file string) (int64, error) {
+	n, err := m.readUint(file)
+	return int64(n), err
+}
+
+// Destroy 删除 cgroup，cgroup 中还有进程时会失败
+func (m *Manager) Destroy() error {
+	if err := os.Remove(m.Dir()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove cgroup %s error: %v", m.Path, err)
+	}
+	return nil
+}
+
+// Exists cgroup 是否已经创建
+func (m *Manager) Exists() bool {
+	_, err := os.Stat(m.Dir())
+	return err == nil
+}
+
+// Pids 返回 cgroup 中的所有进程
+func (m *Manager) Pids() ([]int, error) {
+	procs, err := m.read("cgroup.procs")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Fields(procs) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("parse cgroup.procs error: %v", err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+func (m *Manager) write(file, value string) error {
+	if err := ioutil.WriteFile(path.Join(m.Dir(), file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("write %s to %s error: %v", value, path.Join(m.Path, file), err)
+	}
+	return nil
+}
+
+func (m *Manager) read(file string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(m.Dir(), file))
+	if err != nil {
+		return "", fmt.Errorf("read %s error: %v", path.Join(m.Path, file), err)
+	}
+	return string(data), nil
+}
+
+// limitString 负数表示不限制
+func limitString(limit int64) string {
+	if limit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// convertCPUSharesToWeight 把 v1 的 cpu.shares [2-262144] 转换成 v2 的 cpu.weight [1-10000]
+func convertCPUSharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
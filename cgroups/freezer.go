@@ -0,0 +1,98 @@
+/*
+@Time :    2022/3/18 20:15
+@Author :  liuzhi
+@File :    freezer
+@Software: GoLand
+*/
+
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strings"
+	"time"
+)
+
+// FreezeTimeout 等待 cgroup 冻结或解冻完成的最长时间
+const FreezeTimeout = 10 * time.Second
+
+// Freeze 冻结 cgroup 中的所有进程，等到 cgroup.events 中的 frozen 变为 1 才返回
+// 超时的话恢复成未冻结状态并返回错误
+func (m *Manager) Freeze() error {
+	if err := m.write("cgroup.freeze", "1"); err != nil {
+		return err
+	}
+	if err := m.waitFrozen(true, FreezeTimeout); err != nil {
+		_ = m.write("cgroup.freeze", "0")
+		return err
+	}
+	return nil
+}
+
+// Thaw 解冻 cgroup，等到 frozen 变为 0 才返回
+func (m *Manager) Thaw() error {
+	if err := m.write("cgroup.freeze", "0"); err != nil {
+		return err
+	}
+	return m.waitFrozen(false, FreezeTimeout)
+}
+
+// Frozen cgroup 当前是否处于冻结状态
+func (m *Manager) Frozen() (bool, error) {
+	events, err := m.read("cgroup.events")
+	if err != nil {
+		return false, err
+	}
+	return parseFrozen(events), nil
+}
+
+// waitFrozen 通过 inotify 监听 cgroup.events 的修改，直到 frozen 的值等于 want
+func (m *Manager) waitFrozen(want bool, timeout time.Duration) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify init error: %v", err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	if _, err := unix.InotifyAddWatch(fd, m.Dir()+"/cgroup.events", unix.IN_MODIFY); err != nil {
+		return fmt.Errorf("watch %s/cgroup.events error: %v", m.Path, err)
+	}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 4096)
+	for {
+		// 先注册监听再读取，避免错过两者之间发生的状态变化
+		frozen, err := m.Frozen()
+		if err != nil {
+			return err
+		}
+		if frozen == want {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timeout waiting for cgroup %s frozen=%v", m.Path, want)
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(remaining/time.Millisecond)+1); err != nil && err != unix.EINTR {
+			return fmt.Errorf("poll cgroup events error: %v", err)
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			if _, err := unix.Read(fd, buf); err != nil && err != unix.EINTR {
+				return fmt.Errorf("read inotify events error: %v", err)
+			}
+		}
+	}
+}
+
+// parseFrozen 解析 cgroup.events 中 "frozen 0|1" 这一行
+func parseFrozen(events string) bool {
+	for _, line := range strings.Split(events, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "frozen" {
+			return fields[1] == "1"
+		}
+	}
+	return false
+}
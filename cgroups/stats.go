@@ -0,0 +1,178 @@
+/*
+@Time :    2022/3/19 20:10
+@Author :  liuzhi
+@File :    stats
+@Software: GoLand
+*/
+
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Stats cgroup 的资源使用情况，没有开启的控制器对应的数据为 0
+type Stats struct {
+	CPU    CPUStats    `json:"cpu"`
+	Memory MemoryStats `json:"memory"`
+	IO     IOStats     `json:"io"`
+	Pids   PidsStats   `json:"pids"`
+}
+
+// CPUStats cpu.stat，单位微秒
+type CPUStats struct {
+	UsageUsec  uint64 `json:"usageUsec"`
+	UserUsec   uint64 `json:"userUsec"`
+	SystemUsec uint64 `json:"systemUsec"`
+}
+
+// MemoryStats memory.current、memory.max 和 memory.stat，单位字节，Limit 为 0 表示不限制
+type MemoryStats struct {
+	Usage uint64            `json:"usage"`
+	Limit uint64            `json:"limit"`
+	Stat  map[string]uint64 `json:"stat,omitempty"`
+}
+
+// IOStats io.stat 中所有设备的合计
+type IOStats struct {
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+	ReadOps    uint64 `json:"readOps"`
+	WriteOps   uint64 `json:"writeOps"`
+}
+
+// PidsStats pids.current 和 pids.max，Limit 为 0 表示不限制
+type PidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit"`
+}
+
+// Stats 读取 cgroup 的资源使用情况
+func (m *Manager) Stats() (*Stats, error) {
+	if !m.Exists() {
+		return nil, fmt.Errorf("cgroup %s does not exist", m.Path)
+	}
+	stats := &Stats{}
+	cpuStat, err := m.readIfExists("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	cpu := parseFlatKeyed(cpuStat)
+	stats.CPU = CPUStats{UsageUsec: cpu["usage_usec"], UserUsec: cpu["user_usec"], SystemUsec: cpu["system_usec"]}
+
+	if stats.Memory.Usage, err = m.readUint("memory.current"); err != nil {
+		return nil, err
+	}
+	if stats.Memory.Limit, err = m.readUint("memory.max"); err != nil {
+		return nil, err
+	}
+	memoryStat, err := m.readIfExists("memory.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.Memory.Stat = parseFlatKeyed(memoryStat)
+
+	ioStat, err := m.readIfExists("io.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.IO = parseIOStat(ioStat)
+
+	if stats.Pids.Current, err = m.readUint("pids.current"); err != nil {
+		return nil, err
+	}
+	if stats.Pids.Limit, err = m.readUint("pids.max"); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// OOMKillCount 返回 cgroup 中因为内存超出限制被杀掉的进程数，读取 memory.events 的 oom_kill
+func (m *Manager) OOMKillCount() (uint64, error) {
+	content, err := m.readIfExists("memory.events")
+	if err != nil {
+		return 0, err
+	}
+	return parseFlatKeyed(content)["oom_kill"], nil
+}
+
+// readIfExists 读取 cgroup 文件，控制器没有开启时文件不存在，返回空字符串
+func (m *Manager) readIfExists(file string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(m.Dir(), file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("read %s error: %v", path.Join(m.Path, file), err)
+	}
+	return string(data), nil
+}
+
+// readUint 读取只有一个数值的文件，"max" 和文件不存在都返回 0
+func (m *Manager) readUint(file string) (uint64, error) {
+	value, err := m.readIfExists(file)
+	if err != nil {
+		return 0, err
+	}
+	value = strings.TrimSpace(value)
+	if value == "" || value == "max" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s error: %v", path.Join(m.Path, file), err)
+	}
+	return n, nil
+}
+
+// parseFlatKeyed 解析每行 "key value" 格式的文件，比如 cpu.stat 和 memory.stat
+func parseFlatKeyed(content string) map[string]uint64 {
+	values := map[string]uint64{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = n
+		}
+	}
+	return values
+}
+
+// parseIOStat 解析 io.stat，每行格式为 "8:0 rbytes=1 wbytes=2 rios=3 wios=4 ..."，累加所有设备
+func parseIOStat(content string) IOStats {
+	var stats IOStats
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			n, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "rbytes":
+				stats.ReadBytes += n
+			case "wbytes":
+				stats.WriteBytes += n
+			case "rios":
+				stats.ReadOps += n
+			case "wios":
+				stats.WriteOps += n
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,66 @@
+/*
+@Time :    2022/3/29 22:50
+@Author :  liuzhi
+@File :    config
+@Software: GoLand
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultPath 全局配置文件的默认位置，文件不存在时全部使用默认值
+const DefaultPath = "/etc/my-container/config.json"
+
+// EnvPath 通过环境变量指定配置文件
+const EnvPath = "MY_CONTAINER_CONFIG"
+
+// Config 全局配置
+type Config struct {
+	// Firewall 防火墙后端：auto、iptables 或 nftables，默认 auto
+	Firewall string `json:"firewall,omitempty"`
+	// ContainerIfPrefix 容器中网卡名的前缀，默认 eth，网卡依次命名为 eth0、eth1
+	ContainerIfPrefix string `json:"containerIfPrefix,omitempty"`
+}
+
+var (
+	global     = &Config{}
+	globalPath = DefaultPath
+)
+
+// Load 读取全局配置，只有默认位置的配置文件允许不存在
+func Load(path string) error {
+	if path == "" {
+		path = DefaultPath
+	}
+	globalPath = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == DefaultPath {
+			global = &Config{}
+			return nil
+		}
+		return fmt.Errorf("read config %s error: %v", path, err)
+	}
+	conf := &Config{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return fmt.Errorf("parse config %s error: %v", path, err)
+	}
+	global = conf
+	return nil
+}
+
+// Get 返回当前的全局配置
+func Get() *Config {
+	return global
+}
+
+// Path 返回加载的配置文件路径，启动 shim 时通过 --config 传递，保证使用同一份配置
+func Path() string {
+	return globalPath
+}
@@ -0,0 +1,297 @@
+/*
+@Time :    2022/3/10 20:30
+@Author :  liuzhi
+@File :    capabilities
+@Software: GoLand
+*/
+
+package container
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capabilityList capability 名称 -> 编号，参考 linux/capability.h
+var capabilityList = map[string]uint{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// DefaultCapabilities 容器默认保留的 capability，和 docker 的默认集合一致
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// AllCapabilities 返回全部已知的 capability，--privileged 或 --cap-add ALL 时使用
+func AllCapabilities() []string {
+	caps := make([]string, 0, len(capabilityList))
+	for name := range capabilityList {
+		caps = append(caps, name)
+	}
+	sort.Slice(caps, func(i, j int) bool {
+		return capabilityList[caps[i]] < capabilityList[caps[j]]
+	})
+	return caps
+}
+
+// normalizeCapability 统一成 CAP_XXX 的形式，支持 net_admin、NET_ADMIN、CAP_NET_ADMIN 等写法
+func normalizeCapability(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if name == "ALL" {
+		return name, nil
+	}
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	if _, ok := capabilityList[name]; !ok {
+		return "", fmt.Errorf("unknown capability: %s", name)
+	}
+	return name, nil
+}
+
+// ParseCapabilities 校验并统一 capability 名称，不支持 ALL
+func ParseCapabilities(names []string) ([]string, error) {
+	caps := make([]string, 0, len(names))
+	for _, n := range names {
+		name, err := normalizeCapability(n)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ALL" {
+			return nil, fmt.Errorf("unknown capability: %s", n)
+		}
+		caps = append(caps, name)
+	}
+	return caps, nil
+}
+
+// TweakCapabilities 在默认集合的基础上应用 --cap-add/--cap-drop，先 drop 再 add，ALL 表示全部
+func TweakCapabilities(adds, drops []string, privileged bool) ([]string, error) {
+	if privileged {
+		return AllCapabilities(), nil
+	}
+	set := map[string]bool{}
+	for _, c := range DefaultCapabilities {
+		set[c] = true
+	}
+	for _, d := range drops {
+		name, err := normalizeCapability(d)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ALL" {
+			set = map[string]bool{}
+			continue
+		}
+		delete(set, name)
+	}
+	for _, a := range adds {
+		name, err := normalizeCapability(a)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ALL" {
+			for _, c := range AllCapabilities() {
+				set[c] = true
+			}
+			continue
+		}
+		set[name] = true
+	}
+	caps := make([]string, 0, len(set))
+	for name := range set {
+		caps = append(caps, name)
+	}
+	sort.Slice(caps, func(i, j int) bool {
+		return capabilityList[caps[i]] < capabilityList[caps[j]]
+	})
+	return caps, nil
+}
+
+// lastCap 读取内核支持的最大 capability 编号，老内核不支持新的 capability
+func lastCap() uint {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return capabilityList["CAP_AUDIT_READ"]
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return capabilityList["CAP_AUDIT_READ"]
+	}
+	return uint(last)
+}
+
+// Capabilities 进程的五组 capability，和 OCI runtime-spec 的 process.capabilities 对应
+type Capabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+// NewCapabilities run 命令使用：bounding、effective、permitted 设置成 caps，inheritable 和 ambient 保持为空
+// inheritable 不为空时带有 inheritable 文件 capability 的程序 exec 之后可以重新获得 capability（CVE-2022-24769），
+// ambient 会让非 root 用户 exec 之后依然持有 capability，这两个集合只在 OCI spec 中显式配置时才设置
+func NewCapabilities(caps []string) *Capabilities {
+	return &Capabilities{Bounding: caps, Effective: caps, Permitted: caps}
+}
+
+// capabilitySet 把 capability 名称转换成编号集合，忽略内核不支持的 capability
+func capabilitySet(names []string, last uint) (map[uint]bool, error) {
+	set := map[uint]bool{}
+	for _, name := range names {
+		c, ok := capabilityList[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability: %s", name)
+		}
+		if c <= last {
+			set[c] = true
+		}
+	}
+	return set, nil
+}
+
+// setupCapabilities 分别设置当前线程的 bounding、effective、permitted、inheritable、ambient 集合
+// 需要切换用户时在 drop bounding 集合之后切换，切换之后再设置其他集合
+// capability 是线程级别的，调用方需要锁定线程并在同一个线程上 exec
+func setupCapabilities(caps *Capabilities, user *User) error {
+	last := lastCap()
+	var sets [5]map[uint]bool
+	for i, names := range [][]string{caps.Bounding, caps.Effective, caps.Permitted, caps.Inheritable, caps.Ambient} {
+		set, err := capabilitySet(names, last)
+		if err != nil {
+			return err
+		}
+		sets[i] = set
+	}
+	bounding, effective, permitted, inheritable, ambient := sets[0], sets[1], sets[2], sets[3], sets[4]
+
+	// bounding 集合需要 CAP_SETPCAP，所以要在 capset 之前处理
+	for c := uint(0); c <= last; c++ {
+		if bounding[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil {
+			return fmt.Errorf("drop bounding capability %d error: %v", c, err)
+		}
+	}
+
+	if err := setupUser(user); err != nil {
+		return err
+	}
+
+	// capset 的 v3 版本需要两组 32 位数据
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for c := range effective {
+		data[c/32].Effective |= 1 << (c % 32)
+	}
+	for c := range permitted {
+		data[c/32].Permitted |= 1 << (c % 32)
+	}
+	for c := range inheritable {
+		data[c/32].Inheritable |= 1 << (c % 32)
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset error: %v", err)
+	}
+
+	// ambient 集合要求 capability 同时在 permitted 和 inheritable 中，4.3 以下的内核不支持
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		if len(ambient) > 0 {
+			return fmt.Errorf("ambient capabilities not supported: %v", err)
+		}
+		log.Debugf("ambient capabilities not supported: %v", err)
+		return nil
+	}
+	for c := range ambient {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("raise ambient capability %d error: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// setupUser 切换到指定的用户和组，通过 PR_SET_KEEPCAPS 保留 permitted 集合，之后由 capset 重新设置
+func setupUser(user *User) error {
+	if user == nil || (user.Uid == 0 && user.Gid == 0 && len(user.AdditionalGids) == 0) {
+		return nil
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set keepcaps error: %v", err)
+	}
+	gids := make([]int, 0, len(user.AdditionalGids))
+	for _, gid := range user.AdditionalGids {
+		gids = append(gids, int(gid))
+	}
+	if err := syscall.Setgroups(gids); err != nil {
+		return fmt.Errorf("setgroups error: %v", err)
+	}
+	if err := syscall.Setgid(int(user.Gid)); err != nil {
+		return fmt.Errorf("setgid %d error: %v", user.Gid, err)
+	}
+	if err := syscall.Setuid(int(user.Uid)); err != nil {
+		return fmt.Errorf("setuid %d error: %v", user.Uid, err)
+	}
+	return unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0)
+}
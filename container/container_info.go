@@ -0,0 +1,262 @@
+/*
+@Time :    2022/3/13 20:05
+@Author :  liuzhi
+@File :    container_info
+@Software: GoLand
+*/
+
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 容器状态
+const (
+	Created    = "created"
+	Running    = "running"
+	Paused     = "paused"
+	Restarting = "restarting"
+	Stopped    = "stopped"
+	Exited     = "exited"
+)
+
+const (
+	// DefaultInfoLocation 容器信息的存放目录，每个容器一个子目录
+	DefaultInfoLocation = "/var/run/my-container/containers/"
+	ConfigName          = "config.json"
+	InitConfigName      = "init.json"
+	ContainerLogFile    = "container.log"
+	lockName            = ".lock"
+)
+
+// RestartPolicy 重启策略：no、on-failure[:max]、always、unless-stopped
+type RestartPolicy struct {
+	Name              string `json:"name"`
+	MaximumRetryCount int    `json:"maximumRetryCount"`
+}
+
+// ParseRestartPolicy 解析 --restart 参数
+func ParseRestartPolicy(policy string) (RestartPolicy, error) {
+	p := RestartPolicy{Name: "no"}
+	if policy == "" {
+		return p, nil
+	}
+	parts := strings.SplitN(policy, ":", 2)
+	p.Name = parts[0]
+	switch p.Name {
+	case "no", "always", "unless-stopped":
+		if len(parts) == 2 {
+			return p, fmt.Errorf("maximum retry count cannot be used with restart policy '%s'", p.Name)
+		}
+	case "on-failure":
+		if len(parts) == 2 {
+			count, err := strconv.Atoi(parts[1])
+			if err != nil || count < 0 {
+				return p, fmt.Errorf("invalid maximum retry count: %s", parts[1])
+			}
+			p.MaximumRetryCount = count
+		}
+	default:
+		return p, fmt.Errorf("invalid restart policy '%s'", p.Name)
+	}
+	return p, nil
+}
+
+// ShouldRestart 容器退出后是否需要重启，用户主动 stop 的容器任何策略下都不会重启
+// 没有常驻的 daemon，所以 always 和 unless-stopped 的行为一致
+func (p RestartPolicy) ShouldRestart(exitCode int, restartCount int, stoppedByUser bool) bool {
+	if stoppedByUser {
+		return false
+	}
+	switch p.Name {
+	case "always", "unless-stopped":
+		return true
+	case "on-failure":
+		if exitCode == 0 {
+			return false
+		}
+		return p.MaximumRetryCount == 0 || restartCount < p.MaximumRetryCount
+	}
+	return false
+}
+
+// ParseLabels 解析 --label key=value，只有 key 时值为空字符串
+func ParseLabels(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid label: %s", arg)
+		}
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels, nil
+}
+
+// NewContainerId 生成容器 ID，12 位随机 16 进制字符串
+func NewContainerId() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("generate container id error %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Dir 容器信息的存放目录
+func (info *ContainerInfo) Dir() string {
+	return path.Join(DefaultInfoLocation, info.Id)
+}
+
+// Dump 把容器信息写入 config.json，先写临时文件再 rename，避免读到写了一半的文件
+func (info *ContainerInfo) Dump() error {
+	dir := info.Dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	infoJson, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, ConfigName+".tmp")
+	if err := ioutil.WriteFile(tmp, infoJson, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, ConfigName))
+}
+
+// Remove 删除容器信息目录
+func (info *ContainerInfo) Remove() error {
+	return os.RemoveAll(info.Dir())
+}
+
+// loadContainerInfo 读取 id 对应的容器信息
+func loadContainerInfo(id string) (*ContainerInfo, error) {
+	infoJson, err := ioutil.ReadFile(path.Join(DefaultInfoLocation, id, ConfigName))
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{}
+	if err := json.Unmarshal(infoJson, info); err != nil {
+		return nil, fmt.Errorf("decode container %s info error: %v", id, err)
+	}
+	return info, nil
+}
+
+// GetContainerInfo 通过容器 ID 或容器名查找容器信息
+func GetContainerInfo(nameOrId string) (*ContainerInfo, error) {
+	if info, err := loadContainerInfo(nameOrId); err == nil {
+		return info, nil
+	}
+	infos, err := ListContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name == nameOrId {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("no such container: %s", nameOrId)
+}
+
+// ListContainerInfos 读取所有容器的信息
+func ListContainerInfos() ([]*ContainerInfo, error) {
+	dirs, err := ioutil.ReadDir(DefaultInfoLocation)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var infos []*ContainerInfo
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		info, err := loadContainerInfo(dir.Name())
+		if err != nil {
+			log.Errorf("load container %s info error %v", dir.Name(), err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// UpdateContainerInfo 加锁读取容器信息，修改之后写回
+// shim 和 stop 等命令会同时修改同一个容器的信息，通过文件锁串行化
+func UpdateContainerInfo(id string, update func(info *ContainerInfo)) (*ContainerInfo, error) {
+	lockFile, err := os.OpenFile(path.Join(DefaultInfoLocation, id, lockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func(lockFile *os.File) {
+		_ = lockFile.Close()
+	}(lockFile)
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	info, err := loadContainerInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	update(info)
+	return info, info.Dump()
+}
+
+// DumpInitConfig 保存 init 配置，shim 重启容器时需要重新发送给 init 进程
+func DumpInitConfig(id string, conf *InitConfig) error {
+	confJson, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(DefaultInfoLocation, id, InitConfigName), confJson, 0644)
+}
+
+// LoadInitConfig 读取保存的 init 配置
+func LoadInitConfig(id string) (*InitConfig, error) {
+	confJson, err := ioutil.ReadFile(path.Join(DefaultInfoLocation, id, InitConfigName))
+	if err != nil {
+		return nil, err
+	}
+	conf := &InitConfig{}
+	if err := json.Unmarshal(confJson, conf); err != nil {
+		return nil, fmt.Errorf("decode container %s init config error: %v", id, err)
+	}
+	return conf, nil
+}
+
+// ProcessAlive 判断进程是否还存在，僵尸进程视为已经退出
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// 格式为 pid (comm) state ...，comm 中可能有空格，从最后一个 ')' 之后取状态
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
@@ -9,30 +9,97 @@ package container
 
 import (
 	log "github.com/sirupsen/logrus"
+	"my-container/landlock"
+	"my-container/seccomp"
 	"os"
 	"os/exec"
 	"syscall"
 )
 
 type ContainerInfo struct {
-	Pid         string   `json:"pid"`         // 容器的init进程在宿主机上的 PID
-	Id          string   `json:"id"`          // 容器Id
-	Name        string   `json:"name"`        // 容器名
-	Command     string   `json:"command"`     // 容器内init运行命令
-	CreatedTime string   `json:"createTime"`  // 创建时间
-	Status      string   `json:"status"`      // 容器的状态
-	Volume      string   `json:"volume"`      // 容器的数据卷
-	PortMapping []string `json:"portMapping"` // 端口映射
+	Pid           string            `json:"pid"`                   // 容器的init进程在宿主机上的 PID
+	Id            string            `json:"id"`                    // 容器Id
+	Name          string            `json:"name"`                  // 容器名
+	Command       string            `json:"command"`               // 容器内init运行命令
+	CreatedTime   string            `json:"createTime"`            // 创建时间
+	Status        string            `json:"status"`                // 容器的状态
+	Volume        string            `json:"volume"`                // 容器的数据卷
+	PortMapping   []string          `json:"portMapping"`           // 端口映射
+	ShimPid       string            `json:"shimPid"`               // 负责监管容器进程的 shim 的 PID
+	RestartPolicy RestartPolicy     `json:"restartPolicy"`         // 重启策略
+	RestartCount  int               `json:"restartCount"`          // 已经重启的次数
+	ExitCode      int               `json:"exitCode"`              // 最近一次退出的退出码
+	StoppedByUser bool              `json:"stoppedByUser"`         // 是否被用户主动 stop，是则不再重启
+	Healthcheck   *HealthConfig     `json:"healthcheck,omitempty"` // 健康检查配置
+	Health        *HealthState      `json:"health,omitempty"`      // 健康状态
+	Bundle        string            `json:"bundle,omitempty"`      // oci 命令创建的容器对应的 bundle 目录
+	CgroupPath    string            `json:"cgroupPath,omitempty"`  // 容器的 cgroup，相对于 cgroup 挂载点
+	Labels        map[string]string `json:"labels,omitempty"`      // 用户通过 --label 设置的标签
+	Networks      []string          `json:"networks,omitempty"`    // 容器连接的网络
 }
 
+// InitConfig 父进程通过管道传递给容器 init 进程的配置
+type InitConfig struct {
+	Seccomp         *seccomp.Profile  `json:"seccomp,omitempty"`       // seccomp 配置，nil 表示不限制(unconfined)
+	Capabilities    *Capabilities     `json:"capabilities,omitempty"`  // 各个集合保留的 capability，nil 表示不做调整
+	NoNewPrivileges bool              `json:"noNewPrivileges"`         // 是否设置 no_new_privs
+	ReadonlyRootfs  bool              `json:"readonlyRootfs"`          // 根目录是否只读
+	Tmpfs           map[string]string `json:"tmpfs,omitempty"`         // tmpfs 挂载点 -> 挂载选项
+	MaskedPaths     []string          `json:"maskedPaths,omitempty"`   // 屏蔽的路径
+	ReadonlyPaths   []string          `json:"readonlyPaths,omitempty"` // 只读的路径
+	Landlock        *landlock.Policy  `json:"landlock,omitempty"`      // landlock 策略，nil 表示不启用
+
+	// 以下配置主要给 oci 命令使用，run 命令使用宿主机的根目录和环境变量
+	Args     []string `json:"args,omitempty"`     // 完整的命令和参数，为空时使用 init 的命令行参数
+	Env      []string `json:"env,omitempty"`      // 环境变量，nil 表示继承 init 的环境变量
+	Cwd      string   `json:"cwd,omitempty"`      // 工作目录
+	Hostname string   `json:"hostname,omitempty"` // 主机名
+	Rootfs   string   `json:"rootfs,omitempty"`   // 根文件系统目录，为空时不切换根目录
+	Mounts   []Mount  `json:"mounts,omitempty"`   // 切换根目录之前挂载到 rootfs 中的挂载点
+	User     *User    `json:"user,omitempty"`     // 运行用户，nil 表示 root
+	Rlimits  []Rlimit `json:"rlimits,omitempty"`  // 资源限制
+	ExecFifo string   `json:"execFifo,omitempty"` // 不为空时 exec 之前等待 start 命令打开这个 fifo
+}
+
+// Mount 挂载点，Destination 是容器内的路径
+type Mount struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+}
+
+// User 容器进程的用户
+type User struct {
+	Uid            uint32   `json:"uid"`
+	Gid            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// Rlimit 资源限制，Type 是 RLIMIT_* 对应的数值
+type Rlimit struct {
+	Type int    `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// DefaultCloneFlags 容器进程默认创建的 namespace
+const DefaultCloneFlags = syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID |
+	syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC
+
 // NewParentProcess 创建一个 cmd 设置参数
-func NewParentProcess(tty bool, command string) *exec.Cmd {
+// 返回的同步管道用于在进程启动后和 init 交换消息，子进程从 fd 3 读取，协议见 sync.go
+func NewParentProcess(tty bool, command string) (*exec.Cmd, *ParentPipe) {
+	pipe, err := newSyncPipes()
+	if err != nil {
+		log.Error(err)
+		return nil, nil
+	}
 	args := []string{"init", command}
 	log.Debug("执行参数为：", args)
 	cmd := exec.Command("/proc/self/exe", args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID |
-			syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		Cloneflags: DefaultCloneFlags,
 	}
 	// 重定向到标准流
 	if tty {
@@ -40,5 +107,7 @@ func NewParentProcess(tty bool, command string) *exec.Cmd {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 	}
-	return cmd
+	// 同步管道的 init 一端作为子进程的第 4 个文件描述符(0,1,2 之后)
+	cmd.ExtraFiles = []*os.File{pipe.child}
+	return cmd, pipe
 }
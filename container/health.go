@@ -0,0 +1,125 @@
+/*
+@Time :    2022/3/14 20:20
+@Author :  liuzhi
+@File :    health
+@Software: GoLand
+*/
+
+package container
+
+import (
+	"bytes"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// 健康状态
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// 最多保留的检查结果数量
+const MaxHealthLogEntries = 5
+
+// 检查命令输出最多保留的字节数
+const maxHealthOutput = 4096
+
+// HealthConfig 健康检查配置，对应 run 的 --health-* 参数
+type HealthConfig struct {
+	Test               string        `json:"test"`               // 检查命令，通过 /bin/sh -c 在容器中执行
+	Interval           time.Duration `json:"interval"`           // 两次检查的间隔
+	Timeout            time.Duration `json:"timeout"`            // 单次检查的超时时间
+	Retries            int           `json:"retries"`            // 连续失败多少次认为不健康
+	StartPeriod        time.Duration `json:"startPeriod"`        // 启动阶段的失败不计入连续失败次数
+	RestartOnUnhealthy bool          `json:"restartOnUnhealthy"` // 不健康时是否重启容器
+}
+
+// HealthState 当前的健康状态和最近几次检查结果
+type HealthState struct {
+	Status        string          `json:"status"`
+	FailingStreak int             `json:"failingStreak"`
+	Log           []*HealthResult `json:"log"`
+}
+
+// HealthResult 单次检查结果
+type HealthResult struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	Output   string    `json:"output"`
+}
+
+// AddResult 记录一次检查结果并更新状态，inStartPeriod 时失败不计数
+func (h *HealthState) AddResult(result *HealthResult, retries int, inStartPeriod bool) {
+	h.Log = append(h.Log, result)
+	if len(h.Log) > MaxHealthLogEntries {
+		h.Log = h.Log[len(h.Log)-MaxHealthLogEntries:]
+	}
+	if result.ExitCode == 0 {
+		h.Status = HealthHealthy
+		h.FailingStreak = 0
+		return
+	}
+	if inStartPeriod {
+		return
+	}
+	h.FailingStreak++
+	if h.FailingStreak >= retries {
+		h.Status = HealthUnhealthy
+	}
+}
+
+// ExecCommand 构造在容器的 namespace 中执行命令的 cmd
+// Go 程序是多线程的，不能直接 setns 进入 mount namespace，所以借助 nsenter 完成
+func ExecCommand(pid string, command string) *exec.Cmd {
+	return exec.Command("nsenter", "--target", pid,
+		"--mount", "--uts", "--ipc", "--net", "--pid",
+		"--", "/bin/sh", "-c", command)
+}
+
+// RunHealthCommand 执行一次检查命令，超时则杀掉检查命令的整个进程组
+// nsenter 会 fork 出真正的检查进程，只杀 nsenter 的话子进程还持有输出管道，Wait 会一直等到检查进程自己退出
+func RunHealthCommand(cmd *exec.Cmd, timeout time.Duration) *HealthResult {
+	result := &HealthResult{Start: time.Now()}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		result.End = time.Now()
+		result.ExitCode = -1
+		result.Output = err.Error()
+		return result
+	}
+	timer := time.AfterFunc(timeout, func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timedOut := !timer.Stop()
+	result.End = time.Now()
+
+	switch {
+	case timedOut:
+		result.ExitCode = -1
+		output.Reset()
+		output.WriteString("Health check exceeded timeout (" + timeout.String() + ")")
+	case err == nil:
+		result.ExitCode = 0
+	default:
+		result.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				result.ExitCode = status.ExitStatus()
+			}
+		}
+	}
+	out := output.Bytes()
+	if len(out) > maxHealthOutput {
+		out = out[:maxHealthOutput]
+	}
+	result.Output = string(out)
+	return result
+}
@@ -8,27 +8,176 @@
 package container
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"my-container/landlock"
+	"my-container/seccomp"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 )
 
 func RunContainerInitProcess(cmd string, args []string) error {
 	log.Infof("进入RunContainerInitProcess, command %s", cmd)
+	pipe := openChildPipe()
+	conf, err := pipe.readConfig()
+	if err == nil {
+		err = stageError("sync", pipe.waitRun())
+	}
+	if err == nil {
+		err = initContainer(pipe, conf, cmd)
+	}
+	// 走到这里说明没有 exec 成功，把原因告诉父进程
+	err = stageError("init", err)
+	pipe.reportError(err)
+	return err
+}
+
+// initContainer 初始化容器环境并执行用户命令，成功时不会返回，失败时返回带有步骤的 *InitError
+func initContainer(pipe *childPipe, conf *InitConfig, cmd string) error {
+	var err error
+	// exec fifo 在宿主机的目录中，切换根目录之后就访问不到了，先以 O_PATH 打开
+	fifoFd := -1
+	if conf.ExecFifo != "" {
+		if fifoFd, err = unix.Open(conf.ExecFifo, unix.O_PATH|unix.O_CLOEXEC, 0); err != nil {
+			return stageError("fifo", fmt.Errorf("open exec fifo error: %v", err))
+		}
+	}
 	// Systemd 加入linux之后, mount namespace 就变成 shared by default, 所以你必须显示
 	// 声明你要这个新的mount namespace独立。
 	// 具体细节参考namespace关于mount的描述
 	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
-		return err
+		return stageError("mount", err)
 	}
-	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
-	if err := syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), ""); err != nil {
-		return err
+	if conf.Rootfs != "" {
+		// 指定了根文件系统时，/proc 等挂载点由 Mounts 配置
+		if err := pivotRoot(conf); err != nil {
+			return stageError("rootfs", err)
+		}
+	} else {
+		defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
+		if err := syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), ""); err != nil {
+			return stageError("mount", err)
+		}
+	}
+	if conf.Hostname != "" {
+		if err := unix.Sethostname([]byte(conf.Hostname)); err != nil {
+			return stageError("hostname", fmt.Errorf("set hostname error: %v", err))
+		}
+	}
+	if err := setupRootfs(conf); err != nil {
+		return stageError("rootfs", err)
+	}
+	if conf.Cwd != "" {
+		if err := os.Chdir(conf.Cwd); err != nil {
+			return stageError("cwd", fmt.Errorf("chdir to %s error: %v", conf.Cwd, err))
+		}
 	}
+	for _, rlimit := range conf.Rlimits {
+		if err := unix.Setrlimit(rlimit.Type, &unix.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}); err != nil {
+			return stageError("rlimit", fmt.Errorf("set rlimit %d error: %v", rlimit.Type, err))
+		}
+	}
+
 	argv := []string{cmd}
+	if len(conf.Args) > 0 {
+		argv = conf.Args
+	}
+	env := os.Environ()
+	if conf.Env != nil {
+		env = conf.Env
+	}
+	// 和 shell 一样，命令不是路径时在 PATH 中查找
+	argv0, err := lookPath(argv[0], env)
+	if err != nil {
+		return stageError("exec", err)
+	}
+	if err := pipe.ready(); err != nil {
+		return stageError("sync", fmt.Errorf("send %s error: %v", SyncProcReady, err))
+	}
+
+	// capability 和 seccomp 过滤器都是线程级别的，所以锁定线程，保证设置和 exec 在同一个线程上
+	runtime.LockOSThread()
+	if fifoFd >= 0 {
+		if err := waitExecFifo(fifoFd); err != nil {
+			return stageError("fifo", err)
+		}
+	}
+	if err := finalizeSecurity(conf); err != nil {
+		return stageError("security", err)
+	}
 	// 相当于执行内核的 execve 系统调用
-	if err := syscall.Exec(cmd, argv, os.Environ()); err != nil {
-		log.Error(err.Error())
+	return stageError("exec", syscall.Exec(argv0, argv, env))
+}
+
+// waitExecFifo 以写方式打开 exec fifo，会阻塞到 start 命令以读方式打开为止
+// 通过 /proc/self/fd 重新打开之前以 O_PATH 打开的 fifo，所以容器中需要挂载 /proc
+func waitExecFifo(fifoFd int) error {
+	fifo, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fifoFd), os.O_WRONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open exec fifo for write error: %v", err)
+	}
+	defer func(fifo *os.File) {
+		_ = fifo.Close()
+	}(fifo)
+	_ = unix.Close(fifoFd)
+	if _, err := fifo.Write([]byte{0}); err != nil {
+		return fmt.Errorf("write exec fifo error: %v", err)
 	}
 	return nil
 }
+
+// lookPath 在 env 的 PATH 中查找命令
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	pathEnv := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			pathEnv = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		p := filepath.Join(dir, file)
+		if stat, err := os.Stat(p); err == nil && !stat.IsDir() && stat.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable file not found in $PATH: %s", file)
+}
+
+// finalizeSecurity 在 exec 之前设置 no_new_privs、capability、landlock 和 seccomp
+// 安装 seccomp 过滤器和 landlock 策略需要 no_new_privs 或者 CAP_SYS_ADMIN，所以没有设置 no_new_privs 时要在 drop capability 之前安装，
+// 设置了 no_new_privs 则放到最后，尽量少拦截 init 自身的系统调用
+func finalizeSecurity(conf *InitConfig) error {
+	if conf.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("set no_new_privs error: %v", err)
+		}
+	} else if err := restrictSelf(conf); err != nil {
+		return err
+	}
+	if conf.Capabilities != nil {
+		if err := setupCapabilities(conf.Capabilities, conf.User); err != nil {
+			return err
+		}
+	} else if err := setupUser(conf.User); err != nil {
+		return err
+	}
+	if conf.NoNewPrivileges {
+		return restrictSelf(conf)
+	}
+	return nil
+}
+
+// restrictSelf 应用 landlock 策略和 seccomp 过滤器，seccomp 放在最后，避免拦截 landlock 的系统调用
+func restrictSelf(conf *InitConfig) error {
+	if err := landlock.Restrict(conf.Landlock); err != nil {
+		return err
+	}
+	return seccomp.InitSeccomp(conf.Seccomp)
+}
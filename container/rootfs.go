@@ -0,0 +1,334 @@
+/*
+@Time :    2022/3/11 21:20
+@Author :  liuzhi
+@File :    rootfs
+@Software: GoLand
+*/
+
+package container
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"my-container/archive"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// DefaultMaskedPaths 默认屏蔽的路径，容器内看到的是空目录或者 /dev/null
+var DefaultMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+// DefaultReadonlyPaths 默认只读的内核路径
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// ReadonlyRootfsTmpfs 只读 rootfs 时自动挂载 tmpfs 的目录，保证程序有地方写临时文件
+var ReadonlyRootfsTmpfs = []string{"/tmp", "/run"}
+
+// mount 选项中可以转换成 flag 的部分，其余的原样作为 data 传给文件系统
+var mountFlags = map[string]uintptr{
+	"ro":          syscall.MS_RDONLY,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"bind":        syscall.MS_BIND,
+	"rbind":       syscall.MS_BIND | syscall.MS_REC,
+}
+
+// 指定了根文件系统时，从宿主机 bind mount 到容器 /dev 下的设备
+var defaultDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// /dev 下的标准软链接
+var defaultDevSymlinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	"ptmx":   "pts/ptmx",
+}
+
+// 默认值或者不需要处理的选项，根目录已经设置成 private，传播属性统一忽略
+var ignoredMountOptions = map[string]bool{
+	"rw": true, "suid": true, "dev": true, "exec": true, "async": true, "atime": true, "diratime": true,
+	"private": true, "rprivate": true, "shared": true, "rshared": true,
+	"slave": true, "rslave": true, "unbindable": true, "runbindable": true,
+}
+
+// 不带值但需要作为 data 传给文件系统的选项
+var dataMountOptions = map[string]bool{"newinstance": true}
+
+// ParseMountOptions 把 "ro,noexec,size=64m" 这样的选项拆成 mount flag 和 data
+func ParseMountOptions(options string) (uintptr, string, error) {
+	var flags uintptr
+	var data []string
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" || ignoredMountOptions[opt] {
+			continue
+		}
+		if f, ok := mountFlags[opt]; ok {
+			flags |= f
+			continue
+		}
+		// 没有值的文件系统选项，比如 devpts 的 newinstance
+		if !strings.Contains(opt, "=") && !dataMountOptions[opt] {
+			return 0, "", fmt.Errorf("unknown mount option: %s", opt)
+		}
+		data = append(data, opt)
+	}
+	return flags, strings.Join(data, ","), nil
+}
+
+// setupRootfs 挂载 tmpfs、屏蔽敏感路径、设置只读路径，最后按需把根目录重新挂载为只读
+// 需要在 /proc 挂载之后、seccomp 安装之前执行，指定了 rootfs 时 tmpfs 已经在 pivotRoot 中挂载
+// 只读 rootfs 只作用于根挂载点本身，/proc、/dev、tmpfs 和 -v 挂载的卷是独立的挂载点，保持各自的读写属性
+func setupRootfs(conf *InitConfig) error {
+	if conf.Rootfs == "" {
+		if err := mountTmpfsDirs("", conf.Tmpfs); err != nil {
+			return err
+		}
+	}
+	for _, p := range conf.MaskedPaths {
+		if err := maskPath(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range conf.ReadonlyPaths {
+		if err := readonlyPath(p); err != nil {
+			return err
+		}
+	}
+	if conf.ReadonlyRootfs {
+		// 只改变当前 mount namespace 中根挂载点的只读标记，不影响宿主机
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+			return fmt.Errorf("remount rootfs readonly error: %v", err)
+		}
+	}
+	return nil
+}
+
+// mountTmpfsDirs 在 root 中挂载 tmpfs，挂载点和 mountToRootfs 一样通过 SecureJoin 在 root 中解析并创建
+// root 为空时容器和宿主机共享根目录，挂载点必须已经存在，不能在宿主机上创建目录
+func mountTmpfsDirs(root string, tmpfs map[string]string) error {
+	// 按路径排序，父目录先于子目录挂载，否则子目录的 tmpfs 会被父目录的 tmpfs 盖住
+	targets := make([]string, 0, len(tmpfs))
+	for target := range tmpfs {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		dest := target
+		if root != "" {
+			var err error
+			if dest, err = archive.SecureJoin(root, target); err != nil {
+				return fmt.Errorf("resolve tmpfs mount point %s error: %v", target, err)
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return fmt.Errorf("create tmpfs mount point %s error: %v", target, err)
+			}
+		} else if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+			return fmt.Errorf("tmpfs mount point %s must be an existing directory when the container has no rootfs", target)
+		}
+		if err := mountTmpfs(dest, tmpfs[target]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountTmpfs 在 target 挂载 tmpfs，默认 nosuid、nodev
+func mountTmpfs(target, options string) error {
+	flags, data, err := ParseMountOptions(options)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", target, "tmpfs", flags|syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+		return fmt.Errorf("mount tmpfs on %s error: %v", target, err)
+	}
+	return nil
+}
+
+// maskPath 屏蔽路径：目录用只读的空 tmpfs 覆盖，文件用 /dev/null 覆盖，不存在的路径忽略
+func maskPath(p string) error {
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if stat.IsDir() {
+		err = syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY, "")
+	} else {
+		err = syscall.Mount("/dev/null", p, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mask path %s error: %v", p, err)
+	}
+	return nil
+}
+
+// readonlyPath 先 bind mount 到自身，再重新挂载为只读(bind mount 第一次挂载时不会应用 MS_RDONLY)
+func readonlyPath(p string) error {
+	if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("bind mount %s error: %v", p, err)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount(p, p, "", flags, ""); err != nil {
+		// 部分文件系统的挂载标记不允许修改，去掉附加标记再试一次
+		log.Debugf("remount %s readonly with nosuid,nodev,noexec error: %v", p, err)
+		if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("remount %s readonly error: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// pivotRoot 挂载 Mounts 和设备到 rootfs 中，然后通过 pivot_root 切换根目录并卸载旧的根目录
+func pivotRoot(conf *InitConfig) error {
+	root := conf.Rootfs
+	// pivot_root 要求新的根目录是一个挂载点，bind mount 到自身
+	if err := syscall.Mount(root, root, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount rootfs %s error: %v", root, err)
+	}
+	for _, m := range conf.Mounts {
+		if err := mountToRootfs(root, m); err != nil {
+			return err
+		}
+	}
+	setupDevices(root)
+	if err := mountTmpfsDirs(root, conf.Tmpfs); err != nil {
+		return err
+	}
+
+	pivotDir := filepath.Join(root, ".pivot_root")
+	if err := os.Mkdir(pivotDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// 旧的根目录挂载到 rootfs/.pivot_root 上
+	if err := syscall.PivotRoot(root, pivotDir); err != nil {
+		return fmt.Errorf("pivot_root error: %v", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir / error: %v", err)
+	}
+	pivotDir = "/.pivot_root"
+	if err := syscall.Unmount(pivotDir, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount pivot_root dir error: %v", err)
+	}
+	return os.Remove(pivotDir)
+}
+
+// mountToRootfs 把一个挂载点挂载到 rootfs 中
+// 挂载点通过 SecureJoin 在 rootfs 中解析，bundle 里指向外部的软链接不会让挂载落到宿主机的路径上
+func mountToRootfs(root string, m Mount) error {
+	dest, err := archive.SecureJoin(root, m.Destination)
+	if err != nil {
+		return fmt.Errorf("resolve mount destination %s error: %v", m.Destination, err)
+	}
+	flags, data, err := ParseMountOptions(strings.Join(m.Options, ","))
+	if err != nil {
+		return fmt.Errorf("mount %s: %v", m.Destination, err)
+	}
+	if flags&syscall.MS_BIND == 0 {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		fsType := m.Type
+		if fsType == "cgroup" {
+			// 只支持 cgroup v2，挂载失败不影响容器启动
+			if err := syscall.Mount("cgroup2", dest, "cgroup2", flags, data); err != nil {
+				log.Warnf("mount cgroup2 on %s error: %v", m.Destination, err)
+			}
+			return nil
+		}
+		if err := syscall.Mount(m.Source, dest, fsType, flags, data); err != nil {
+			return fmt.Errorf("mount %s on %s error: %v", fsType, m.Destination, err)
+		}
+		return nil
+	}
+
+	// bind mount 的目标要和源的类型一致，文件对应文件，目录对应目录
+	stat, err := os.Stat(m.Source)
+	if err != nil {
+		return fmt.Errorf("bind mount source %s error: %v", m.Source, err)
+	}
+	if err := createMountPoint(dest, stat.IsDir()); err != nil {
+		return err
+	}
+	if err := syscall.Mount(m.Source, dest, "", flags&(syscall.MS_BIND|syscall.MS_REC), ""); err != nil {
+		return fmt.Errorf("bind mount %s on %s error: %v", m.Source, m.Destination, err)
+	}
+	// bind mount 第一次挂载时只有 MS_BIND 和 MS_REC 生效，其他标记需要 remount
+	if extra := flags &^ (syscall.MS_BIND | syscall.MS_REC); extra != 0 {
+		if err := syscall.Mount("", dest, "", extra|syscall.MS_BIND|syscall.MS_REMOUNT, ""); err != nil {
+			return fmt.Errorf("remount %s error: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// createMountPoint 创建挂载点，isDir 为 false 时创建空文件
+func createMountPoint(dest string, isDir bool) error {
+	if isDir {
+		return os.MkdirAll(dest, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// setupDevices 从宿主机 bind mount 常用设备到 rootfs/dev 下，并创建标准软链接，rootfs 中没有 /dev 时跳过
+func setupDevices(root string) {
+	devDir := filepath.Join(root, "dev")
+	if _, err := os.Stat(devDir); err != nil {
+		return
+	}
+	for _, dev := range defaultDevices {
+		dest := filepath.Join(devDir, dev)
+		if err := createMountPoint(dest, false); err != nil {
+			log.Warnf("create device %s error: %v", dest, err)
+			continue
+		}
+		if err := syscall.Mount(filepath.Join("/dev", dev), dest, "", syscall.MS_BIND, ""); err != nil {
+			log.Warnf("bind mount device %s error: %v", dev, err)
+		}
+	}
+	for name, target := range defaultDevSymlinks {
+		if err := os.Symlink(target, filepath.Join(devDir, name)); err != nil && !os.IsExist(err) {
+			log.Warnf("create symlink /dev/%s error: %v", name, err)
+		}
+	}
+}
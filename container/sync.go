@@ -0,0 +1,219 @@
+/*
+@Time :    2022/3/25 21:00
+@Author :  liuzhi
+@File :    sync
+@Software: GoLand
+*/
+
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// 父进程和 init 进程之间通过 socketpair 交换 json 消息，流程如下：
+//
+//	父进程 -> init: config    init 配置
+//	父进程 -> init: procRun   cgroup、网络等宿主机上的准备工作已经完成
+//	init -> 父进程: procReady 容器初始化完成，接下来等待 exec fifo 或者直接执行用户命令
+//	init -> 父进程: procError 任何一步失败时发送，之后 init 退出
+//
+// init 一端设置了 close-on-exec，用户命令执行成功后父进程读到 EOF
+const (
+	SyncConfig    = "config"
+	SyncProcRun   = "procRun"
+	SyncProcReady = "procReady"
+	SyncProcError = "procError"
+)
+
+// init 进程中同步管道的文件描述符，对应父进程 ExtraFiles 的第一个
+const initPipeFd = 3
+
+// SyncMsg 同步消息
+type SyncMsg struct {
+	Type   string      `json:"type"`
+	Config *InitConfig `json:"config,omitempty"`
+	Error  *InitError  `json:"error,omitempty"`
+}
+
+// InitError init 进程初始化失败的原因，Stage 是失败的步骤，比如 rootfs、exec
+type InitError struct {
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("container init failed at %s: %s", e.Stage, e.Message)
+}
+
+// stageError 给错误加上失败的步骤，已经是 InitError 的保持不变
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if initErr, ok := err.(*InitError); ok {
+		return initErr
+	}
+	return &InitError{Stage: stage, Message: err.Error()}
+}
+
+type syncPipe struct {
+	file *os.File
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func newSyncPipe(file *os.File) *syncPipe {
+	return &syncPipe{file: file, enc: json.NewEncoder(file), dec: json.NewDecoder(file)}
+}
+
+func (p *syncPipe) send(msg *SyncMsg) error {
+	return p.enc.Encode(msg)
+}
+
+// recv 读取下一条消息，对端关闭时返回 io.EOF
+func (p *syncPipe) recv() (*SyncMsg, error) {
+	msg := &SyncMsg{}
+	if err := p.dec.Decode(msg); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ParentPipe 父进程一端的同步管道
+type ParentPipe struct {
+	*syncPipe
+	child *os.File
+}
+
+// newSyncPipes 创建 socketpair，返回父进程一端和传给 init 的一端
+func newSyncPipes() (*ParentPipe, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create sync pipe error: %v", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "sync-parent")
+	child := os.NewFile(uintptr(fds[1]), "sync-child")
+	return &ParentPipe{syncPipe: newSyncPipe(parent), child: child}, nil
+}
+
+// CloseChild 进程启动之后关闭父进程持有的 init 一端，否则 init 退出或者 exec 之后读不到 EOF
+func (p *ParentPipe) CloseChild() {
+	_ = p.child.Close()
+}
+
+// Close 关闭两端，init 在等待 procRun 时读到 EOF 会直接退出
+func (p *ParentPipe) Close() {
+	_ = p.child.Close()
+	_ = p.file.Close()
+}
+
+// SendConfig 发送 init 配置
+func (p *ParentPipe) SendConfig(conf *InitConfig) error {
+	if err := p.send(&SyncMsg{Type: SyncConfig, Config: conf}); err != nil {
+		return fmt.Errorf("send init config error: %v", err)
+	}
+	return nil
+}
+
+// Run 通知 init 宿主机上的准备工作已经完成
+func (p *ParentPipe) Run() error {
+	if err := p.send(&SyncMsg{Type: SyncProcRun}); err != nil {
+		return fmt.Errorf("send %s error: %v", SyncProcRun, err)
+	}
+	return nil
+}
+
+// WaitReady 等待 init 完成初始化，init 失败时返回 *InitError
+func (p *ParentPipe) WaitReady() error {
+	msg, err := p.recv()
+	if err == io.EOF {
+		return &InitError{Stage: "init", Message: "init process exited unexpectedly"}
+	}
+	if err != nil {
+		return fmt.Errorf("read sync message error: %v", err)
+	}
+	switch msg.Type {
+	case SyncProcReady:
+		return nil
+	case SyncProcError:
+		if msg.Error == nil {
+			return &InitError{Stage: "init", Message: "unknown error"}
+		}
+		return msg.Error
+	}
+	return fmt.Errorf("unexpected sync message %s", msg.Type)
+}
+
+// WaitExec 在 WaitReady 之后等待用户命令开始执行，读到 EOF 说明 exec 成功
+func (p *ParentPipe) WaitExec() error {
+	msg, err := p.recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read sync message error: %v", err)
+	}
+	if msg.Type == SyncProcError && msg.Error != nil {
+		return msg.Error
+	}
+	return fmt.Errorf("unexpected sync message %s", msg.Type)
+}
+
+// childPipe init 进程一端的同步管道
+type childPipe struct {
+	*syncPipe
+}
+
+// openChildPipe 打开从父进程继承的 fd 3，并设置 close-on-exec
+func openChildPipe() *childPipe {
+	syscall.CloseOnExec(initPipeFd)
+	return &childPipe{syncPipe: newSyncPipe(os.NewFile(uintptr(initPipeFd), "sync"))}
+}
+
+// readConfig 读取父进程发送的配置
+func (p *childPipe) readConfig() (*InitConfig, error) {
+	msg, err := p.recv()
+	if err != nil {
+		return nil, fmt.Errorf("read init config error: %v", err)
+	}
+	if msg.Type != SyncConfig || msg.Config == nil {
+		return nil, fmt.Errorf("expected %s message, got %s", SyncConfig, msg.Type)
+	}
+	return msg.Config, nil
+}
+
+// waitRun 阻塞到父进程完成 cgroup、网络的配置，父进程放弃启动时会关闭管道
+func (p *childPipe) waitRun() error {
+	msg, err := p.recv()
+	if err == io.EOF {
+		return fmt.Errorf("parent process aborted")
+	}
+	if err != nil {
+		return fmt.Errorf("read sync message error: %v", err)
+	}
+	if msg.Type != SyncProcRun {
+		return fmt.Errorf("expected %s message, got %s", SyncProcRun, msg.Type)
+	}
+	return nil
+}
+
+func (p *childPipe) ready() error {
+	return p.send(&SyncMsg{Type: SyncProcReady})
+}
+
+// reportError 把失败原因发给父进程，父进程可能已经不再读取，发送失败时忽略
+func (p *childPipe) reportError(err error) {
+	initErr, ok := stageError("init", err).(*InitError)
+	if !ok {
+		return
+	}
+	_ = p.send(&SyncMsg{Type: SyncProcError, Error: initErr})
+}
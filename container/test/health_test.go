@@ -0,0 +1,56 @@
+/*
+@Time :    2022/3/14 22:10
+@Author :  liuzhi
+@File :    health_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"my-container/container"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHealthCheckTimeout sh 不会 exec 最后一条之前的命令，sleep 是孙子进程并且持有输出管道，超时时也要被杀掉
+func TestHealthCheckTimeout(t *testing.T) {
+	start := time.Now()
+	result := container.RunHealthCommand(exec.Command("/bin/sh", "-c", "sleep 30; true"), 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("health check took %s, timeout not enforced", elapsed)
+	}
+	if result.ExitCode != -1 || !strings.Contains(result.Output, "exceeded timeout") {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+// TestHealthCheckTimeoutNsenter 通过 nsenter 执行的检查命令超时，需要 root 和 nsenter
+func TestHealthCheckTimeoutNsenter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("nsenter requires root")
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter not found")
+	}
+	start := time.Now()
+	cmd := container.ExecCommand(strconv.Itoa(os.Getpid()), "sleep 30")
+	result := container.RunHealthCommand(cmd, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("health check took %s, timeout not enforced", elapsed)
+	}
+	if result.ExitCode != -1 || !strings.Contains(result.Output, "exceeded timeout") {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestHealthCheckExitCode(t *testing.T) {
+	result := container.RunHealthCommand(exec.Command("/bin/sh", "-c", "echo failed; exit 3"), time.Second)
+	if result.ExitCode != 3 || result.Output != "failed\n" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+@Time :    2022/3/23 20:05
+@Author :  liuzhi
+@File :    events
+@Software: GoLand
+*/
+
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// 没有常驻的 daemon，事件追加写入到日志文件中，events 命令读取并跟踪这个文件
+const (
+	// DefaultLogFile 事件日志的位置
+	DefaultLogFile = "/var/run/my-container/events.log"
+	// 日志超过这个大小时轮转，只保留一个旧文件
+	maxLogSize = 8 << 20
+	// 跟踪新事件时检查文件变化的间隔
+	followInterval = 100 * time.Millisecond
+)
+
+// 事件的对象类型
+const (
+	ContainerEvent = "container"
+	NetworkEvent   = "network"
+)
+
+// Actor 事件的主体，Attributes 中包含 name 等附加信息
+type Actor struct {
+	ID         string            `json:"ID"`
+	Attributes map[string]string `json:"Attributes,omitempty"`
+}
+
+// Event 一条事件，格式和 docker events 的 json 输出一致
+type Event struct {
+	Type     string `json:"Type"`
+	Action   string `json:"Action"`
+	Actor    Actor  `json:"Actor"`
+	Time     int64  `json:"time"`
+	TimeNano int64  `json:"timeNano"`
+}
+
+// Bus 基于文件的事件总线，多个进程可以同时发布事件
+type Bus struct {
+	Path string
+}
+
+var defaultBus = &Bus{Path: DefaultLogFile}
+
+// Publish 通过默认的事件总线发布事件，失败只打印日志，不影响正常流程
+func Publish(eventType, action, id string, attributes map[string]string) {
+	if err := defaultBus.Publish(eventType, action, id, attributes); err != nil {
+		log.Warnf("publish %s %s event error %v", eventType, action, err)
+	}
+}
+
+// Subscribe 读取默认事件总线上的事件
+func Subscribe(since, until time.Time, filter *Filter, follow bool, handle func(*Event) error) error {
+	return defaultBus.Subscribe(since, until, filter, follow, handle)
+}
+
+// Publish 追加一条事件，通过文件锁和其他进程的写入、轮转串行化
+func (b *Bus) Publish(eventType, action, id string, attributes map[string]string) error {
+	now := time.Now()
+	ev := &Event{
+		Type:     eventType,
+		Action:   action,
+		Actor:    Actor{ID: id, Attributes: attributes},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(b.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxLogSize {
+		// 轮转之后跟踪的进程通过 inode 变化发现新文件
+		if err := os.Rename(b.Path, b.Path+".1"); err != nil {
+			return fmt.Errorf("rotate event log error: %v", err)
+		}
+	}
+	return nil
+}
+
+// Subscribe 按时间顺序把 [since, until] 范围内匹配 filter 的事件交给 handle
+// follow 为 true 时读完历史事件之后继续等待新的事件，直到超过 until 或者 handle 返回错误
+// 和 docker 一样，跟踪时没有指定 since 只输出之后发生的事件
+func (b *Bus) Subscribe(since, until time.Time, filter *Filter, follow bool, handle func(*Event) error) error {
+	if follow && since.IsZero() {
+		since = time.Now()
+	}
+	emit := func(ev *Event) (bool, error) {
+		t := time.Unix(0, ev.TimeNano)
+		if !until.IsZero() && t.After(until) {
+			return true, nil
+		}
+		if (!since.IsZero() && t.Before(since)) || !filter.Match(ev) {
+			return false, nil
+		}
+		return false, handle(ev)
+	}
+
+	// 先读取轮转出去的旧文件
+	if !since.IsZero() {
+		if f, err := os.Open(b.Path + ".1"); err == nil {
+			_, done, err := readEvents(bufio.NewReader(f), emit)
+			_ = f.Close()
+			if err != nil || done {
+				return err
+			}
+		}
+	}
+
+	var f *os.File
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+	var reader *bufio.Reader
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(b.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if f != nil {
+				reader = bufio.NewReader(f)
+			}
+		}
+		if f != nil {
+			isRotated := rotated(f, b.Path)
+			partial, done, err := readEvents(reader, emit)
+			if err != nil || done {
+				return err
+			}
+			// 文件在读取之前已经被轮转，旧文件不会再有新的写入，切换到新文件
+			if isRotated {
+				_ = f.Close()
+				f = nil
+				continue
+			}
+			// 写了一半的行放回去，下次读取时拼接
+			reader = bufio.NewReader(io.MultiReader(bytes.NewReader(partial), f))
+		}
+		if !follow || (!until.IsZero() && time.Now().After(until)) {
+			return nil
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// readEvents 逐行读取事件直到 EOF，返回末尾不完整的行
+func readEvents(reader *bufio.Reader, emit func(*Event) (bool, error)) ([]byte, bool, error) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return line, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		ev := &Event{}
+		if err := json.Unmarshal(line, ev); err != nil {
+			log.Debugf("skip invalid event line %q", line)
+			continue
+		}
+		done, err := emit(ev)
+		if err != nil || done {
+			return nil, done, err
+		}
+	}
+}
+
+// rotated 判断打开的文件是否已经不是 path 指向的文件
+func rotated(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(opened, current)
+}
@@ -0,0 +1,109 @@
+/*
+@Time :    2022/3/23 20:40
+@Author :  liuzhi
+@File :    filter
+@Software: GoLand
+*/
+
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter events 的过滤条件，同一个 key 的多个值之间是或的关系，不同 key 之间是与的关系
+type Filter struct {
+	values map[string][]string
+}
+
+// 支持的过滤条件
+var filterKeys = map[string]bool{
+	"type":      true, // container 或 network
+	"event":     true, // 事件类型，比如 start、die
+	"container": true, // 容器的 ID 或者名称
+	"network":   true, // 网络的名称
+	"label":     true, // key 或者 key=value
+}
+
+// ParseFilter 解析 key=value 形式的过滤条件
+func ParseFilter(args []string) (*Filter, error) {
+	f := &Filter{values: map[string][]string{}}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("bad format of filter (expected name=value): %s", arg)
+		}
+		key := strings.ToLower(parts[0])
+		if !filterKeys[key] {
+			return nil, fmt.Errorf("invalid filter '%s'", key)
+		}
+		f.values[key] = append(f.values[key], parts[1])
+	}
+	return f, nil
+}
+
+// Match 判断事件是否满足所有过滤条件，nil 表示不过滤
+func (f *Filter) Match(ev *Event) bool {
+	if f == nil {
+		return true
+	}
+	if !f.matchAny("type", ev.Type) || !f.matchAny("event", ev.Action) {
+		return false
+	}
+	if values, ok := f.values["container"]; ok {
+		if ev.Type != ContainerEvent || !(contains(values, ev.Actor.ID) || contains(values, ev.Actor.Attributes["name"])) {
+			return false
+		}
+	}
+	if values, ok := f.values["network"]; ok {
+		// 容器连接和断开网络的事件也属于网络事件，网络名保存在 name 中
+		if ev.Type != NetworkEvent || !(contains(values, ev.Actor.ID) || contains(values, ev.Actor.Attributes["name"])) {
+			return false
+		}
+	}
+	for _, label := range f.values["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		value, ok := ev.Actor.Attributes[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) matchAny(key, value string) bool {
+	values, ok := f.values[key]
+	return !ok || contains(values, value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTime 解析 --since/--until，支持 RFC3339、2006-01-02 15:04:05、unix 时间戳和 10m 这样的相对时间
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if ts, err := strconv.ParseFloat(value, 64); err == nil {
+		sec := int64(ts)
+		return time.Unix(sec, int64((ts-float64(sec))*1e9)), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time format: %s", value)
+}
@@ -0,0 +1,102 @@
+/*
+@Time :    2022/3/23 21:30
+@Author :  liuzhi
+@File :    events_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"io/ioutil"
+	"my-container/events"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bus := &events.Bus{Path: path.Join(dir, "events.log")}
+	start := time.Now()
+	for _, action := range []string{"create", "start", "die"} {
+		if err := bus.Publish(events.ContainerEvent, action, "1234", map[string]string{"name": "web"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bus.Publish(events.NetworkEvent, "create", "br0", map[string]string{"name": "br0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := events.ParseFilter([]string{"container=web", "event=start", "event=die"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	err = bus.Subscribe(start, time.Time{}, filter, false, func(ev *events.Event) error {
+		actions = append(actions, ev.Action)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions[0] != "start" || actions[1] != "die" {
+		t.Fatalf("unexpected events: %v", actions)
+	}
+
+	// 跟踪模式下能收到订阅之后发布的事件，超过 until 后返回
+	received := make(chan string, 1)
+	go func() {
+		_ = bus.Subscribe(time.Time{}, time.Now().Add(time.Second), nil, true, func(ev *events.Event) error {
+			received <- ev.Action
+			return nil
+		})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := bus.Publish(events.ContainerEvent, "destroy", "1234", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case action := <-received:
+		if action != "destroy" {
+			t.Fatalf("unexpected followed event: %s", action)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("followed event not received")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	if _, err := events.ParseFilter([]string{"image=busybox"}); err == nil {
+		t.Fatalf("expected invalid filter error")
+	}
+	if _, err := events.ParseFilter([]string{"event"}); err == nil {
+		t.Fatalf("expected bad format error")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Unix(1648000000, 0)
+	cases := map[string]time.Time{
+		"10m":                  now.Add(-10 * time.Minute),
+		"1647990000":           time.Unix(1647990000, 0),
+		"2022-03-23T10:00:00Z": time.Date(2022, 3, 23, 10, 0, 0, 0, time.UTC),
+	}
+	for value, want := range cases {
+		got, err := events.ParseTime(value, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("ParseTime(%q) = %v, want %v", value, got, want)
+		}
+	}
+	if _, err := events.ParseTime("yesterday", now); err == nil {
+		t.Fatalf("expected invalid time error")
+	}
+}
@@ -0,0 +1,99 @@
+/*
+@Time :    2022/3/24 20:10
+@Author :  liuzhi
+@File :    filters
+@Software: GoLand
+*/
+
+package filters
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Args ps、network ls 的 --filter 条件，同一个 key 的多个值之间是或的关系，不同 key 之间是与的关系
+type Args struct {
+	values map[string][]string
+}
+
+// Parse 解析 key=value 形式的过滤条件，key 必须在 allowed 中
+func Parse(args []string, allowed ...string) (Args, error) {
+	f := Args{values: map[string][]string{}}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return f, fmt.Errorf("bad format of filter (expected name=value): %s", arg)
+		}
+		key := strings.ToLower(parts[0])
+		if !contains(allowed, key) {
+			// allowed 可能是调用方的包级变量，排序副本，不修改调用方的切片
+			names := append([]string(nil), allowed...)
+			sort.Strings(names)
+			return f, fmt.Errorf("invalid filter '%s', available filters: %s", key, strings.Join(names, ", "))
+		}
+		f.values[key] = append(f.values[key], parts[1])
+	}
+	return f, nil
+}
+
+// Get 返回 key 对应的所有值
+func (f Args) Get(key string) []string {
+	return f.values[key]
+}
+
+// Match 没有 key 对应的条件，或者 value 等于其中一个值
+func (f Args) Match(key, value string) bool {
+	values, ok := f.values[key]
+	return !ok || contains(values, value)
+}
+
+// MatchAny 没有 key 对应的条件，或者 candidates 中至少有一个等于条件中的值
+func (f Args) MatchAny(key string, candidates ...string) bool {
+	values, ok := f.values[key]
+	if !ok {
+		return true
+	}
+	for _, c := range candidates {
+		if contains(values, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSubstring 没有 key 对应的条件，或者 value 包含其中一个值，用于按名称模糊过滤
+func (f Args) MatchSubstring(key, value string) bool {
+	values, ok := f.values[key]
+	if !ok {
+		return true
+	}
+	for _, v := range values {
+		if strings.Contains(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchLabels label 条件之间是与的关系，只有 key 时要求标签存在，key=value 时要求值相等
+func (f Args) MatchLabels(key string, labels map[string]string) bool {
+	for _, label := range f.values[key] {
+		parts := strings.SplitN(label, "=", 2)
+		value, ok := labels[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+@Time :    2022/3/24 21:30
+@Author :  liuzhi
+@File :    filters_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"my-container/filters"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	if _, err := filters.Parse([]string{"image=busybox"}, "name", "label"); err == nil {
+		t.Fatalf("expected invalid filter error")
+	}
+	if _, err := filters.Parse([]string{"name"}, "name"); err == nil {
+		t.Fatalf("expected bad format error")
+	}
+	// 错误信息中排序的是副本，调用方的切片保持原来的顺序
+	allowed := []string{"name", "label"}
+	_, err := filters.Parse([]string{"image=busybox"}, allowed...)
+	if err == nil || !strings.HasSuffix(err.Error(), "label, name") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if allowed[0] != "name" || allowed[1] != "label" {
+		t.Fatalf("allowed filters modified: %v", allowed)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	f, err := filters.Parse([]string{"label=env=prod", "label=team", "name=web", "status=running", "status=paused"}, "name", "label", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"env": "prod", "team": "infra"}
+	if !f.MatchLabels("label", labels) {
+		t.Fatalf("labels %v should match", labels)
+	}
+	if f.MatchLabels("label", map[string]string{"env": "dev", "team": "infra"}) {
+		t.Fatalf("label value mismatch should not match")
+	}
+	if f.MatchLabels("label", map[string]string{"env": "prod"}) {
+		t.Fatalf("missing label should not match")
+	}
+	if !f.MatchSubstring("name", "my-web-1") || f.MatchSubstring("name", "db") {
+		t.Fatalf("unexpected name match")
+	}
+	if !f.Match("status", "paused") || f.Match("status", "exited") {
+		t.Fatalf("unexpected status match")
+	}
+	if !f.MatchAny("network", "br0") {
+		t.Fatalf("absent key should match everything")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+@Time :    2022/3/22 20:10
+@Author :  liuzhi
+@File :    format
+@Software: GoLand
+*/
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const (
+	// TablePrefix 以 table 开头的模板按照表格输出，并且带表头
+	TablePrefix = "table "
+	// JSON 每行输出一个 json 对象
+	JSON = "json"
+)
+
+// 模板中可以使用的函数，和 docker 的 --format 保持一致
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"split": strings.Split,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": strings.Title,
+	"truncate": func(s string, n int) string {
+		if len(s) > n {
+			return s[:n]
+		}
+		return s
+	},
+	"pad": func(s string, left, right int) string {
+		return strings.Repeat(" ", left) + s + strings.Repeat(" ", right)
+	},
+}
+
+// Parse 解析 Go 模板，支持 \t 和 \n 转义，方便在命令行中输入
+func Parse(format string) (*template.Template, error) {
+	format = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(format)
+	tmpl, err := template.New("format").Funcs(funcs).Option("missingkey=zero").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("template parsing error: %v", err)
+	}
+	return tmpl, nil
+}
+
+// Object 输出单个对象，format 为空时输出缩进的 json，inspect 使用
+func Object(w io.Writer, format string, v interface{}) error {
+	if format == "" || format == JSON {
+		data, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	tmpl, err := Parse(format)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(w, v); err != nil {
+		return fmt.Errorf("template execution error: %v", err)
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// Table 输出列表，format 为空时使用 defaultFormat
+// table 开头的模板通过 tabwriter 对齐，表头由 headers 中字段名对应的标题渲染，其他模板每行输出一次
+func Table(w io.Writer, format, defaultFormat string, headers map[string]string, rows []interface{}) error {
+	if format == "" {
+		format = defaultFormat
+	}
+	if format == JSON {
+		for _, row := range rows {
+			data, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(w, string(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	table := strings.HasPrefix(format, TablePrefix)
+	tmpl, err := Parse(strings.TrimPrefix(format, TablePrefix))
+	if err != nil {
+		return err
+	}
+	out := w
+	var tw *tabwriter.Writer
+	if table {
+		tw = tabwriter.NewWriter(w, 12, 1, 3, ' ', 0)
+		out = tw
+		// 表头用 map 渲染同一个模板，字段名对应的值就是标题
+		if err := tmpl.Execute(out, headers); err != nil {
+			return fmt.Errorf("template execution error: %v", err)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+	for _, row := range rows {
+		if err := tmpl.Execute(out, row); err != nil {
+			return fmt.Errorf("template execution error: %v", err)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+@Time :    2022/3/22 21:40
+@Author :  liuzhi
+@File :    format_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"bytes"
+	formatter "my-container/format"
+	"strings"
+	"testing"
+)
+
+type row struct {
+	ID   string
+	Name string
+}
+
+var headers = map[string]string{"ID": "ID", "Name": "NAME"}
+
+func TestTable(t *testing.T) {
+	rows := []interface{}{&row{ID: "1", Name: "a"}, &row{ID: "2", Name: "b"}}
+	var buf bytes.Buffer
+	if err := formatter.Table(&buf, "", `table {{.ID}}\t{{.Name}}`, headers, rows); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || strings.Fields(lines[0])[1] != "NAME" || strings.Fields(lines[2])[1] != "b" {
+		t.Fatalf("unexpected table output:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := formatter.Table(&buf, "{{.Name | upper}}", "", headers, rows); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "A\nB\n" {
+		t.Fatalf("unexpected template output: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := formatter.Table(&buf, "json", "", headers, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"ID":"1","Name":"a"}`+"\n" {
+		t.Fatalf("unexpected json output: %q", buf.String())
+	}
+}
+
+func TestObject(t *testing.T) {
+	var buf bytes.Buffer
+	obj := struct{ State struct{ Status string } }{}
+	obj.State.Status = "running"
+	if err := formatter.Object(&buf, "{{.State.Status}}", obj); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "running\n" {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	if err := formatter.Object(&buf, "{{.State.", obj); err == nil {
+		t.Fatalf("expected template parsing error")
+	}
+}
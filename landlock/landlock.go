@@ -0,0 +1,189 @@
+/*
+@Time :    2022/3/12 20:40
+@Author :  liuzhi
+@File :    landlock
+@Software: GoLand
+*/
+
+package landlock
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// landlock 的系统调用号，所有架构统一
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+)
+
+const (
+	createRulesetVersion = 1 << 0 // LANDLOCK_CREATE_RULESET_VERSION
+	rulePathBeneath      = 1      // LANDLOCK_RULE_PATH_BENEATH
+)
+
+// 文件系统权限位，参考 linux/landlock.h
+const (
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+	accessRefer      = 1 << 13 // ABI v2
+	accessTruncate   = 1 << 14 // ABI v3
+)
+
+var accessRights = map[string]uint64{
+	"execute":     accessExecute,
+	"write_file":  accessWriteFile,
+	"read_file":   accessReadFile,
+	"read_dir":    accessReadDir,
+	"remove_dir":  accessRemoveDir,
+	"remove_file": accessRemoveFile,
+	"make_char":   accessMakeChar,
+	"make_dir":    accessMakeDir,
+	"make_reg":    accessMakeReg,
+	"make_sock":   accessMakeSock,
+	"make_fifo":   accessMakeFifo,
+	"make_block":  accessMakeBlock,
+	"make_sym":    accessMakeSym,
+	"refer":       accessRefer,
+	"truncate":    accessTruncate,
+}
+
+var accessGroups = map[string]uint64{
+	"read": accessReadFile | accessReadDir,
+	"write": accessWriteFile | accessRemoveDir | accessRemoveFile | accessMakeChar | accessMakeDir |
+		accessMakeReg | accessMakeSock | accessMakeFifo | accessMakeBlock | accessMakeSym | accessRefer | accessTruncate,
+}
+
+// 只能作用于普通文件的权限，规则指向文件而不是目录时只能使用这些权限
+const fileAccess = accessExecute | accessWriteFile | accessReadFile | accessTruncate
+
+// 各个 ABI 版本支持的全部权限
+var abiAccess = map[int]uint64{
+	1: 1<<13 - 1,
+	2: 1<<14 - 1,
+	3: 1<<15 - 1,
+}
+
+// ErrNotSupported 内核不支持 landlock
+var ErrNotSupported = errors.New("landlock is not supported by the kernel")
+
+type rulesetAttr struct {
+	handledAccessFs uint64
+}
+
+// 内核中是 packed 结构体，一共 12 字节，Go 的结构体前 12 字节布局一致
+type pathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// ABIVersion 查询内核支持的 landlock ABI 版本
+func ABIVersion() (int, error) {
+	v, _, errno := unix.Syscall(sysLandlockCreateRuleset, 0, 0, createRulesetVersion)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+			return 0, ErrNotSupported
+		}
+		return 0, errno
+	}
+	return int(v), nil
+}
+
+// Restrict 按照策略限制当前线程，exec 之后的进程继承限制
+// 需要 no_new_privs 或者 CAP_SYS_ADMIN，调用方需要锁定线程
+func Restrict(policy *Policy) error {
+	if policy == nil {
+		return nil
+	}
+	abi, err := ABIVersion()
+	if err != nil {
+		if err == ErrNotSupported && !policy.Required {
+			log.Warnf("landlock policy ignored: %v (requires Linux 5.13+ with landlock enabled in the lsm= boot parameter)", err)
+			return nil
+		}
+		return fmt.Errorf("landlock: %v", err)
+	}
+	if abi > 3 {
+		abi = 3
+	}
+	handled := abiAccess[abi]
+
+	attr := rulesetAttr{handledAccessFs: handled}
+	fd, _, errno := unix.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock create ruleset error: %v", errno)
+	}
+	rulesetFd := int(fd)
+	defer func() {
+		_ = unix.Close(rulesetFd)
+	}()
+
+	for _, rule := range policy.Rules {
+		mask, err := accessMask(rule.Access)
+		if err != nil {
+			return err
+		}
+		// 高版本的权限在低版本内核上去掉，尽力而为
+		mask &= handled
+		for _, p := range rule.Paths {
+			if err := addPathRule(rulesetFd, p, mask); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, _, errno := unix.Syscall(sysLandlockRestrictSelf, uintptr(rulesetFd), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock restrict self error: %v", errno)
+	}
+	log.Infof("landlock policy applied, abi version %d", abi)
+	return nil
+}
+
+// addPathRule 允许对 p 下的目录树执行 mask 中的操作，路径不存在时忽略
+func addPathRule(rulesetFd int, p string, mask uint64) error {
+	parentFd, err := unix.Open(p, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.ENOENT {
+			log.Warnf("landlock rule path %s does not exist, skip", p)
+			return nil
+		}
+		return fmt.Errorf("landlock open %s error: %v", p, err)
+	}
+	defer func() {
+		_ = unix.Close(parentFd)
+	}()
+	var stat unix.Stat_t
+	if err := unix.Fstat(parentFd, &stat); err != nil {
+		return fmt.Errorf("landlock stat %s error: %v", p, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		mask &= fileAccess
+	}
+	// 权限全部被去掉时内核返回 ENOMSG，这条规则不允许任何操作，跳过即可
+	if mask == 0 {
+		log.Warnf("landlock rule for %s has no access supported by this kernel or file type, skip", p)
+		return nil
+	}
+	attr := pathBeneathAttr{allowedAccess: mask, parentFd: int32(parentFd)}
+	if _, _, errno := unix.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), rulePathBeneath,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock add rule for %s error: %v", p, errno)
+	}
+	return nil
+}
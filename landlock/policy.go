@@ -0,0 +1,81 @@
+/*
+@Time :    2022/3/12 20:10
+@Author :  liuzhi
+@File :    policy
+@Software: GoLand
+*/
+
+package landlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Policy landlock 策略，也就是 --security-opt landlock=policy.json 指定的内容
+// 例如：
+//
+//	{
+//	  "required": false,
+//	  "rules": [
+//	    {"paths": ["/bin", "/lib", "/usr"], "access": ["read", "execute"]},
+//	    {"paths": ["/tmp"], "access": ["read", "write"]}
+//	  ]
+//	}
+//
+// 没有列出的路径全部禁止访问
+type Policy struct {
+	Required bool    `json:"required"` // 内核不支持 landlock 时是否直接失败，默认只打印警告
+	Rules    []*Rule `json:"rules"`
+}
+
+// Rule 允许对 Paths 下的整个目录树执行 Access 中的操作
+type Rule struct {
+	Paths  []string `json:"paths"`
+	Access []string `json:"access"`
+}
+
+// LoadPolicy 从文件读取 landlock 策略
+func LoadPolicy(policyPath string) (*Policy, error) {
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read landlock policy %s error: %v", policyPath, err)
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("decode landlock policy error: %v", err)
+	}
+	for _, rule := range policy.Rules {
+		for _, p := range rule.Paths {
+			if !path.IsAbs(p) {
+				return nil, fmt.Errorf("landlock policy path must be absolute: %s", p)
+			}
+		}
+		if _, err := accessMask(rule.Access); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// accessMask 把 access 名称转换成 landlock 的权限位，支持 read/write/execute 三个组合名称，
+// 也支持 read_file、make_dir 这样和内核定义一一对应的名称
+func accessMask(access []string) (uint64, error) {
+	var mask uint64
+	for _, a := range access {
+		a = strings.ToLower(a)
+		if m, ok := accessGroups[a]; ok {
+			mask |= m
+			continue
+		}
+		if m, ok := accessRights[a]; ok {
+			mask |= m
+			continue
+		}
+		return 0, fmt.Errorf("unknown landlock access right: %s", a)
+	}
+	return mask, nil
+}
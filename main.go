@@ -9,6 +9,7 @@ package main
 
 import (
 	"github.com/urfave/cli"
+	"my-container/config"
 	"my-container/wheel"
 	"os"
 )
@@ -24,12 +25,34 @@ func main() {
 	app.Commands = []cli.Command{
 		wheel.RunCommand,
 		wheel.InitCommand,
+		wheel.ShimCommand,
+		wheel.StopCommand,
+		wheel.PauseCommand,
+		wheel.UnpauseCommand,
+		wheel.ListCommand,
+		wheel.RemoveCommand,
+		wheel.InspectCommand,
+		wheel.NetworkCommand,
+		wheel.StatsCommand,
+		wheel.EventsCommand,
+		wheel.TopCommand,
+		wheel.CopyCommand,
+		wheel.OciCommand,
+	}
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "global config file",
+			Value:  config.DefaultPath,
+			EnvVar: config.EnvPath,
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
 		log.SetFormatter(&log.JSONFormatter{})
 		log.SetOutput(os.Stdout)
-		return nil
+		return config.Load(context.GlobalString("config"))
 	}
 
 	err := app.Run(os.Args)
@@ -8,22 +8,56 @@
 package network
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// bridge 驱动支持的 -o 选项
+const (
+	// BridgeNameOption Linux Bridge 设备名，默认和网络名相同
+	BridgeNameOption = "com.mycontainer.bridge.name"
+	// BridgeMTUOption 网桥和 veth 的 MTU
+	BridgeMTUOption = "mtu"
+	// BridgeICCOption 为 false 时禁止同一个网络中的容器互相访问
+	BridgeICCOption = "enable_icc"
+	// BridgeMasqueradeOption 为 false 时容器访问外部网络不做 SNAT
+	BridgeMasqueradeOption = "enable_ip_masquerade"
 )
 
 // BridgeNetworkDriver 网络驱动实现，类似Bridge网桥
-// 定义一个空struct，实现NetDriver的接口
+// nl 为空时直接操作内核，测试时可以通过 NewBridgeDriver 传入 FakeNetlink
 type BridgeNetworkDriver struct {
+	nl Netlink
+}
+
+// NewBridgeDriver 创建使用指定 Netlink 的 bridge 驱动
+func NewBridgeDriver(nl Netlink) *BridgeNetworkDriver {
+	return &BridgeNetworkDriver{nl: nl}
+}
+
+func (d *BridgeNetworkDriver) handle() Netlink {
+	if d.nl == nil {
+		return NewNetlink()
+	}
+	return d.nl
 }
 
 func (d *BridgeNetworkDriver) Name() string {
 	return "bridge"
 }
 
-func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, error) {
+func (d *BridgeNetworkDriver) Capability() Capability {
+	return Capability{Scope: ScopeLocal, NeedsBridge: true}
+}
+
+func (d *BridgeNetworkDriver) Create(subnet string, name string, options map[string]string) (*Network, error) {
 	// 解析字符串，获取网关ip，网络ip
 	ip, ipRange, _ := net.ParseCIDR(subnet)
 	ipRange.IP = ip
@@ -31,6 +65,10 @@ func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, erro
 		Name:    name,
 		IpRange: ipRange,
 		Driver:  d.Name(),
+		Options: options,
+	}
+	if err := validateBridgeOptions(n); err != nil {
+		return nil, err
 	}
 	// 配置Linux Bridge
 	err := d.initBridge(n)
@@ -42,51 +80,86 @@ func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, erro
 }
 
 func (d *BridgeNetworkDriver) Delete(network Network) error {
-	bridgeName := network.Name
-	br, err := netlink.LinkByName(bridgeName)
+	bridgeName := network.BridgeName()
+	br, err := d.handle().LinkByName(bridgeName)
 	if err != nil {
 		return err
 	}
 	// 删除网络对应的 Linux Bridge 设备
-	return netlink.LinkDel(br)
+	return d.handle().LinkDel(br)
 }
 
 func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
-	bridgeName := network.Name
+	bridgeName := network.BridgeName()
 	// 通过接口名获取到 Linux Bridge 接口的对象和接口属性
-	br, err := netlink.LinkByName(bridgeName)
+	br, err := d.handle().LinkByName(bridgeName)
 	if err != nil {
 		return err
 	}
-	// 创建 Veth 接口的配置
+	// 创建 Veth 接口的配置，两端的名字都由端点 ID 的哈希得到，同一个容器连接多个网络时也不会冲突
+	// 容器一端移到容器的 namespace 之后再改名为 eth0、eth1
 	la := netlink.NewLinkAttrs()
-	la.Name = endpoint.ID[:5]
+	la.Name = hostVethName(endpoint)
 	la.MasterIndex = br.Attrs().Index
+	// veth 的两端使用和网桥相同的 MTU
+	la.MTU = network.MTU()
 
+	endpoint.HostVeth = la.Name
 	endpoint.Device = netlink.Veth{
 		LinkAttrs: la,
-		PeerName:  "cif-" + endpoint.ID[:5],
+		PeerName:  peerVethName(endpoint),
 	}
 
-	if err = netlink.LinkAdd(&endpoint.Device); err != nil {
+	if err = d.handle().LinkAdd(&endpoint.Device); err != nil {
 		return fmt.Errorf("error Add Endpoint Device: %v", err)
 	}
 
-	if err = netlink.LinkSetUp(&endpoint.Device); err != nil {
+	if err = d.handle().LinkSetUp(&endpoint.Device); err != nil {
 		return fmt.Errorf("error Add Endpoint Device: %v", err)
 	}
 
 	return nil
 }
 
+// Disconnect 删除宿主机一端的 veth，容器中的另一端会被内核一起删除
 func (d *BridgeNetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
-	return nil
+	name := endpoint.HostVeth
+	if name == "" {
+		name = hostVethName(endpoint)
+	}
+	veth, err := d.handle().LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			// 容器退出时 network namespace 销毁，veth 已经不存在了
+			return nil
+		}
+		return err
+	}
+	return d.handle().LinkDel(veth)
+}
+
+// vethHashLen 网卡名最多 15 个字节（IFNAMSIZ 包括结尾的 0），前缀 4 个字节，剩下的放哈希
+const vethHashLen = syscall.IFNAMSIZ - 1 - 4
+
+func endpointHash(endpoint *Endpoint) string {
+	sum := sha256.Sum256([]byte(endpoint.ID))
+	return hex.EncodeToString(sum[:])[:vethHashLen]
+}
+
+// hostVethName 宿主机一端的 veth 名，比如 veth1a2b3c4d5e6
+func hostVethName(endpoint *Endpoint) string {
+	return "veth" + endpointHash(endpoint)
+}
+
+// peerVethName 容器一端在宿主机上的临时名字
+func peerVethName(endpoint *Endpoint) string {
+	return "cif-" + endpointHash(endpoint)
 }
 
 func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 	// 创建 Bridge 设备
-	bridgeName := n.Name
-	if err := createBridgeInterface(bridgeName); err != nil {
+	bridgeName := n.BridgeName()
+	if err := createBridgeInterface(d.handle(), bridgeName, n.MTU()); err != nil {
 		log.Errorf("创建 bridge 设备")
 		return fmt.Errorf("error add bridge： %s, Error: %v", bridgeName, err)
 	}
@@ -94,17 +167,54 @@ func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 	// 这里的 gatewayIP 就是 *net.IPNet
 	gatewayIP := *n.IpRange
 	gatewayIP.IP = n.IpRange.IP
-	if err := setInterfaceIP(bridgeName, gatewayIP.String()); err != nil {
+	if err := setInterfaceIP(d.handle(), bridgeName, gatewayIP.String()); err != nil {
+		d.removeBridge(bridgeName)
 		return fmt.Errorf("error assigning address: %s on bridge: %s with an error of: %v", gatewayIP, bridgeName, err)
 	}
 	// 启动 Bridge 设备启动
-	if err := setInterfaceUP(bridgeName); err != nil {
+	if err := setInterfaceUP(d.handle(), bridgeName); err != nil {
+		d.removeBridge(bridgeName)
 		return fmt.Errorf("error set bridge up: %s, Error: %v", bridgeName, err)
 	}
-	// 设置 iptables SNAT 规则
-	if err := setupIPTables(bridgeName, n.IpRange); err != nil {
-		return fmt.Errorf("error setting iptables for %s: %v", bridgeName, err)
+	return nil
+}
+
+// removeBridge 删除初始化失败的网桥，已经存在的设备会被拒绝，这里删除的一定是刚创建的网桥
+func (d *BridgeNetworkDriver) removeBridge(bridgeName string) {
+	br, err := d.handle().LinkByName(bridgeName)
+	if err == nil {
+		err = d.handle().LinkDel(br)
+	}
+	if err != nil {
+		log.Warnf("remove bridge %s error %v", bridgeName, err)
 	}
+}
 
+// validateBridgeOptions 校验 -o 选项，网卡名最多 15 个字节，网络名太长时需要通过选项指定网桥名
+func validateBridgeOptions(n *Network) error {
+	for key, value := range n.Options {
+		switch key {
+		case BridgeNameOption:
+			if value == "" || strings.ContainsAny(value, "/: \t\n") {
+				return fmt.Errorf("invalid bridge name %q", value)
+			}
+		case BridgeMTUOption:
+			// IPv4 要求 MTU 至少为 68
+			if mtu, err := strconv.Atoi(value); err != nil || mtu < 68 || mtu > 65535 {
+				return fmt.Errorf("invalid mtu %q, must be between 68 and 65535", value)
+			}
+		case BridgeICCOption, BridgeMasqueradeOption:
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid value %q for option %s, must be true or false", value, key)
+			}
+		default:
+			return fmt.Errorf("unknown bridge option %q, supported options: %s, %s, %s, %s",
+				key, BridgeNameOption, BridgeMTUOption, BridgeICCOption, BridgeMasqueradeOption)
+		}
+	}
+	if name := n.BridgeName(); len(name) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("bridge name %s is longer than %d bytes, use -o %s=<name> to set a shorter one",
+			name, syscall.IFNAMSIZ-1, BridgeNameOption)
+	}
 	return nil
 }
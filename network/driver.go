@@ -7,13 +7,31 @@
 
 package network
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 驱动的作用范围
+const (
+	// ScopeLocal 网络只在本机有效
+	ScopeLocal = "local"
+	// ScopeGlobal 网络跨主机有效
+	ScopeGlobal = "global"
+)
+
 // NetDriver 定义网络驱动的接口
 type NetDriver interface {
 	// Name 驱动名
 	Name() string
 
-	// Create 创建网络
-	Create(subnet string, name string) (*Network, error)
+	// Capability 驱动的能力，创建网络时用于校验参数
+	Capability() Capability
+
+	// Create 创建网络，options 为 network create -o 指定的驱动选项，驱动负责校验
+	Create(subnet string, name string, options map[string]string) (*Network, error)
 
 	// Delete 删除网络
 	Delete(network Network) error
@@ -24,3 +42,71 @@ type NetDriver interface {
 	// Disconnect 移除连接端点
 	Disconnect(network Network, endpoint *Endpoint) error
 }
+
+// Capability 网络驱动的元数据
+type Capability struct {
+	Scope       string // local 或 global
+	IPv6        bool   // 是否支持 IPv6 子网
+	NeedsBridge bool   // 是否需要在宿主机上创建 Linux Bridge
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]NetDriver{}
+)
+
+func init() {
+	if err := RegisterDriver(&BridgeNetworkDriver{}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterDriver 注册网络驱动，驱动名不能重复，第三方驱动可以在自己包的 init 中调用
+func RegisterDriver(d NetDriver) error {
+	if d == nil {
+		return fmt.Errorf("network driver is nil")
+	}
+	name := d.Name()
+	if name == "" {
+		return fmt.Errorf("network driver name is empty")
+	}
+	switch scope := d.Capability().Scope; scope {
+	case ScopeLocal, ScopeGlobal:
+	default:
+		return fmt.Errorf("network driver %s has invalid scope %q", name, scope)
+	}
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if _, ok := drivers[name]; ok {
+		return fmt.Errorf("network driver %s is already registered", name)
+	}
+	drivers[name] = d
+	return nil
+}
+
+// GetDriver 根据名称查找已经注册的驱动，找不到时列出所有可用的驱动
+func GetDriver(name string) (NetDriver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("network driver %q not found, available drivers: %s", name, strings.Join(driverNames(), ", "))
+	}
+	return d, nil
+}
+
+// Drivers 返回所有已经注册的驱动名，按名称排序
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	return driverNames()
+}
+
+func driverNames() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,68 @@
+/*
+@Time :    2022/3/30 20:30
+@Author :  liuzhi
+@File :    endpoint
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// endpointDirName 端点保存在网络配置目录下的隐藏目录中，每个端点一个 json 文件
+// 以 . 开头不会和网络名冲突，加载网络配置时也会跳过
+const endpointDirName = ".endpoints"
+
+func (ep *Endpoint) dump(dumpPath string) error {
+	dir := path.Join(dumpPath, endpointDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	epJson, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, ep.ID+".json"), epJson, 0644)
+}
+
+func (ep *Endpoint) remove(dumpPath string) error {
+	err := os.Remove(path.Join(dumpPath, endpointDirName, ep.ID+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadEndpoints 读取保存的所有端点
+func loadEndpoints(dumpPath string) ([]*Endpoint, error) {
+	dir := path.Join(dumpPath, endpointDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		epJson, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ep := &Endpoint{}
+		if err := json.Unmarshal(epJson, ep); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
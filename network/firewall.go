@@ -0,0 +1,100 @@
+/*
+@Time :    2022/3/28 20:10
+@Author :  liuzhi
+@File :    firewall
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// 防火墙后端，通过全局配置文件的 firewall 字段选择
+const (
+	FirewallAuto     = "auto"
+	FirewallIptables = "iptables"
+	FirewallNftables = "nftables"
+)
+
+// Firewall 网络需要的 NAT 和隔离规则，每条规则都归属于某个网桥，删除网络时通过 Flush 一次清理
+// 所有方法都是幂等的，重复添加已经存在的规则不会报错
+type Firewall interface {
+	// EnsureMasquerade 子网中的容器访问外部网络时做源地址伪装
+	EnsureMasquerade(bridge string, subnet *net.IPNet) error
+	// AddPortMapping 把宿主机端口 DNAT 到容器 ip 的端口上
+	AddPortMapping(bridge string, ip net.IP, pm PortMapping) error
+	// RemovePortMapping 删除 AddPortMapping 添加的规则
+	RemovePortMapping(bridge string, ip net.IP, pm PortMapping) error
+	// Isolate 禁止这个网桥和其他隔离的网桥之间互相转发
+	Isolate(bridge string) error
+	// DisableICC 禁止同一个网桥上的容器之间互相访问
+	DisableICC(bridge string) error
+	// Flush 删除网桥相关的所有规则
+	Flush(bridge string) error
+}
+
+// PortMapping 端口映射，字符串格式为 宿主机端口:容器端口[/协议]，协议默认为 tcp
+type PortMapping struct {
+	HostPort      int
+	ContainerPort int
+	Proto         string
+}
+
+// ParsePortMapping 解析 -p 参数，比如 8080:80 或者 53:53/udp
+func ParsePortMapping(s string) (PortMapping, error) {
+	pm := PortMapping{Proto: "tcp"}
+	ports := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		ports, pm.Proto = s[:i], s[i+1:]
+	}
+	if pm.Proto != "tcp" && pm.Proto != "udp" {
+		return pm, fmt.Errorf("invalid port mapping %q, unsupported protocol %s", s, pm.Proto)
+	}
+	parts := strings.Split(ports, ":")
+	if len(parts) != 2 {
+		return pm, fmt.Errorf("invalid port mapping %q, expected hostPort:containerPort[/proto]", s)
+	}
+	var err error
+	if pm.HostPort, err = parsePort(parts[0]); err != nil {
+		return pm, fmt.Errorf("invalid port mapping %q: %v", s, err)
+	}
+	if pm.ContainerPort, err = parsePort(parts[1]); err != nil {
+		return pm, fmt.Errorf("invalid port mapping %q: %v", s, err)
+	}
+	return pm, nil
+}
+
+func (pm PortMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", pm.HostPort, pm.ContainerPort, pm.Proto)
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// NewFirewall 根据配置创建防火墙后端，auto 时有 iptables 命令就用 iptables，否则直接通过 netlink 操作 nftables
+// stateDir 用来保存 nftables 后端的规则，iptables 的规则保存在内核的自定义链中
+func NewFirewall(backend string, stateDir string) (Firewall, error) {
+	switch backend {
+	case "", FirewallAuto:
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return newIptablesFirewall(), nil
+		}
+		return newNftablesFirewall(stateDir), nil
+	case FirewallIptables:
+		return newIptablesFirewall(), nil
+	case FirewallNftables:
+		return newNftablesFirewall(stateDir), nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q, supported backends: %s, %s, %s", backend, FirewallAuto, FirewallIptables, FirewallNftables)
+}
@@ -0,0 +1,133 @@
+/*
+@Time :    2022/3/29 22:30
+@Author :  liuzhi
+@File :    firewall_fake
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"net"
+	"sync"
+)
+
+// FakeFirewall 内存中的 Firewall 实现，只记录规则，用于测试
+type FakeFirewall struct {
+	mu           sync.Mutex
+	masquerade   map[string]string
+	isolated     map[string]bool
+	noICC        map[string]bool
+	portMappings []FakePortMapping
+}
+
+// FakePortMapping 测试中检查的端口映射规则
+type FakePortMapping struct {
+	Bridge string
+	IP     string
+	PortMapping
+}
+
+func NewFakeFirewall() *FakeFirewall {
+	return &FakeFirewall{masquerade: map[string]string{}, isolated: map[string]bool{}, noICC: map[string]bool{}}
+}
+
+func (f *FakeFirewall) EnsureMasquerade(bridge string, subnet *net.IPNet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, network, _ := net.ParseCIDR(subnet.String())
+	f.masquerade[bridge] = network.String()
+	return nil
+}
+
+func (f *FakeFirewall) AddPortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule := FakePortMapping{Bridge: bridge, IP: ip.String(), PortMapping: pm}
+	for _, r := range f.portMappings {
+		if r == rule {
+			return nil
+		}
+	}
+	f.portMappings = append(f.portMappings, rule)
+	return nil
+}
+
+func (f *FakeFirewall) RemovePortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule := FakePortMapping{Bridge: bridge, IP: ip.String(), PortMapping: pm}
+	kept := f.portMappings[:0]
+	for _, r := range f.portMappings {
+		if r != rule {
+			kept = append(kept, r)
+		}
+	}
+	f.portMappings = kept
+	return nil
+}
+
+func (f *FakeFirewall) Isolate(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isolated[bridge] = true
+	return nil
+}
+
+func (f *FakeFirewall) DisableICC(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.noICC[bridge] = true
+	return nil
+}
+
+func (f *FakeFirewall) Flush(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.masquerade, bridge)
+	delete(f.isolated, bridge)
+	delete(f.noICC, bridge)
+	kept := f.portMappings[:0]
+	for _, r := range f.portMappings {
+		if r.Bridge != bridge {
+			kept = append(kept, r)
+		}
+	}
+	f.portMappings = kept
+	return nil
+}
+
+// Masquerade 返回网桥做地址伪装的子网
+func (f *FakeFirewall) Masquerade(bridge string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subnet, ok := f.masquerade[bridge]
+	return subnet, ok
+}
+
+// Isolated 网桥是否和其他网桥隔离
+func (f *FakeFirewall) Isolated(bridge string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.isolated[bridge]
+}
+
+// ICCDisabled 是否禁止了网桥上的容器互相访问
+func (f *FakeFirewall) ICCDisabled(bridge string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.noICC[bridge]
+}
+
+// PortMappings 返回网桥上的端口映射规则
+func (f *FakeFirewall) PortMappings(bridge string) []FakePortMapping {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []FakePortMapping
+	for _, r := range f.portMappings {
+		if r.Bridge == bridge {
+			result = append(result, r)
+		}
+	}
+	return result
+}
@@ -0,0 +1,229 @@
+/*
+@Time :    2022/3/28 20:40
+@Author :  liuzhi
+@File :    firewall_iptables
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 自定义链，所有规则都加在这些链里，不直接修改系统的链
+const (
+	iptablesNatChain         = "MY-CONTAINER"
+	iptablesPostroutingChain = "MY-CONTAINER-POSTROUTING"
+	iptablesIsolationStage1  = "MY-CONTAINER-ISOLATION-STAGE-1"
+	iptablesIsolationStage2  = "MY-CONTAINER-ISOLATION-STAGE-2"
+)
+
+// iptablesChain 自定义链以及从系统链跳转过来的规则
+type iptablesChain struct {
+	table string
+	name  string
+	// jumps 系统链中跳转到这个链的规则，第一个元素是系统链的名字
+	jumps [][]string
+	// insert 跳转规则插入到系统链的最前面，隔离规则需要在其他 ACCEPT 规则之前生效
+	insert bool
+}
+
+var iptablesChains = []iptablesChain{
+	{table: "nat", name: iptablesNatChain, jumps: [][]string{
+		{"PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL"},
+		{"OUTPUT", "!", "-d", "127.0.0.0/8", "-m", "addrtype", "--dst-type", "LOCAL"},
+	}},
+	{table: "nat", name: iptablesPostroutingChain, jumps: [][]string{{"POSTROUTING"}}},
+	{table: "filter", name: iptablesIsolationStage2},
+	{table: "filter", name: iptablesIsolationStage1, jumps: [][]string{{"FORWARD"}}, insert: true},
+}
+
+// iptablesFirewall 调用 iptables 命令，参数直接以切片传递，不再拼接字符串
+type iptablesFirewall struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+func newIptablesFirewall() *iptablesFirewall {
+	return &iptablesFirewall{}
+}
+
+// iptables 执行命令，-w 等待其他进程释放 xtables 锁
+func (f *iptablesFirewall) iptables(args ...string) (string, error) {
+	output, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// exists 通过 -C 检查规则是否已经存在
+func (f *iptablesFirewall) exists(table, chain string, rule ...string) bool {
+	_, err := f.iptables(append([]string{"-t", table, "-C", chain}, rule...)...)
+	return err == nil
+}
+
+func (f *iptablesFirewall) appendRule(table, chain string, rule ...string) error {
+	if f.exists(table, chain, rule...) {
+		return nil
+	}
+	_, err := f.iptables(append([]string{"-t", table, "-A", chain}, rule...)...)
+	return err
+}
+
+func (f *iptablesFirewall) deleteRule(table, chain string, rule ...string) error {
+	if !f.exists(table, chain, rule...) {
+		return nil
+	}
+	_, err := f.iptables(append([]string{"-t", table, "-D", chain}, rule...)...)
+	return err
+}
+
+// ensureChains 创建自定义链和跳转规则，每个进程只需要成功执行一次
+func (f *iptablesFirewall) ensureChains() error {
+	if f.ready {
+		return nil
+	}
+	for _, c := range iptablesChains {
+		if _, err := f.iptables("-t", c.table, "-n", "-L", c.name); err != nil {
+			if _, err := f.iptables("-t", c.table, "-N", c.name); err != nil {
+				return err
+			}
+		}
+		for _, jump := range c.jumps {
+			rule := append(append([]string{}, jump[1:]...), "-j", c.name)
+			if f.exists(c.table, jump[0], rule...) {
+				continue
+			}
+			op := "-A"
+			if c.insert {
+				op = "-I"
+			}
+			if _, err := f.iptables(append([]string{"-t", c.table, op, jump[0]}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+	// 第二阶段的链最后一条规则是 RETURN，网桥的 DROP 规则插入到它前面
+	if err := f.appendRule("filter", iptablesIsolationStage2, "-j", "RETURN"); err != nil {
+		return err
+	}
+	if err := f.appendRule("filter", iptablesIsolationStage1, "-j", "RETURN"); err != nil {
+		return err
+	}
+	f.ready = true
+	return nil
+}
+
+func (f *iptablesFirewall) EnsureMasquerade(bridge string, subnet *net.IPNet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureChains(); err != nil {
+		return err
+	}
+	_, network, _ := net.ParseCIDR(subnet.String())
+	return f.appendRule("nat", iptablesPostroutingChain, "-s", network.String(), "!", "-o", bridge, "-j", "MASQUERADE")
+}
+
+func portMappingRule(bridge string, ip net.IP, pm PortMapping) []string {
+	return []string{"!", "-i", bridge, "-p", pm.Proto, "-m", pm.Proto, "--dport", strconv.Itoa(pm.HostPort),
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(ip.String(), strconv.Itoa(pm.ContainerPort))}
+}
+
+func (f *iptablesFirewall) AddPortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureChains(); err != nil {
+		return err
+	}
+	return f.appendRule("nat", iptablesNatChain, portMappingRule(bridge, ip, pm)...)
+}
+
+func (f *iptablesFirewall) RemovePortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureChains(); err != nil {
+		return err
+	}
+	return f.deleteRule("nat", iptablesNatChain, portMappingRule(bridge, ip, pm)...)
+}
+
+// Isolate 和 docker 一样分两个阶段：从网桥出去且不回到本网桥的包进入第二阶段，在第二阶段中发往其他隔离网桥的包被丢弃
+func (f *iptablesFirewall) Isolate(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureChains(); err != nil {
+		return err
+	}
+	stage1 := []string{"-i", bridge, "!", "-o", bridge, "-j", iptablesIsolationStage2}
+	if !f.exists("filter", iptablesIsolationStage1, stage1...) {
+		if _, err := f.iptables(append([]string{"-t", "filter", "-I", iptablesIsolationStage1, "1"}, stage1...)...); err != nil {
+			return err
+		}
+	}
+	stage2 := []string{"-o", bridge, "-j", "DROP"}
+	if !f.exists("filter", iptablesIsolationStage2, stage2...) {
+		if _, err := f.iptables(append([]string{"-t", "filter", "-I", iptablesIsolationStage2, "1"}, stage2...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableICC 和隔离规则一起放在第一阶段的链中，从网桥进来又从同一个网桥出去的包直接丢弃
+// 网桥内部的转发需要开启 br_netfilter 才会经过 iptables
+func (f *iptablesFirewall) DisableICC(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureChains(); err != nil {
+		return err
+	}
+	rule := []string{"-i", bridge, "-o", bridge, "-j", "DROP"}
+	if f.exists("filter", iptablesIsolationStage1, rule...) {
+		return nil
+	}
+	_, err := f.iptables(append([]string{"-t", "filter", "-I", iptablesIsolationStage1, "1"}, rule...)...)
+	return err
+}
+
+// Flush 遍历自定义链，删除通过 -i/-o 匹配这个网桥的规则
+func (f *iptablesFirewall) Flush(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range iptablesChains {
+		output, err := f.iptables("-t", c.table, "-S", c.name)
+		if err != nil {
+			// 链不存在说明还没有添加过规则
+			log.Debugf("list chain %s error: %v", c.name, err)
+			continue
+		}
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "-A" || !matchesInterface(fields, bridge) {
+				continue
+			}
+			if _, err := f.iptables(append([]string{"-t", c.table, "-D"}, fields[1:]...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matchesInterface 规则中是否有 -i bridge 或者 -o bridge(包括取反的 ! -o bridge)
+// 只比较网卡参数，网桥名和端口号、动作之类的其他参数相同时不会误删其他网络的规则
+func matchesInterface(fields []string, bridge string) bool {
+	for i := 0; i+1 < len(fields); i++ {
+		if (fields[i] == "-i" || fields[i] == "-o") && fields[i+1] == bridge {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,503 @@
+/*
+@Time :    2022/3/29 21:00
+@Author :  liuzhi
+@File :    firewall_nftables
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+)
+
+// nftables 中的表名，所有规则都在这张表里，和其他程序的规则互不影响
+const nftTable = "my-container"
+
+// nfDrop 内核中 DROP 的 verdict 取值
+const nfDrop = 0
+
+// nftablesFirewall 直接通过 netlink 操作 nftables，不依赖 nft 命令
+// 期望的规则保存在 stateDir 下的 json 文件中，每次修改都在一个事务里删除整张表再按照状态重建，
+// 不需要记录规则的 handle，多个进程之间通过文件锁串行化
+type nftablesFirewall struct {
+	statePath string
+}
+
+// nftState 防火墙的期望状态
+type nftState struct {
+	Masquerade   map[string]string `json:"masquerade"` // 网桥 -> 子网
+	Isolated     []string          `json:"isolated"`
+	NoICC        []string          `json:"noIcc"`
+	PortMappings []nftPortMapping  `json:"portMappings"`
+}
+
+type nftPortMapping struct {
+	Bridge string `json:"bridge"`
+	IP     net.IP `json:"ip"`
+	PortMapping
+}
+
+func newNftablesFirewall(stateDir string) *nftablesFirewall {
+	return &nftablesFirewall{statePath: path.Join(stateDir, firewallDirName, "nftables.json")}
+}
+
+// update 加锁读取状态，修改之后下发到内核，成功后再保存
+func (f *nftablesFirewall) update(fn func(s *nftState)) error {
+	if err := os.MkdirAll(path.Dir(f.statePath), 0755); err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(f.statePath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer func(lockFile *os.File) {
+		_ = lockFile.Close()
+	}(lockFile)
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	s := &nftState{Masquerade: map[string]string{}}
+	if data, err := ioutil.ReadFile(f.statePath); err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return fmt.Errorf("load nftables state error: %v", err)
+		}
+		if s.Masquerade == nil {
+			s.Masquerade = map[string]string{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	fn(s)
+	if err := nftApply(s); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.statePath, data, 0644)
+}
+
+func (f *nftablesFirewall) EnsureMasquerade(bridge string, subnet *net.IPNet) error {
+	_, network, _ := net.ParseCIDR(subnet.String())
+	return f.update(func(s *nftState) {
+		s.Masquerade[bridge] = network.String()
+	})
+}
+
+func (f *nftablesFirewall) AddPortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	return f.update(func(s *nftState) {
+		for _, m := range s.PortMappings {
+			if m.Bridge == bridge && m.IP.Equal(ip) && m.PortMapping == pm {
+				return
+			}
+		}
+		s.PortMappings = append(s.PortMappings, nftPortMapping{Bridge: bridge, IP: ip, PortMapping: pm})
+	})
+}
+
+func (f *nftablesFirewall) RemovePortMapping(bridge string, ip net.IP, pm PortMapping) error {
+	return f.update(func(s *nftState) {
+		kept := s.PortMappings[:0]
+		for _, m := range s.PortMappings {
+			if !(m.Bridge == bridge && m.IP.Equal(ip) && m.PortMapping == pm) {
+				kept = append(kept, m)
+			}
+		}
+		s.PortMappings = kept
+	})
+}
+
+func (f *nftablesFirewall) Isolate(bridge string) error {
+	return f.update(func(s *nftState) {
+		s.Isolated = addBridge(s.Isolated, bridge)
+	})
+}
+
+// addBridge 把网桥加入有序的列表，已经存在时不变
+func addBridge(bridges []string, bridge string) []string {
+	for _, b := range bridges {
+		if b == bridge {
+			return bridges
+		}
+	}
+	bridges = append(bridges, bridge)
+	sort.Strings(bridges)
+	return bridges
+}
+
+func removeBridge(bridges []string, bridge string) []string {
+	kept := bridges[:0]
+	for _, b := range bridges {
+		if b != bridge {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+func (f *nftablesFirewall) DisableICC(bridge string) error {
+	return f.update(func(s *nftState) {
+		s.NoICC = addBridge(s.NoICC, bridge)
+	})
+}
+
+func (f *nftablesFirewall) Flush(bridge string) error {
+	return f.update(func(s *nftState) {
+		delete(s.Masquerade, bridge)
+		s.Isolated = removeBridge(s.Isolated, bridge)
+		s.NoICC = removeBridge(s.NoICC, bridge)
+		kept := s.PortMappings[:0]
+		for _, m := range s.PortMappings {
+			if m.Bridge != bridge {
+				kept = append(kept, m)
+			}
+		}
+		s.PortMappings = kept
+	})
+}
+
+// nftChain 表中的基础链
+type nftChain struct {
+	name     string
+	kind     string
+	hook     uint32
+	priority int32
+}
+
+var nftChains = []nftChain{
+	{name: "prerouting", kind: "nat", hook: unix.NF_INET_PRE_ROUTING, priority: -100},
+	{name: "output", kind: "nat", hook: unix.NF_INET_LOCAL_OUT, priority: -100},
+	{name: "postrouting", kind: "nat", hook: unix.NF_INET_POST_ROUTING, priority: 100},
+	{name: "forward", kind: "filter", hook: unix.NF_INET_FORWARD, priority: 0},
+}
+
+// nftApply 在一个批处理事务中重建整张表
+// 先 add table 再 delete table，表不存在时删除也不会失败，这是 nft 命令本身也在用的写法
+func nftApply(s *nftState) error {
+	b := &nftBatch{}
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, nftTableAttrs())
+	b.add(unix.NFT_MSG_DELTABLE, 0, nftTableAttrs())
+	if len(s.Masquerade) == 0 && len(s.Isolated) == 0 && len(s.NoICC) == 0 && len(s.PortMappings) == 0 {
+		return b.send()
+	}
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, nftTableAttrs())
+	for _, c := range nftChains {
+		hook := nl.NewRtAttr(unix.NFTA_CHAIN_HOOK|unix.NLA_F_NESTED, nil)
+		hook.AddRtAttr(unix.NFTA_HOOK_HOOKNUM, be32(c.hook))
+		hook.AddRtAttr(unix.NFTA_HOOK_PRIORITY, be32(uint32(c.priority)))
+		b.add(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE,
+			nl.NewRtAttr(unix.NFTA_CHAIN_TABLE, nl.ZeroTerminated(nftTable)),
+			nl.NewRtAttr(unix.NFTA_CHAIN_NAME, nl.ZeroTerminated(c.name)),
+			hook,
+			nl.NewRtAttr(unix.NFTA_CHAIN_TYPE, nl.ZeroTerminated(c.kind)),
+		)
+	}
+
+	bridges := make([]string, 0, len(s.Masquerade))
+	for bridge := range s.Masquerade {
+		bridges = append(bridges, bridge)
+	}
+	sort.Strings(bridges)
+	for _, bridge := range bridges {
+		_, subnet, err := net.ParseCIDR(s.Masquerade[bridge])
+		if err != nil || subnet.IP.To4() == nil {
+			return fmt.Errorf("invalid masquerade subnet %s for %s", s.Masquerade[bridge], bridge)
+		}
+		// ip saddr 10.0.0.0/24 oifname != br masquerade
+		b.addRule("postrouting",
+			nftPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 12, 4),
+			nftBitwise(subnet.Mask, 4),
+			nftCmp(unix.NFT_CMP_EQ, subnet.IP.To4()),
+			nftMeta(unix.NFT_META_OIFNAME),
+			nftCmp(unix.NFT_CMP_NEQ, ifname(bridge)),
+			nftExpr("masq", nil),
+		)
+	}
+
+	for _, m := range s.PortMappings {
+		ip := m.IP.To4()
+		if ip == nil {
+			return fmt.Errorf("invalid port mapping destination %s", m.IP)
+		}
+		proto := byte(unix.IPPROTO_TCP)
+		if m.Proto == "udp" {
+			proto = unix.IPPROTO_UDP
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(m.ContainerPort))
+		hostPort := make([]byte, 2)
+		binary.BigEndian.PutUint16(hostPort, uint16(m.HostPort))
+		// fib daddr type local iifname != br meta l4proto tcp th dport 8080 dnat to ip:80
+		dnat := append(nftFibLocal(),
+			nftMeta(unix.NFT_META_IIFNAME),
+			nftCmp(unix.NFT_CMP_NEQ, ifname(m.Bridge)),
+			nftMeta(unix.NFT_META_L4PROTO),
+			nftCmp(unix.NFT_CMP_EQ, []byte{proto}),
+			nftPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2),
+			nftCmp(unix.NFT_CMP_EQ, hostPort),
+			nftImmediate(unix.NFT_REG_1, ip),
+			nftImmediate(unix.NFT_REG_2, port),
+			nftDnat(),
+		)
+		b.addRule("prerouting", dnat...)
+		// 本机访问映射的端口时经过 output 链，排除 127.0.0.0/8
+		output := append([]*nl.RtAttr{
+			nftPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4),
+			nftBitwise(net.CIDRMask(8, 32), 4),
+			nftCmp(unix.NFT_CMP_NEQ, []byte{127, 0, 0, 0}),
+		}, dnat...)
+		b.addRule("output", output...)
+	}
+
+	// iifname br oifname br drop，禁止同一个网桥上的容器互相访问
+	for _, bridge := range s.NoICC {
+		b.addRule("forward",
+			nftMeta(unix.NFT_META_IIFNAME),
+			nftCmp(unix.NFT_CMP_EQ, ifname(bridge)),
+			nftMeta(unix.NFT_META_OIFNAME),
+			nftCmp(unix.NFT_CMP_EQ, ifname(bridge)),
+			nftVerdict(nfDrop),
+		)
+	}
+
+	// iifname a oifname b drop，隔离的网桥两两之间互相丢弃
+	for _, from := range s.Isolated {
+		for _, to := range s.Isolated {
+			if from == to {
+				continue
+			}
+			b.addRule("forward",
+				nftMeta(unix.NFT_META_IIFNAME),
+				nftCmp(unix.NFT_CMP_EQ, ifname(from)),
+				nftMeta(unix.NFT_META_OIFNAME),
+				nftCmp(unix.NFT_CMP_EQ, ifname(to)),
+				nftVerdict(nfDrop),
+			)
+		}
+	}
+	return b.send()
+}
+
+func nftTableAttrs() *nl.RtAttr {
+	return nl.NewRtAttr(unix.NFTA_TABLE_NAME, nl.ZeroTerminated(nftTable))
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// ifname 网卡名在寄存器中占 IFNAMSIZ 个字节，不足的补 0
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+func nftExpr(name string, data *nl.RtAttr) *nl.RtAttr {
+	elem := nl.NewRtAttr(unix.NFTA_LIST_ELEM|unix.NLA_F_NESTED, nil)
+	elem.AddRtAttr(unix.NFTA_EXPR_NAME, nl.ZeroTerminated(name))
+	if data != nil {
+		elem.AddChild(data)
+	}
+	return elem
+}
+
+func nftExprData() *nl.RtAttr {
+	return nl.NewRtAttr(unix.NFTA_EXPR_DATA|unix.NLA_F_NESTED, nil)
+}
+
+func nftValue(attrType int, value []byte) *nl.RtAttr {
+	data := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+	data.AddRtAttr(unix.NFTA_DATA_VALUE, value)
+	return data
+}
+
+// nftMeta 把网卡名或四层协议等元数据加载到寄存器 1
+func nftMeta(key uint32) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_META_DREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_META_KEY, be32(key))
+	return nftExpr("meta", data)
+}
+
+// nftPayload 把报文中的一段加载到寄存器 1
+func nftPayload(base, offset, length uint32) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_PAYLOAD_DREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_PAYLOAD_BASE, be32(base))
+	data.AddRtAttr(unix.NFTA_PAYLOAD_OFFSET, be32(offset))
+	data.AddRtAttr(unix.NFTA_PAYLOAD_LEN, be32(length))
+	return nftExpr("payload", data)
+}
+
+// nftBitwise 寄存器 1 和掩码做与运算，用于匹配网段
+func nftBitwise(mask []byte, length uint32) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_BITWISE_SREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_BITWISE_DREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_BITWISE_LEN, be32(length))
+	data.AddChild(nftValue(unix.NFTA_BITWISE_MASK, mask))
+	data.AddChild(nftValue(unix.NFTA_BITWISE_XOR, make([]byte, length)))
+	return nftExpr("bitwise", data)
+}
+
+func nftCmp(op uint32, value []byte) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_CMP_SREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_CMP_OP, be32(op))
+	data.AddChild(nftValue(unix.NFTA_CMP_DATA, value))
+	return nftExpr("cmp", data)
+}
+
+// nftFibLocal fib daddr type local，相当于 iptables 的 -m addrtype --dst-type LOCAL
+func nftFibLocal() []*nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_FIB_DREG, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_FIB_RESULT, be32(unix.NFT_FIB_RESULT_ADDRTYPE))
+	data.AddRtAttr(unix.NFTA_FIB_FLAGS, be32(unix.NFTA_FIB_F_DADDR))
+	// 地址类型以主机字节序写入寄存器
+	rtnLocal := make([]byte, 4)
+	nl.NativeEndian().PutUint32(rtnLocal, unix.RTN_LOCAL)
+	return []*nl.RtAttr{nftExpr("fib", data), nftCmp(unix.NFT_CMP_EQ, rtnLocal)}
+}
+
+func nftImmediate(reg uint32, value []byte) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_IMMEDIATE_DREG, be32(reg))
+	data.AddChild(nftValue(unix.NFTA_IMMEDIATE_DATA, value))
+	return nftExpr("immediate", data)
+}
+
+func nftVerdict(code uint32) *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_IMMEDIATE_DREG, be32(unix.NFT_REG_VERDICT))
+	value := nl.NewRtAttr(unix.NFTA_IMMEDIATE_DATA|unix.NLA_F_NESTED, nil)
+	verdict := nl.NewRtAttr(unix.NFTA_DATA_VERDICT|unix.NLA_F_NESTED, nil)
+	verdict.AddRtAttr(unix.NFTA_VERDICT_CODE, be32(code))
+	value.AddChild(verdict)
+	data.AddChild(value)
+	return nftExpr("immediate", data)
+}
+
+// nftDnat 目的地址取寄存器 1，端口取寄存器 2
+func nftDnat() *nl.RtAttr {
+	data := nftExprData()
+	data.AddRtAttr(unix.NFTA_NAT_TYPE, be32(unix.NFT_NAT_DNAT))
+	data.AddRtAttr(unix.NFTA_NAT_FAMILY, be32(unix.NFPROTO_IPV4))
+	data.AddRtAttr(unix.NFTA_NAT_REG_ADDR_MIN, be32(unix.NFT_REG_1))
+	data.AddRtAttr(unix.NFTA_NAT_REG_PROTO_MIN, be32(unix.NFT_REG_2))
+	return nftExpr("nat", data)
+}
+
+// nftBatch nftables 的修改需要放在 BATCH_BEGIN 和 BATCH_END 之间一起提交，内核保证原子性
+type nftBatch struct {
+	msgs []*nl.NetlinkRequest
+}
+
+// nfgenmsg nfnetlink 消息头
+type nfgenmsg struct {
+	family uint8
+	resID  uint16
+}
+
+func (m *nfgenmsg) Len() int {
+	return 4
+}
+
+func (m *nfgenmsg) Serialize() []byte {
+	b := make([]byte, 4)
+	b[0] = m.family
+	b[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[2:], m.resID)
+	return b
+}
+
+func (b *nftBatch) add(msgType int, flags int, attrs ...*nl.RtAttr) {
+	req := nl.NewNetlinkRequest(unix.NFNL_SUBSYS_NFTABLES<<8|msgType, flags|unix.NLM_F_ACK)
+	req.AddData(&nfgenmsg{family: unix.NFPROTO_IPV4})
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	b.msgs = append(b.msgs, req)
+}
+
+func (b *nftBatch) addRule(chain string, exprs ...*nl.RtAttr) {
+	list := nl.NewRtAttr(unix.NFTA_RULE_EXPRESSIONS|unix.NLA_F_NESTED, nil)
+	for _, expr := range exprs {
+		list.AddChild(expr)
+	}
+	b.add(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND,
+		nl.NewRtAttr(unix.NFTA_RULE_TABLE, nl.ZeroTerminated(nftTable)),
+		nl.NewRtAttr(unix.NFTA_RULE_CHAIN, nl.ZeroTerminated(chain)),
+		list,
+	)
+}
+
+// send 提交批处理并等待每条消息的确认，任何一条失败时内核会回滚整个事务
+func (b *nftBatch) send() error {
+	begin := nl.NewNetlinkRequest(unix.NFNL_MSG_BATCH_BEGIN, 0)
+	begin.AddData(&nfgenmsg{resID: unix.NFNL_SUBSYS_NFTABLES})
+	end := nl.NewNetlinkRequest(unix.NFNL_MSG_BATCH_END, 0)
+	end.AddData(&nfgenmsg{resID: unix.NFNL_SUBSYS_NFTABLES})
+
+	var buf []byte
+	pending := map[uint32]bool{}
+	buf = append(buf, begin.Serialize()...)
+	for _, msg := range b.msgs {
+		buf = append(buf, msg.Serialize()...)
+		pending[msg.Seq] = true
+	}
+	buf = append(buf, end.Serialize()...)
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("open nftables netlink socket error: %v", err)
+	}
+	defer unix.Close(fd)
+	tv := unix.Timeval{Sec: 5}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	if err := unix.Sendto(fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("send nftables batch error: %v", err)
+	}
+
+	rb := make([]byte, unix.Getpagesize()*4)
+	for len(pending) > 0 {
+		n, _, err := unix.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return fmt.Errorf("receive nftables ack error: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return fmt.Errorf("nftables batch error: %v", syscall.Errno(-errno))
+			}
+			delete(pending, m.Header.Seq)
+		}
+	}
+	return nil
+}
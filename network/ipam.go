@@ -8,8 +8,11 @@
 package network
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -50,27 +53,13 @@ func (ipam *IPAM) load() error {
 			return err
 		}
 	}
-	// 打开文件
-	subnetConfigFile, err := os.Open(ipam.SubnetAllocatorPath)
-	defer func(subnetConfigFile *os.File) {
-		err := subnetConfigFile.Close()
-		if err != nil {
-			log.Debug("file close error")
-		}
-	}(subnetConfigFile)
-
+	// 读取整个文件，大网段的位图可能有几万个字符
+	subnetConfigJson, err := ioutil.ReadFile(ipam.SubnetAllocatorPath)
 	if err != nil {
 		return err
 	}
-	// 定义读取文件的数据变量
-	subnetConfigJson := make([]byte, 3000)
-	// Read 方法把文件对象装在到传递的[]byte中，返回文件长度(reads up to len(b) bytes from the File.)
-	read, err := subnetConfigFile.Read(subnetConfigJson)
-	if err != nil {
-		return err
-	}
-	// 将json数据转换成map赋值给结构体成员 Subnets(先切片，只保留原始数据，因为我们分配的数组比较长，只切原始数据)
-	err = json.Unmarshal(subnetConfigJson[:read], ipam.Subnets)
+	// 将json数据转换成map赋值给结构体成员 Subnets
+	err = json.Unmarshal(subnetConfigJson, ipam.Subnets)
 	if err != nil {
 		log.Errorf("Error dump Allocator info, %v", err)
 		return err
@@ -125,44 +114,47 @@ func (ipam *IPAM) Allocator(subnet *net.IPNet) (ip net.IP, err error) {
 		log.Errorf("ipam load 网络分配信息失败")
 	}
 
+	// 统一使用网络地址作为 key，传入的可能是网关地址，比如 192.168.1.1/24
 	_, ipNet, _ := net.ParseCIDR(subnet.String())
+	key := ipNet.String()
 
 	// ip：192.168.1.100/24 网络地址：192.168.1.0/24 子网掩码：255.255.255.0
 	// 255.255.255.0 调用此方法返回 24 32，网络前缀占24位，主机位 32 - 8
 	ones, bits := ipNet.Mask.Size()
 
 	// 如果之前没有分配过这个网段，则初始化网段配置（看有多少主机地址位数，初始化多少个0）
-	if _, exist := (*ipam.Subnets)[subnet.String()]; !exist {
+	if _, exist := (*ipam.Subnets)[key]; !exist {
 		// (32 - 8) ^ 2, 等效 1 << 24
-		(*ipam.Subnets)[subnet.String()] = strings.Repeat("0", 1<<uint8(bits-ones))
+		(*ipam.Subnets)[key] = strings.Repeat("0", 1<<uint8(bits-ones))
 	}
 
 	// 遍历位图字符串（可以考虑用byte数组）
-	for c := range (*ipam.Subnets)[subnet.String()] {
+	for c := range (*ipam.Subnets)[key] {
 		// 找到为 "0" 项，也就是还未配置的
-		if (*ipam.Subnets)[subnet.String()][c] == '0' {
+		if (*ipam.Subnets)[key][c] == '0' {
 			// 字符串不能修改，把字符串转换成 byte 数组，然后根据当前的 index，也就是c，修改为 "1"
-			ipAlloc := []byte((*ipam.Subnets)[subnet.String()])
+			ipAlloc := []byte((*ipam.Subnets)[key])
 			ipAlloc[c] = '1'
 			// 重新转回字符串
-			(*ipam.Subnets)[subnet.String()] = string(ipAlloc)
-			// 赋值返回值ip，先从 subnet.IP 取出网络地址
+			(*ipam.Subnets)[key] = string(ipAlloc)
+			// 复制一份网络地址，不能直接修改调用方传入的 subnet.IP
 			// ip：192.168.1.100/24 则网络地址：192.168.1.0/24，那么从0开始计算偏移量即可
-			ip = subnet.IP
+			ip = make(net.IP, net.IPv4len)
+			copy(ip, ipNet.IP.To4())
 			/*
 				ipv4, IP 的 byte 数组是 4位长度
 				比如网段是 172.16.0.0/12，数组序号是 65555. 那么在172.16.0.0
 				上依次加[uint8(65555 >> 24)、uint8(65555 >> 16)、uint8(65555 >> 8)、uint8(65555 >> 0)，即[0, 1, 0, 19)
 				那么获得的 IP 就是 172.17.0.19
+				由于网络地址不能分配，是从1开始分配的，所以偏移量加1
 			*/
-			for t := uint(4); t > 0; t -= 1 {
-				[]byte(ip)[4-t] += uint8(c >> ((t - 1) * 8))
-			}
-			// 由于网络地址不能分配，是从1开始分配的，所以加1
-			ip[3] += 1
+			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(c)+1)
 			break
 		}
 	}
+	if ip == nil {
+		return nil, fmt.Errorf("no available ip in subnet %s", key)
+	}
 	_ = ipam.dump()
 	return
 }
@@ -177,20 +169,17 @@ func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
 	if err != nil {
 		log.Errorf("Error dump allocation info, %v", err)
 	}
-	// 初始化索引，待会计算后赋值，表示ip地址在网段中的索引位置
-	c := 0
-	// 转换成4字节表示
+	// 与分配 IP 相反，IP 地址减去网络地址再减 1 就是位图中的索引，由于 IP 是从1开始分配的，所以要减 1
 	releaseIP := ipaddr.To4()
-	// 由于 IP 是从1开始分配的，所以转换成索引应减 1
-	releaseIP[3] -= 1
-	/*
-		与分配 IP 相反，释放 IP 获得索引的方式是 IP 地址的每一位相减之后分别左移将对应的数值加到索引上
-	*/
-	for t := uint(4); t > 0; t -= 1 {
-		c += int(releaseIP[t-1]-subnet.IP[t-1]) << ((4 - t) * 8)
+	if releaseIP == nil || !subnet.Contains(releaseIP) {
+		return fmt.Errorf("ip %s is not in subnet %s", ipaddr, subnet)
 	}
-	// 将分配的位图数组中索引位置的值置为0
+	c := int(binary.BigEndian.Uint32(releaseIP)-binary.BigEndian.Uint32(subnet.IP.To4())) - 1
 	ipAlloc := []byte((*ipam.Subnets)[subnet.String()])
+	if c < 0 || c >= len(ipAlloc) {
+		return fmt.Errorf("ip %s is not allocated in subnet %s", ipaddr, subnet)
+	}
+	// 将分配的位图数组中索引位置的值置为0
 	ipAlloc[c] = '0'
 	(*ipam.Subnets)[subnet.String()] = string(ipAlloc)
 
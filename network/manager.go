@@ -0,0 +1,628 @@
+/*
+@Time :    2022/3/26 15:00
+@Author :  liuzhi
+@File :    manager
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"my-container/container"
+	"my-container/events"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ManagerConfig 创建 Manager 需要的依赖，没有指定的使用默认值
+type ManagerConfig struct {
+	// StateDir 网络配置的保存目录，每个网络一个 json 文件
+	StateDir string
+	// IPAM 为空时在 StateDir/ipam/subnet.json 中记录分配情况
+	IPAM *IPAM
+	// Drivers 为空时使用通过 RegisterDriver 注册的驱动
+	Drivers []NetDriver
+	// Netlink 为空时直接操作内核，驱动需要使用同一个 Netlink，比如 NewBridgeDriver(nl)
+	Netlink Netlink
+	// Firewall 为空时自动选择 iptables 或 nftables
+	Firewall Firewall
+	// IfPrefix 容器中网卡名的前缀，为空时使用 eth，容器中的网卡依次命名为 eth0、eth1
+	IfPrefix string
+	// Publish 发布网络事件，为空时使用 events.Publish 写入全局的事件日志
+	Publish func(eventType, action, id string, attributes map[string]string)
+}
+
+// DefaultIfPrefix 容器中网卡名的默认前缀
+const DefaultIfPrefix = "eth"
+
+// 状态目录下 IPAM 和防火墙使用的子目录，不能作为网络名
+const (
+	ipamDirName     = "ipam"
+	firewallDirName = "firewall"
+)
+
+// networkNamePattern 网络名会作为状态目录下的文件名和端点文件名的一部分，只允许这些字符
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Manager 管理一个状态目录下的所有网络，不同的 Manager 之间互不影响，可以在测试中并行使用
+type Manager struct {
+	stateDir string
+	ipam     *IPAM
+	drivers  map[string]NetDriver
+	nl       Netlink
+	fw       Firewall
+	ifPrefix string
+	publish  func(eventType, action, id string, attributes map[string]string)
+
+	mu        sync.Mutex
+	networks  map[string]*Network
+	endpoints map[string]*Endpoint
+}
+
+// NewManager 创建 Manager 并加载状态目录中已有的网络
+func NewManager(cfg ManagerConfig) (*Manager, error) {
+	if cfg.StateDir == "" {
+		return nil, fmt.Errorf("network state directory is empty")
+	}
+	m := &Manager{
+		stateDir:  cfg.StateDir,
+		ipam:      cfg.IPAM,
+		drivers:   map[string]NetDriver{},
+		nl:        cfg.Netlink,
+		fw:        cfg.Firewall,
+		ifPrefix:  cfg.IfPrefix,
+		publish:   cfg.Publish,
+		networks:  map[string]*Network{},
+		endpoints: map[string]*Endpoint{},
+	}
+	if m.nl == nil {
+		m.nl = NewNetlink()
+	}
+	if m.publish == nil {
+		m.publish = events.Publish
+	}
+	if m.ifPrefix == "" {
+		m.ifPrefix = DefaultIfPrefix
+	}
+	if err := validIfPrefix(m.ifPrefix); err != nil {
+		return nil, err
+	}
+	if m.fw == nil {
+		fw, err := NewFirewall(FirewallAuto, cfg.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		m.fw = fw
+	}
+	if m.ipam == nil {
+		m.ipam = &IPAM{SubnetAllocatorPath: path.Join(cfg.StateDir, ipamDirName, "subnet.json")}
+	}
+	if cfg.Drivers == nil {
+		driversMu.RLock()
+		for name, d := range drivers {
+			m.drivers[name] = d
+		}
+		driversMu.RUnlock()
+	}
+	for _, d := range cfg.Drivers {
+		if _, ok := m.drivers[d.Name()]; ok {
+			return nil, fmt.Errorf("network driver %s is already registered", d.Name())
+		}
+		m.drivers[d.Name()] = d
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load 读取状态目录下的网络配置，单个文件损坏只打印日志
+func (m *Manager) load() error {
+	if err := os.MkdirAll(m.stateDir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(m.stateDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		nw := &Network{Name: f.Name()}
+		if err := nw.load(path.Join(m.stateDir, f.Name())); err != nil {
+			log.Errorf("error load network %s: %v", f.Name(), err)
+			continue
+		}
+		m.networks[nw.Name] = nw
+	}
+	log.Debugf("networks: %v", m.networks)
+	endpoints, err := loadEndpoints(m.stateDir)
+	if err != nil {
+		return fmt.Errorf("load endpoints error: %v", err)
+	}
+	for _, ep := range endpoints {
+		nw, ok := m.networks[ep.NetworkName]
+		if !ok {
+			log.Warnf("endpoint %s belongs to unknown network %s", ep.ID, ep.NetworkName)
+			continue
+		}
+		ep.Network = nw
+		m.endpoints[ep.ID] = ep
+	}
+	return nil
+}
+
+// stateLockName 状态目录下的锁文件，以 . 开头，加载网络配置时会跳过
+const stateLockName = ".lock"
+
+// lock 修改网络之前加锁，除了进程内的互斥锁，还对状态目录加文件锁
+// 每个容器的 shim 都会连接网络，多个进程同时修改 IPAM 和端点文件会分配出相同的地址，所以加锁之后重新加载状态
+func (m *Manager) lock() (func(), error) {
+	m.mu.Lock()
+	lockFile, err := os.OpenFile(path.Join(m.stateDir, stateLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	unlock := func() {
+		_ = lockFile.Close()
+		m.mu.Unlock()
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		unlock()
+		return nil, fmt.Errorf("lock network state error: %v", err)
+	}
+	m.networks = map[string]*Network{}
+	m.endpoints = map[string]*Endpoint{}
+	if err := m.load(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// driver 查找驱动，找不到时列出所有可用的驱动
+func (m *Manager) driver(name string) (NetDriver, error) {
+	d, ok := m.drivers[name]
+	if !ok {
+		names := make([]string, 0, len(m.drivers))
+		for n := range m.drivers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("network driver %q not found, available drivers: %s", name, strings.Join(names, ", "))
+	}
+	return d, nil
+}
+
+// Create 创建网络，子网的第一个地址作为网关，options 交给驱动校验和使用
+func (m *Manager) Create(driver, subnet, name string, labels, options map[string]string) (*Network, error) {
+	if err := validNetworkName(name); err != nil {
+		return nil, err
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, ok := m.networks[name]; ok {
+		return nil, fmt.Errorf("network with name %s already exists", name)
+	}
+	d, err := m.driver(driver)
+	if err != nil {
+		return nil, err
+	}
+	// 通过 ParseCIDR 转换网段字符串
+	// For example, ParseCIDR("192.0.2.1/24") returns the IP address
+	// 192.0.2.1 and the network 192.0.2.0/24.
+	ip, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	if ip.To4() == nil && !d.Capability().IPv6 {
+		return nil, fmt.Errorf("network driver %s does not support IPv6 subnet %s", driver, subnet)
+	}
+	// 不同的网络不能共用同一个网桥，否则删除其中一个网络时会影响另一个
+	if d.Capability().NeedsBridge {
+		bridge := (&Network{Name: name, Options: options}).BridgeName()
+		for _, other := range m.networks {
+			if other.BridgeName() == bridge {
+				return nil, fmt.Errorf("bridge %s is already used by network %s", bridge, other.Name)
+			}
+		}
+	}
+	// 通过IPAM组件分配IP，获取网段中的第一个IP作为网关的IP
+	gatewayIp, err := m.ipam.Allocator(cidr)
+	if err != nil {
+		return nil, err
+	}
+	// cidr 由 { IP，Mask } 两个成员变量组成
+	cidr.IP = gatewayIp
+	nw, err := d.Create(cidr.String(), name, options)
+	if err != nil {
+		_ = m.ipam.Release(cidr, &gatewayIp)
+		return nil, err
+	}
+	nw.Labels = labels
+	// 网桥类型的网络需要配置 SNAT 和网络之间的隔离规则
+	if d.Capability().NeedsBridge {
+		if err := m.setupFirewall(nw); err != nil {
+			_ = m.fw.Flush(nw.BridgeName())
+			_ = d.Delete(*nw)
+			_ = m.ipam.Release(cidr, &gatewayIp)
+			return nil, err
+		}
+	}
+	// 保存网络配置，方便后续查询网络端点信息，数据保存在文件中
+	if err := nw.dump(m.stateDir); err != nil {
+		return nil, err
+	}
+	m.networks[name] = nw
+	attributes := map[string]string{"name": name, "type": driver}
+	for k, v := range labels {
+		attributes[k] = v
+	}
+	m.publish(events.NetworkEvent, "create", name, attributes)
+	return nw, nil
+}
+
+// Delete 删除网络，释放网关地址并删除驱动创建的设备
+func (m *Manager) Delete(name string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nw, ok := m.networks[name]
+	if !ok {
+		return fmt.Errorf("no Such Network: %s", name)
+	}
+	d, err := m.driver(nw.Driver)
+	if err != nil {
+		return err
+	}
+	// 清理已经退出的容器留下的端点
+	for _, ep := range m.endpoints {
+		if ep.NetworkName == name {
+			if err := m.releaseEndpoint(d, ep); err != nil {
+				return err
+			}
+		}
+	}
+	// 通过 IPAM 释放网络网关的 IP
+	if err := m.ipam.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
+		return fmt.Errorf("error Remove Network gateway ip: %s", err)
+	}
+	if d.Capability().NeedsBridge {
+		if err := m.fw.Flush(nw.BridgeName()); err != nil {
+			return fmt.Errorf("error Remove Network firewall rules: %s", err)
+		}
+	}
+	// 调用网络驱动，删除网络创建的设备和配置
+	if err := d.Delete(*nw); err != nil {
+		return fmt.Errorf("error Remove Network DriverError: %s", err)
+	}
+	// 从网络的配置目录中，删除该网络的配置文件
+	if err := nw.remove(m.stateDir); err != nil {
+		return err
+	}
+	delete(m.networks, name)
+	m.publish(events.NetworkEvent, "destroy", name, map[string]string{"name": name, "type": nw.Driver})
+	return nil
+}
+
+// Connect 连接网络，相当于把veth设备挂到Linux Bridge网桥上，容器中的网卡依次命名为 eth0、eth1，默认路由在第一块网卡上
+func (m *Manager) Connect(networkName string, containerInfo *container.ContainerInfo) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// 从 dict 中获取容器的网络连接信息
+	nw, ok := m.networks[networkName]
+	if !ok {
+		return fmt.Errorf("network %s not found", networkName)
+	}
+	d, err := m.driver(nw.Driver)
+	if err != nil {
+		return err
+	}
+	id := endpointID(containerInfo.Id, networkName)
+	if _, ok := m.endpoints[id]; ok {
+		return fmt.Errorf("container %s is already connected to network %s", containerInfo.Id, networkName)
+	}
+	pid, err := strconv.Atoi(containerInfo.Pid)
+	if err != nil {
+		return fmt.Errorf("invalid container pid %q", containerInfo.Pid)
+	}
+	portMappings := make([]PortMapping, 0, len(containerInfo.PortMapping))
+	for _, s := range containerInfo.PortMapping {
+		pm, err := ParsePortMapping(s)
+		if err != nil {
+			return err
+		}
+		portMappings = append(portMappings, pm)
+	}
+	if err := m.checkPortMappings(containerInfo.Id, portMappings); err != nil {
+		return err
+	}
+	ifName, ifIndex, err := nextIfName(m.nl, pid, m.ifPrefix)
+	if err != nil {
+		return fmt.Errorf("error find interface name in container: %v", err)
+	}
+	// 从网络的 IP 段中，分配容器IP地址
+	ip, err := m.ipam.Allocator(nw.IpRange)
+	if err != nil {
+		log.Error("调用 Connect, ip 分配失败")
+		return err
+	}
+	// 创建网络端点，设置网络端点的 IP、网络和端口映射信息，供下面的配置调用
+	endpoint := &Endpoint{
+		ID:          id,
+		ContainerID: containerInfo.Id,
+		NetworkName: networkName,
+		IPAddress:   ip,
+		Network:     nw,
+		PortMapping: containerInfo.PortMapping,
+		IfName:      ifName,
+	}
+	if err := m.connect(d, endpoint, containerInfo, portMappings, ifIndex == 0); err != nil {
+		// 失败时清理已经创建的设备、规则和分配的地址
+		_ = d.Disconnect(*nw, endpoint)
+		for _, pm := range portMappings {
+			_ = m.fw.RemovePortMapping(nw.BridgeName(), ip, pm)
+		}
+		_ = m.ipam.Release(nw.IpRange, &ip)
+		return err
+	}
+	if err := endpoint.dump(m.stateDir); err != nil {
+		return fmt.Errorf("error record endpoint %s: %v", endpoint.ID, err)
+	}
+	m.endpoints[endpoint.ID] = endpoint
+	m.publish(events.NetworkEvent, "connect", networkName, map[string]string{"name": networkName, "container": containerInfo.Id})
+	return nil
+}
+
+// CheckPortMappings 检查宿主机端口是否已经被其他容器占用，run 命令在启动容器之前调用
+func (m *Manager) CheckPortMappings(containerId string, mappings []string) error {
+	portMappings := make([]PortMapping, 0, len(mappings))
+	for _, s := range mappings {
+		pm, err := ParsePortMapping(s)
+		if err != nil {
+			return err
+		}
+		portMappings = append(portMappings, pm)
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.checkPortMappings(containerId, portMappings)
+}
+
+// checkPortMappings 同一个宿主机端口和协议只能映射一次，否则先添加的 DNAT 规则生效，后面的容器访问不到
+// 已经停止的容器在 rm 之前依然占用端口，和保存的端点一致
+func (m *Manager) checkPortMappings(containerId string, portMappings []PortMapping) error {
+	used := map[string]string{}
+	for _, ep := range m.endpoints {
+		if ep.ContainerID == containerId {
+			continue
+		}
+		for _, s := range ep.PortMapping {
+			if pm, err := ParsePortMapping(s); err == nil {
+				used[fmt.Sprintf("%d/%s", pm.HostPort, pm.Proto)] = "container " + ep.ContainerID
+			}
+		}
+	}
+	for _, pm := range portMappings {
+		key := fmt.Sprintf("%d/%s", pm.HostPort, pm.Proto)
+		if owner, ok := used[key]; ok {
+			return fmt.Errorf("host port %s is already allocated by %s", key, owner)
+		}
+		used[key] = "another port mapping of this container"
+	}
+	return nil
+}
+
+func (m *Manager) connect(d NetDriver, endpoint *Endpoint, containerInfo *container.ContainerInfo, portMappings []PortMapping, defaultRoute bool) error {
+	// 调用网络驱动 挂载和配置网络端点
+	if err := d.Connect(endpoint.Network, endpoint); err != nil {
+		return err
+	}
+	// 在容器的 namespace 中配置网络设备的IP地址
+	if err := ConfigEndpointIpAddressAndRoute(m.nl, endpoint, containerInfo, defaultRoute); err != nil {
+		return err
+	}
+	// 配置容器到端口的主机端口的映射（DNAT）
+	for _, pm := range portMappings {
+		if err := m.fw.AddPortMapping(endpoint.Network.BridgeName(), endpoint.IPAddress, pm); err != nil {
+			return fmt.Errorf("error add port mapping %s: %v", pm, err)
+		}
+	}
+	return nil
+}
+
+// Disconnect 断开容器和网络的连接，删除 veth 和端口映射，释放容器的地址
+// 优先使用保存的端点，没有记录时从运行中容器的网卡地址找到对应的端点
+func (m *Manager) Disconnect(networkName string, containerInfo *container.ContainerInfo) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nw, ok := m.networks[networkName]
+	if !ok {
+		return fmt.Errorf("network %s not found", networkName)
+	}
+	d, err := m.driver(nw.Driver)
+	if err != nil {
+		return err
+	}
+	endpoint, ok := m.endpoints[endpointID(containerInfo.Id, networkName)]
+	if !ok {
+		pid, err := strconv.Atoi(containerInfo.Pid)
+		if err != nil {
+			return fmt.Errorf("invalid container pid %q", containerInfo.Pid)
+		}
+		ifName, ip, err := findEndpointIfName(m.nl, pid, nw.IpRange)
+		if err != nil {
+			return fmt.Errorf("container %s is not connected to network %s: %v", containerInfo.Id, networkName, err)
+		}
+		endpoint = &Endpoint{
+			ID:          endpointID(containerInfo.Id, networkName),
+			ContainerID: containerInfo.Id,
+			NetworkName: networkName,
+			IPAddress:   ip,
+			Network:     nw,
+			PortMapping: containerInfo.PortMapping,
+			IfName:      ifName,
+		}
+	}
+	return m.releaseEndpoint(d, endpoint)
+}
+
+// DisconnectContainer 释放容器的所有端点，容器重启和删除时调用，这时容器的 network namespace 已经不存在了
+func (m *Manager) DisconnectContainer(containerId string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, ep := range m.endpoints {
+		if ep.ContainerID != containerId {
+			continue
+		}
+		d, err := m.driver(ep.Network.Driver)
+		if err != nil {
+			return err
+		}
+		if err := m.releaseEndpoint(d, ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEndpoint 删除端点的设备、端口映射和连接跟踪记录，释放地址并删除保存的端点
+func (m *Manager) releaseEndpoint(d NetDriver, endpoint *Endpoint) error {
+	nw := endpoint.Network
+	ip := endpoint.IPAddress
+	if err := d.Disconnect(*nw, endpoint); err != nil {
+		return err
+	}
+	for _, s := range endpoint.PortMapping {
+		pm, err := ParsePortMapping(s)
+		if err != nil {
+			continue
+		}
+		if err := m.fw.RemovePortMapping(nw.BridgeName(), ip, pm); err != nil {
+			return fmt.Errorf("error remove port mapping %s: %v", pm, err)
+		}
+	}
+	// 已经建立的连接还会命中旧的 NAT 记录，需要清掉
+	if err := m.nl.ConntrackDelete(ip); err != nil {
+		log.Warnf("delete conntrack entries of %s error: %v", ip, err)
+	}
+	if err := m.ipam.Release(nw.IpRange, &ip); err != nil {
+		return fmt.Errorf("error release ip %s: %v", ip, err)
+	}
+	if err := endpoint.remove(m.stateDir); err != nil {
+		return err
+	}
+	delete(m.endpoints, endpoint.ID)
+	m.publish(events.NetworkEvent, "disconnect", nw.Name, map[string]string{"name": nw.Name, "container": endpoint.ContainerID})
+	return nil
+}
+
+// Endpoints 返回所有端点，按 ID 排序
+func (m *Manager) Endpoints() []*Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*Endpoint, 0, len(m.endpoints))
+	for _, ep := range m.endpoints {
+		result = append(result, ep)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// List 返回所有网络，按名称排序
+func (m *Manager) List() []*Network {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.networks))
+	for name := range m.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*Network, 0, len(names))
+	for _, name := range names {
+		result = append(result, m.networks[name])
+	}
+	return result
+}
+
+// Inspect 根据名称查找网络
+func (m *Manager) Inspect(name string) (*Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nw, ok := m.networks[name]
+	if !ok {
+		return nil, fmt.Errorf("no Such Network: %s", name)
+	}
+	return nw, nil
+}
+
+// setupFirewall 容器访问外部网络时做 SNAT，并且和其他网桥隔离，规则按照网络的 -o 选项配置
+func (m *Manager) setupFirewall(nw *Network) error {
+	bridge := nw.BridgeName()
+	if nw.MasqueradeEnabled() {
+		if err := m.fw.EnsureMasquerade(bridge, nw.IpRange); err != nil {
+			return fmt.Errorf("error setting masquerade for %s: %v", bridge, err)
+		}
+	}
+	if err := m.fw.Isolate(bridge); err != nil {
+		return fmt.Errorf("error setting isolation for %s: %v", bridge, err)
+	}
+	if !nw.ICCEnabled() {
+		if err := m.fw.DisableICC(bridge); err != nil {
+			return fmt.Errorf("error disabling inter-container communication for %s: %v", bridge, err)
+		}
+	}
+	return nil
+}
+
+// validIfPrefix 网卡名加上序号不能超过 15 个字节，也不能包含 / 和空白字符
+func validIfPrefix(prefix string) error {
+	if len(prefix) > syscall.IFNAMSIZ-1-3 || strings.ContainsAny(prefix, "/: \t\n") {
+		return fmt.Errorf("invalid container interface prefix %q", prefix)
+	}
+	return nil
+}
+
+// validNetworkName 校验网络名，防止通过 ../ 之类的名字写到状态目录之外
+func validNetworkName(name string) error {
+	if !networkNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid network name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-]* are allowed", name)
+	}
+	if name == ipamDirName || name == firewallDirName {
+		return fmt.Errorf("network name %q is reserved", name)
+	}
+	return nil
+}
+
+func endpointID(containerId, networkName string) string {
+	return fmt.Sprintf("%s-%s", containerId, networkName)
+}
@@ -0,0 +1,153 @@
+/*
+@Time :    2022/3/27 10:10
+@Author :  liuzhi
+@File :    netlink
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"net"
+	"runtime"
+)
+
+// Netlink 网络设备、地址和路由的操作，驱动和端点配置都通过它访问内核，测试时可以换成 FakeNetlink
+type Netlink interface {
+	// LinkByName 查找网络设备，不存在时返回 netlink.LinkNotFoundError
+	LinkByName(name string) (netlink.Link, error)
+	// LinkAdd 创建网络设备，相当于 ip link add
+	LinkAdd(link netlink.Link) error
+	// LinkDel 删除网络设备，删除 veth 的一端时另一端也会被删除
+	LinkDel(link netlink.Link) error
+	// LinkSetUp 启动网络设备，相当于 ip link set xxx up
+	LinkSetUp(link netlink.Link) error
+	// LinkSetName 修改网络设备的名字，设备需要处于 down 状态
+	LinkSetName(link netlink.Link, name string) error
+	// LinkList 列出当前 namespace 中的所有网络设备，包括流量统计
+	LinkList() ([]netlink.Link, error)
+	// NetNsIdByPid 返回 pid 所在 network namespace 在当前 namespace 中的 nsid，还没有分配时返回负数
+	NetNsIdByPid(pid int) (int, error)
+	// LinkSetNsPid 把网络设备移到 pid 所在的 network namespace
+	LinkSetNsPid(link netlink.Link, pid int) error
+	// AddrAdd 给网络设备配置地址，相当于 ip addr add
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	// AddrList 列出网络设备上的 IPv4 地址
+	AddrList(link netlink.Link) ([]netlink.Addr, error)
+	// RouteAdd 添加路由，相当于 ip route add
+	RouteAdd(route *netlink.Route) error
+	// ConntrackDelete 删除容器地址相关的连接跟踪记录，避免已经建立的连接继续命中旧的 NAT 规则
+	ConntrackDelete(ip net.IP) error
+	// InNetNs 在 pid 所在的 network namespace 中执行 fn
+	InNetNs(pid int, fn func(nl Netlink) error) error
+}
+
+// NewNetlink 返回直接操作内核的实现
+func NewNetlink() Netlink {
+	return &realNetlink{}
+}
+
+type realNetlink struct{}
+
+func (r *realNetlink) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (r *realNetlink) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (r *realNetlink) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+func (r *realNetlink) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (r *realNetlink) LinkSetName(link netlink.Link, name string) error {
+	return netlink.LinkSetName(link, name)
+}
+
+func (r *realNetlink) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (r *realNetlink) NetNsIdByPid(pid int) (int, error) {
+	return netlink.GetNetNsIdByPid(pid)
+}
+
+func (r *realNetlink) LinkSetNsPid(link netlink.Link, pid int) error {
+	return netlink.LinkSetNsPid(link, pid)
+}
+
+func (r *realNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (r *realNetlink) AddrList(link netlink.Link) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, netlink.FAMILY_V4)
+}
+
+func (r *realNetlink) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+// ConntrackDelete 容器主动发起的连接源地址是容器，端口映射进来的连接回包的源地址是容器
+func (r *realNetlink) ConntrackDelete(ip net.IP) error {
+	for _, tp := range []netlink.ConntrackFilterType{netlink.ConntrackOrigSrcIP, netlink.ConntrackReplySrcIP} {
+		filter := &netlink.ConntrackFilter{}
+		if err := filter.AddIP(tp, ip); err != nil {
+			return err
+		}
+		if _, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, netlink.FAMILY_V4, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InNetNs network namespace 是线程级别的，切换期间锁定线程，执行完成后切换回原来的 namespace
+// 切换回去失败时不解锁线程，goroutine 结束后 runtime 会销毁这个线程，不会让其他 goroutine 跑在容器的 namespace 里
+func (r *realNetlink) InNetNs(pid int, fn func(nl Netlink) error) (err error) {
+	runtime.LockOSThread()
+	restored := true
+	defer func() {
+		if restored {
+			runtime.UnlockOSThread()
+		}
+	}()
+	origin, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("error get current netns: %v", err)
+	}
+	defer func() {
+		_ = origin.Close()
+	}()
+	target, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("error get container net namespace: %v", err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	if err := netns.Set(target); err != nil {
+		return fmt.Errorf("error set netns: %v", err)
+	}
+	restored = false
+	defer func() {
+		if setErr := netns.Set(origin); setErr != nil {
+			log.Errorf("error restore netns, thread stays locked: %v", setErr)
+			if err == nil {
+				err = fmt.Errorf("error restore netns: %v", setErr)
+			}
+			return
+		}
+		restored = true
+	}()
+	return fn(r)
+}
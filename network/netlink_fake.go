@@ -0,0 +1,359 @@
+/*
+@Time :    2022/3/27 10:40
+@Author :  liuzhi
+@File :    netlink_fake
+@Software: GoLand
+*/
+
+package network
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// FakeNetlink 内存中的 Netlink 实现，不需要 root 权限，用于测试
+// 每个 pid 对应一个 network namespace，pid 为 0 表示宿主机，新的 namespace 中只有 lo
+type FakeNetlink struct {
+	state *fakeNetState
+	ns    int
+}
+
+// FakeLink 测试中检查的网络设备状态
+type FakeLink struct {
+	Name        string
+	Type        string
+	Index       int
+	MasterIndex int
+	MTU         int
+	Up          bool
+	PeerName    string
+	Addrs       []string
+}
+
+type fakeNetState struct {
+	mu         sync.Mutex
+	nextIndex  int
+	namespaces map[int]map[string]*fakeLink
+	routes     map[int][]netlink.Route
+	conntrack  []string
+}
+
+type fakeLink struct {
+	FakeLink
+	ns    int
+	peer  *fakeLink
+	stats netlink.LinkStatistics
+}
+
+// NewFakeNetlink 创建宿主机 namespace 的视图
+func NewFakeNetlink() *FakeNetlink {
+	return &FakeNetlink{state: &fakeNetState{
+		nextIndex:  1,
+		namespaces: map[int]map[string]*fakeLink{},
+		routes:     map[int][]netlink.Route{},
+	}}
+}
+
+// links 返回 namespace 中的设备，第一次访问时创建 lo
+func (s *fakeNetState) links(ns int) map[string]*fakeLink {
+	links, ok := s.namespaces[ns]
+	if !ok {
+		links = map[string]*fakeLink{}
+		s.namespaces[ns] = links
+		s.add(ns, &fakeLink{FakeLink: FakeLink{Name: "lo", Type: "device", MTU: 65536}})
+	}
+	return links
+}
+
+func (s *fakeNetState) add(ns int, l *fakeLink) {
+	l.ns = ns
+	l.Index = s.nextIndex
+	s.nextIndex++
+	s.namespaces[ns][l.Name] = l
+}
+
+func (f *FakeNetlink) find(link netlink.Link) (*fakeLink, error) {
+	l, ok := f.state.links(f.ns)[link.Attrs().Name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return l, nil
+}
+
+func (l *fakeLink) toNetlink() netlink.Link {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = l.Name
+	attrs.Index = l.Index
+	attrs.MasterIndex = l.MasterIndex
+	attrs.MTU = l.MTU
+	// 和 docker 一样使用 02:42 开头的本地 MAC 地址，后面是设备的 index
+	attrs.HardwareAddr = net.HardwareAddr{0x02, 0x42, 0, 0, byte(l.Index >> 8), byte(l.Index)}
+	if l.Up {
+		attrs.Flags |= net.FlagUp
+	}
+	// fake 中 nsid 就是 namespace 对应的 pid
+	if l.peer != nil && l.peer.ns != l.ns {
+		attrs.NetNsID = l.peer.ns
+	}
+	stats := l.stats
+	attrs.Statistics = &stats
+	switch l.Type {
+	case "bridge":
+		return &netlink.Bridge{LinkAttrs: attrs}
+	case "veth":
+		return &netlink.Veth{LinkAttrs: attrs, PeerName: l.PeerName}
+	}
+	return &netlink.Device{LinkAttrs: attrs}
+}
+
+func (f *FakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, ok := f.state.links(f.ns)[name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return l.toNetlink(), nil
+}
+
+func (f *FakeNetlink) LinkAdd(link netlink.Link) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	links := f.state.links(f.ns)
+	attrs := link.Attrs()
+	if _, ok := links[attrs.Name]; ok {
+		return syscall.EEXIST
+	}
+	if len(attrs.Name) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("interface name %s is too long", attrs.Name)
+	}
+	mtu := attrs.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+	l := &fakeLink{FakeLink: FakeLink{Name: attrs.Name, Type: link.Type(), MasterIndex: attrs.MasterIndex, MTU: mtu}}
+	if veth, ok := link.(*netlink.Veth); ok {
+		if _, exists := links[veth.PeerName]; exists || veth.PeerName == "" {
+			return syscall.EEXIST
+		}
+		l.PeerName = veth.PeerName
+		peer := &fakeLink{FakeLink: FakeLink{Name: veth.PeerName, Type: "veth", MTU: mtu, PeerName: attrs.Name}}
+		l.peer, peer.peer = peer, l
+		f.state.add(f.ns, peer)
+	}
+	f.state.add(f.ns, l)
+	attrs.Index = l.Index
+	return nil
+}
+
+func (f *FakeNetlink) LinkDel(link netlink.Link) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	f.state.remove(l)
+	if l.peer != nil {
+		f.state.remove(l.peer)
+	}
+	return nil
+}
+
+// remove 删除设备和经过这个设备的路由
+func (s *fakeNetState) remove(l *fakeLink) {
+	delete(s.namespaces[l.ns], l.Name)
+	var routes []netlink.Route
+	for _, r := range s.routes[l.ns] {
+		if r.LinkIndex != l.Index {
+			routes = append(routes, r)
+		}
+	}
+	s.routes[l.ns] = routes
+}
+
+func (f *FakeNetlink) LinkSetUp(link netlink.Link) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	l.Up = true
+	return nil
+}
+
+func (f *FakeNetlink) LinkSetName(link netlink.Link, name string) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	links := f.state.links(f.ns)
+	if _, ok := links[name]; ok {
+		return syscall.EEXIST
+	}
+	if l.Up {
+		return syscall.EBUSY
+	}
+	delete(links, l.Name)
+	l.Name = name
+	links[name] = l
+	if l.peer != nil {
+		l.peer.PeerName = name
+	}
+	return nil
+}
+
+func (f *FakeNetlink) LinkList() ([]netlink.Link, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	var result []netlink.Link
+	for _, l := range f.state.links(f.ns) {
+		result = append(result, l.toNetlink())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Attrs().Index < result[j].Attrs().Index })
+	return result, nil
+}
+
+func (f *FakeNetlink) NetNsIdByPid(pid int) (int, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	if _, ok := f.state.namespaces[pid]; !ok || pid == f.ns {
+		return -1, nil
+	}
+	return pid, nil
+}
+
+func (f *FakeNetlink) LinkSetNsPid(link netlink.Link, pid int) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	target := f.state.links(pid)
+	if _, ok := target[l.Name]; ok {
+		return syscall.EEXIST
+	}
+	// 和内核一样，移动 namespace 之后设备处于 down 状态，地址和路由被清空
+	f.state.remove(l)
+	l.ns, l.Up, l.Addrs, l.MasterIndex = pid, false, nil, 0
+	target[l.Name] = l
+	return nil
+}
+
+func (f *FakeNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	for _, a := range l.Addrs {
+		if a == addr.IPNet.String() {
+			return syscall.EEXIST
+		}
+	}
+	l.Addrs = append(l.Addrs, addr.IPNet.String())
+	return nil
+}
+
+func (f *FakeNetlink) AddrList(link netlink.Link) ([]netlink.Addr, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return nil, err
+	}
+	var result []netlink.Addr
+	for _, a := range l.Addrs {
+		ipNet, err := netlink.ParseIPNet(a)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, netlink.Addr{IPNet: ipNet})
+	}
+	return result, nil
+}
+
+func (f *FakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	found := false
+	for _, l := range f.state.links(f.ns) {
+		if l.Index == route.LinkIndex {
+			found = true
+		}
+	}
+	if !found {
+		return syscall.ENODEV
+	}
+	f.state.routes[f.ns] = append(f.state.routes[f.ns], *route)
+	return nil
+}
+
+func (f *FakeNetlink) ConntrackDelete(ip net.IP) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	f.state.conntrack = append(f.state.conntrack, ip.String())
+	return nil
+}
+
+func (f *FakeNetlink) InNetNs(pid int, fn func(nl Netlink) error) error {
+	return fn(&FakeNetlink{state: f.state, ns: pid})
+}
+
+// Links 返回 pid 对应 namespace 中的所有设备，按名称排序
+func (f *FakeNetlink) Links(pid int) []FakeLink {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	var result []FakeLink
+	for _, l := range f.state.links(pid) {
+		result = append(result, l.FakeLink)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Link 查找 pid 对应 namespace 中的设备
+func (f *FakeNetlink) Link(pid int, name string) (FakeLink, bool) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, ok := f.state.links(pid)[name]
+	if !ok {
+		return FakeLink{}, false
+	}
+	return l.FakeLink, true
+}
+
+// SetStatistics 设置 pid 对应 namespace 中设备的流量统计
+func (f *FakeNetlink) SetStatistics(pid int, name string, stats netlink.LinkStatistics) bool {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	l, ok := f.state.links(pid)[name]
+	if ok {
+		l.stats = stats
+	}
+	return ok
+}
+
+// Routes 返回 pid 对应 namespace 中的路由
+func (f *FakeNetlink) Routes(pid int) []netlink.Route {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	return append([]netlink.Route(nil), f.state.routes[pid]...)
+}
+
+// ConntrackDeleted 返回调用过 ConntrackDelete 的地址
+func (f *FakeNetlink) ConntrackDeleted() []string {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	return append([]string(nil), f.state.conntrack...)
+}
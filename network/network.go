@@ -12,37 +12,77 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"my-container/config"
 	"my-container/container"
+	"my-container/filters"
+	formatter "my-container/format"
 	"net"
 	"os"
 	"path"
-	"path/filepath"
-	"strings"
-	"text/tabwriter"
+	"strconv"
 )
 
-var (
-	defaultNetworkPath = "/var/run/my-container/network/"
-	drivers            = map[string]NetDriver{}
-	networks           = map[string]*Network{}
-)
+var defaultNetworkPath = "/var/run/my-container/network/"
 
 // Network 定义网络基本模型
 type Network struct {
-	Name    string     // 网络名
-	IpRange *net.IPNet // 网络地址端，比如 10.10.1.0/24
-	Driver  string     // 网络驱动名
+	Name    string            // 网络名
+	IpRange *net.IPNet        // 网络地址端，比如 10.10.1.0/24
+	Driver  string            // 网络驱动名
+	Labels  map[string]string `json:",omitempty"` // 用户通过 --label 设置的标签
+	Options map[string]string `json:",omitempty"` // 用户通过 -o 设置的驱动选项
+}
+
+// BridgeName 网络对应的 Linux Bridge 名，没有通过 -o 指定时和网络名相同
+func (net *Network) BridgeName() string {
+	if name := net.Options[BridgeNameOption]; name != "" {
+		return name
+	}
+	return net.Name
+}
+
+// MTU 网桥和 veth 的 MTU，0 表示使用内核的默认值
+func (net *Network) MTU() int {
+	mtu, _ := strconv.Atoi(net.Options[BridgeMTUOption])
+	return mtu
 }
 
-// Endpoint 网络端点
+// ICCEnabled 同一个网络中的容器之间是否可以互相访问，默认允许
+func (net *Network) ICCEnabled() bool {
+	return boolOption(net.Options, BridgeICCOption, true)
+}
+
+// MasqueradeEnabled 容器访问外部网络时是否做 SNAT，默认开启
+func (net *Network) MasqueradeEnabled() bool {
+	return boolOption(net.Options, BridgeMasqueradeOption, true)
+}
+
+func boolOption(options map[string]string, key string, def bool) bool {
+	v, ok := options[key]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// Endpoint 网络端点，连接成功之后保存在网络配置目录中，容器退出后也能知道分配了哪个地址
 // Tips Golang json对象在定义的时候，要声明成员变量是大写才能导出，也就是才会被序列化，可以指定序列化后的名称，一般就是转回驼峰或重写名称
 type Endpoint struct {
 	ID          string           `json:"id"`
-	Device      netlink.Veth     `json:"dev"`
+	ContainerID string           `json:"containerId"`
+	NetworkName string           `json:"network"`
+	Device      netlink.Veth     `json:"-"`
+	HostVeth    string           `json:"hostVeth"` // 宿主机一端的 veth 名
 	IPAddress   net.IP           `json:"ip"`
 	MacAddress  net.HardwareAddr `json:"mac"`
 	PortMapping []string         `json:"portMapping"`
-	Network     *Network
+	IfName      string           `json:"ifName"` // 容器中的网卡名，比如 eth0、eth1
+	Network     *Network         `json:"-"`
 }
 
 func (net *Network) dump(dumpPath string) error {
@@ -100,155 +140,150 @@ func (net *Network) remove(dumpPath string) error {
 }
 
 func (net *Network) load(dumpPath string) error {
-	// 打开，读，反序列化
-	netConfigFile, err := os.Open(dumpPath)
+	// 读取并反序列化
+	netJson, err := ioutil.ReadFile(dumpPath)
 	if err != nil {
 		return err
 	}
-	defer func(netConfigFile *os.File) {
-		err := netConfigFile.Close()
-		if err != nil {
-			log.Error("file close error")
-		}
-	}(netConfigFile)
+	if err := json.Unmarshal(netJson, net); err != nil {
+		log.Errorf("error load netConfigFile info：%v", err)
+		return err
+	}
+	return nil
+}
 
-	netJson := make([]byte, 3000)
-	read, err := netConfigFile.Read(netJson)
+// defaultManager 命令行使用的 Manager，由 Init 创建
+var defaultManager *Manager
+
+// Init 加载保存的网络配置，驱动在包初始化时通过 RegisterDriver 注册，防火墙后端由全局配置决定
+func Init() error {
+	fw, err := NewFirewall(config.Get().Firewall, defaultNetworkPath)
 	if err != nil {
 		return err
 	}
-
-	err = json.Unmarshal(netJson[:read], net)
+	m, err := NewManager(ManagerConfig{
+		StateDir: defaultNetworkPath,
+		IPAM:     ipAllocator,
+		Firewall: fw,
+		IfPrefix: config.Get().ContainerIfPrefix,
+	})
 	if err != nil {
-		log.Errorf("error load netConfigFile info：%v", err)
 		return err
 	}
+	defaultManager = m
 	return nil
 }
 
-// CreateNetwork 创建网络
-func CreateNetwork(driver, subnet, name string) error {
-	// 通过 ParseCIDR 转换网段字符串
-	// For example, ParseCIDR("192.0.2.1/24") returns the IP address
-	// 192.0.2.1 and the network 192.0.2.0/24.
-	ip, cidr, err := net.ParseCIDR(subnet)
-	if err != nil {
-		panic("subnet 参数非法")
+// manager 返回默认的 Manager，还没有初始化时先调用 Init
+func manager() (*Manager, error) {
+	if defaultManager == nil {
+		if err := Init(); err != nil {
+			return nil, err
+		}
 	}
-	log.Debug("网络转换：ip -> ", ip)
-	log.Debug("网络转换：cidr -> ", cidr)
-	// 通过IPAM组件分配IP，获取网段中的第一个IP作为网关的IP
-	gatewayIp, err := ipAllocator.Allocator(cidr)
+	return defaultManager, nil
+}
+
+// CreateNetwork 创建网络
+func CreateNetwork(driver, subnet, name string, labels, options map[string]string) error {
+	m, err := manager()
 	if err != nil {
 		return err
 	}
-	// cidr 由 { IP，Mask } 两个成员变量组成
-	cidr.IP = gatewayIp
-	network, err := drivers[driver].Create(cidr.String(), name)
+	_, err = m.Create(driver, subnet, name, labels, options)
+	return err
+}
+
+// Connect 把容器连接到网络
+func Connect(networkName string, containerInfo *container.ContainerInfo) error {
+	m, err := manager()
 	if err != nil {
 		return err
 	}
-	// 保存网络配置，方便后续查询网络端点信息，数据保存在文件中
-	return network.dump(defaultNetworkPath)
+	return m.Connect(networkName, containerInfo)
 }
 
-// Connect 连接网络，相当于把veth设备挂到Linux Bridge网桥上
-func Connect(networkName string, containerInfo *container.ContainerInfo) error {
-	// 从 dict 中获取容器的网络连接信息
-	network, ok := networks[networkName]
-	if !ok {
-		return fmt.Errorf("network %s not found", networkName)
-	}
-	// 从网络的 IP 段中，分配容器IP地址
-	ip, err := ipAllocator.Allocator(network.IpRange)
+// CheckPortMappings 检查宿主机端口是否已经被其他容器占用
+func CheckPortMappings(containerId string, mappings []string) error {
+	m, err := manager()
 	if err != nil {
-		log.Error("调用 Connect, ip 分配失败")
 		return err
 	}
-	// 创建网络端点，设置网络端点的 IP、网络和端口映射信息，供下面的配置调用
-	endpoint := &Endpoint{
-		ID:          fmt.Sprintf("%s-%s", containerInfo.Id, networkName),
-		IPAddress:   ip,
-		Network:     network,
-		PortMapping: containerInfo.PortMapping,
-	}
-	// 调用网络驱动 挂载和配置网络端点
-	if err = drivers[network.Driver].Connect(network, endpoint); err != nil {
+	return m.CheckPortMappings(containerId, mappings)
+}
+
+// Disconnect 断开容器和网络的连接
+func Disconnect(networkName string, containerInfo *container.ContainerInfo) error {
+	m, err := manager()
+	if err != nil {
 		return err
 	}
-	// 在容器的 namespace 中配置网络设备的IP地址
-	if err = ConfigEndpointIpAddressAndRoute(endpoint, containerInfo); err != nil {
+	return m.Disconnect(networkName, containerInfo)
+}
+
+// DisconnectContainer 释放容器在所有网络上的端点
+func DisconnectContainer(containerId string) error {
+	m, err := manager()
+	if err != nil {
 		return err
 	}
-	// 配置容器到端口的主机端口的映射（通过iptables 做 DNAT）
-	return ConfigPortMapping(endpoint, containerInfo)
+	return m.DisconnectContainer(containerId)
+}
 
+// ListEndpoints 返回保存的所有端点
+func ListEndpoints() ([]*Endpoint, error) {
+	m, err := manager()
+	if err != nil {
+		return nil, err
+	}
+	return m.Endpoints(), nil
 }
 
+// DeleteNetwork 删除网络
 func DeleteNetwork(networkName string) error {
-	// 从 dict 中查找网络信息
-	nw, ok := networks[networkName]
-	if !ok {
-		return fmt.Errorf("no Such Network: %s", networkName)
-	}
-	// 通过 IPAM 释放网络网关的 IP
-	if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
-		return fmt.Errorf("error Remove Network gateway ip: %s", err)
+	m, err := manager()
+	if err != nil {
+		return err
 	}
-	// 调用网络驱动，删除网络创建的设备和配置
-	if err := drivers[nw.Driver].Delete(*nw); err != nil {
-		return fmt.Errorf("error Remove Network DriverError: %s", err)
+	return m.Delete(networkName)
+}
+
+// GetNetwork 根据名称查找网络
+func GetNetwork(name string) (*Network, error) {
+	m, err := manager()
+	if err != nil {
+		return nil, err
 	}
-	// 从网络的配置目录中，删除该网络的配置文件
-	return nw.remove(defaultNetworkPath)
+	return m.Inspect(name)
 }
 
-func Init() error {
-	var bridgeDriver = BridgeNetworkDriver{}
-	drivers[bridgeDriver.Name()] = nil
+// network ls --filter 支持的条件
+var listFilters = []string{"name", "driver", "label"}
 
-	if _, err := os.Stat(defaultNetworkPath); err != nil {
-		if os.IsNotExist(err) {
-			_ = os.MkdirAll(defaultNetworkPath, 0644)
-		} else {
-			return err
-		}
+// ListNetwork 按照 format 输出匹配 filterArgs 的网络列表，format 为空时输出默认的表格，quiet 时只输出网络名
+func ListNetwork(format string, quiet bool, filterArgs []string) error {
+	filter, err := filters.Parse(filterArgs, listFilters...)
+	if err != nil {
+		return err
 	}
-
-	_ = filepath.Walk(defaultNetworkPath, func(nwPath string, info os.FileInfo, err error) error {
-		if strings.HasSuffix(nwPath, "/") {
-			return nil
-		}
-		_, nwName := path.Split(nwPath)
-		nw := &Network{
-			Name: nwName,
+	m, err := manager()
+	if err != nil {
+		return err
+	}
+	var rows []interface{}
+	for _, nw := range m.List() {
+		if !filter.MatchSubstring("name", nw.Name) || !filter.Match("driver", nw.Driver) || !filter.MatchLabels("label", nw.Labels) {
+			continue
 		}
-
-		if err := nw.load(nwPath); err != nil {
-			log.Errorf("error load network: %s", err)
+		if quiet {
+			fmt.Println(nw.Name)
+			continue
 		}
-
-		networks[nwName] = nw
-		return nil
-	})
-
-	log.Infof("networks: %v", networks)
-
-	return nil
-}
-
-func ListNetwork() {
-	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	_, _ = fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
-	for _, nw := range networks {
-		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n",
-			nw.Name,
-			nw.IpRange.String(),
-			nw.Driver,
-		)
+		rows = append(rows, nw)
 	}
-	if err := w.Flush(); err != nil {
-		log.Errorf("Flush error %v", err)
-		return
+	if quiet {
+		return nil
 	}
+	headers := map[string]string{"Name": "NAME", "IpRange": "IpRange", "Driver": "Driver"}
+	return formatter.Table(os.Stdout, format, "table {{.Name}}\t{{.IpRange}}\t{{.Driver}}", headers, rows)
 }
@@ -0,0 +1,67 @@
+/*
+@Time :    2022/3/19 20:40
+@Author :  liuzhi
+@File :    stats
+@Software: GoLand
+*/
+
+package network
+
+import "fmt"
+
+// InterfaceStats 容器一个网络端点的流量统计，以容器的视角计算收发
+type InterfaceStats struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxErrors  uint64 `json:"txErrors"`
+	TxDropped uint64 `json:"txDropped"`
+}
+
+// EndpointStats 读取容器所有网络端点在宿主机一端 veth 的流量统计，key 为宿主机上的设备名
+func EndpointStats(pid int) (map[string]InterfaceStats, error) {
+	m, err := manager()
+	if err != nil {
+		return nil, err
+	}
+	return m.EndpointStats(pid)
+}
+
+// EndpointStats 通过 veth 的 link-netnsid 和容器网络 namespace 的 nsid 匹配，不需要进入容器的 namespace
+func (m *Manager) EndpointStats(pid int) (map[string]InterfaceStats, error) {
+	nsId, err := m.nl.NetNsIdByPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("get netns id of pid %d error: %v", pid, err)
+	}
+	links, err := m.nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]InterfaceStats{}
+	// 内核还没有给容器的 namespace 分配 nsid，说明没有跨 namespace 的 veth
+	if nsId < 0 {
+		return stats, nil
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if link.Type() != "veth" || attrs.NetNsID != nsId || attrs.Statistics == nil {
+			continue
+		}
+		// 宿主机一端收到的就是容器发出的，所以收发需要交换
+		s := attrs.Statistics
+		stats[attrs.Name] = InterfaceStats{
+			RxBytes:   s.TxBytes,
+			RxPackets: s.TxPackets,
+			RxErrors:  s.TxErrors,
+			RxDropped: s.TxDropped,
+			TxBytes:   s.RxBytes,
+			TxPackets: s.RxPackets,
+			TxErrors:  s.RxErrors,
+			TxDropped: s.RxDropped,
+		}
+	}
+	return stats, nil
+}
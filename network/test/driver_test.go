@@ -0,0 +1,76 @@
+/*
+@Time :    2022/3/26 10:20
+@Author :  liuzhi
+@File :    driver_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"my-container/network"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeDriver struct {
+	name  string
+	scope string
+}
+
+func (d *fakeDriver) Name() string { return d.name }
+
+func (d *fakeDriver) Capability() network.Capability {
+	return network.Capability{Scope: d.scope}
+}
+
+func (d *fakeDriver) Create(subnet string, name string, options map[string]string) (*network.Network, error) {
+	ip, ipRange, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ipRange.IP = ip
+	return &network.Network{Name: name, IpRange: ipRange, Driver: d.name, Options: options}, nil
+}
+
+func (d *fakeDriver) Delete(nw network.Network) error { return nil }
+
+func (d *fakeDriver) Connect(nw *network.Network, endpoint *network.Endpoint) error { return nil }
+
+func (d *fakeDriver) Disconnect(nw network.Network, endpoint *network.Endpoint) error { return nil }
+
+func TestRegisterDriver(t *testing.T) {
+	if err := network.RegisterDriver(&fakeDriver{name: "bridge", scope: network.ScopeLocal}); err == nil {
+		t.Fatalf("expected duplicate driver error")
+	}
+	if err := network.RegisterDriver(&fakeDriver{name: "fake", scope: "cluster"}); err == nil {
+		t.Fatalf("expected invalid scope error")
+	}
+	if err := network.RegisterDriver(&fakeDriver{name: "fake", scope: network.ScopeGlobal}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := network.GetDriver("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Capability().Scope != network.ScopeGlobal {
+		t.Fatalf("unexpected scope %s", d.Capability().Scope)
+	}
+
+	_, err = network.GetDriver("overlay")
+	if err == nil || !strings.Contains(err.Error(), "available drivers: bridge, fake") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateNetworkValidatesDriver(t *testing.T) {
+	m := newFakeEnv(t).manager(t, "")
+	_, err := m.Create("macvlan", "192.168.10.0/24", "test", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "available drivers") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.Create("bridge", "fd00::/64", "test", nil, nil); err == nil {
+		t.Fatalf("expected IPv6 not supported error")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+@Time :    2022/3/26 16:00
+@Author :  liuzhi
+@File :    manager_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"my-container/container"
+	"my-container/network"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// discardEvents 测试中不把网络事件写到宿主机的事件日志里
+func discardEvents(eventType, action, id string, attributes map[string]string) {}
+
+// tempStateDir 创建测试用的状态目录，测试结束后删除
+func tempStateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestManager 创建只有 fakeDriver 的 Manager，不操作网卡和防火墙
+func newTestManager(t *testing.T) (*network.Manager, string) {
+	dir := tempStateDir(t)
+	m, err := network.NewManager(network.ManagerConfig{
+		StateDir: dir,
+		Drivers:  []network.NetDriver{&fakeDriver{name: "fake", scope: network.ScopeLocal}},
+		Publish:  discardEvents,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, dir
+}
+
+// fakeEnv 使用 FakeNetlink 和 FakeFirewall 的 bridge 网络环境，同一个环境中的 Manager 共享状态目录和 fake
+type fakeEnv struct {
+	dir string
+	nl  *network.FakeNetlink
+	fw  *network.FakeFirewall
+}
+
+func newFakeEnv(t *testing.T) *fakeEnv {
+	return &fakeEnv{dir: tempStateDir(t), nl: network.NewFakeNetlink(), fw: network.NewFakeFirewall()}
+}
+
+// manager 创建一个新的 Manager，相当于另一个进程加载同一个状态目录，ifPrefix 为空时使用默认前缀
+func (e *fakeEnv) manager(t *testing.T, ifPrefix string) *network.Manager {
+	m, err := network.NewManager(network.ManagerConfig{
+		StateDir: e.dir,
+		Drivers:  []network.NetDriver{network.NewBridgeDriver(e.nl)},
+		Netlink:  e.nl,
+		Firewall: e.fw,
+		IfPrefix: ifPrefix,
+		Publish:  discardEvents,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestManagerCreateDelete(t *testing.T) {
+	// 每个 Manager 使用自己的状态目录，可以并行执行
+	for _, name := range []string{"a", "b"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			m, dir := newTestManager(t)
+			if _, err := m.Create("bridge", "10.20.0.0/24", name, nil, nil); err == nil {
+				t.Fatalf("driver not given to the manager should not be available")
+			}
+			nw, err := m.Create("fake", "10.20.0.0/24", name, map[string]string{"env": "test"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Create("fake", "10.30.0.0/24", name, nil, nil); err == nil {
+				t.Fatalf("expected duplicate network error")
+			}
+			if nw.IpRange.String() != "10.20.0.1/24" {
+				t.Fatalf("unexpected gateway %s", nw.IpRange)
+			}
+
+			// 重新加载状态目录能看到同样的网络
+			reloaded, err := network.NewManager(network.ManagerConfig{
+				StateDir: dir,
+				Drivers:  []network.NetDriver{&fakeDriver{name: "fake", scope: network.ScopeLocal}},
+				Publish:  discardEvents,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := reloaded.Inspect(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Labels["env"] != "test" || got.IpRange.String() != "10.20.0.1/24" {
+				t.Fatalf("unexpected reloaded network %+v", got)
+			}
+			if err := reloaded.Delete(name); err != nil {
+				t.Fatal(err)
+			}
+			if len(reloaded.List()) != 0 {
+				t.Fatalf("network not deleted")
+			}
+
+			// 网关地址已经释放，再次创建得到同样的网关
+			nw, err = reloaded.Create("fake", "10.20.0.0/24", name, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nw.IpRange.String() != "10.20.0.1/24" {
+				t.Fatalf("gateway not released, got %s", nw.IpRange)
+			}
+		})
+	}
+}
+
+// TestNetworkName 网络名会拼到状态目录的路径中，不能逃逸出状态目录，也不能覆盖 ipam 和 firewall 目录
+func TestNetworkName(t *testing.T) {
+	m, _ := newTestManager(t)
+	for _, name := range []string{"../../etc/passwd", "a/b", ".hidden", "-net", "", "ipam", "firewall"} {
+		if _, err := m.Create("fake", "10.20.0.0/24", name, nil, nil); err == nil {
+			t.Fatalf("expected error for network name %q", name)
+		}
+	}
+	if _, err := m.Create("fake", "10.20.0.0/24", "my_net-1.0", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentConnect 每个 shim 都有自己的 Manager，同时连接网络时通过状态目录的文件锁分配到不同的地址
+func TestConcurrentConnect(t *testing.T) {
+	env := newFakeEnv(t)
+	if _, err := env.manager(t, "").Create("bridge", "10.70.0.0/24", "concurrentbr", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	const n = 8
+	managers := make([]*network.Manager, n)
+	for i := range managers {
+		managers[i] = env.manager(t, "")
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i, m := range managers {
+		wg.Add(1)
+		go func(i int, m *network.Manager) {
+			defer wg.Done()
+			info := &container.ContainerInfo{Id: fmt.Sprintf("%012d", i), Pid: strconv.Itoa(1000 + i)}
+			errs <- m.Connect("concurrentbr", info)
+		}(i, m)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ips := map[string]bool{}
+	for _, ep := range env.manager(t, "").Endpoints() {
+		ips[ep.IPAddress.String()] = true
+	}
+	if len(ips) != n {
+		t.Fatalf("expected %d distinct addresses, got %v", n, ips)
+	}
+}
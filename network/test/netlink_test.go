@@ -0,0 +1,344 @@
+/*
+@Time :    2022/3/27 14:30
+@Author :  liuzhi
+@File :    netlink_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"my-container/container"
+	"my-container/network"
+	"strings"
+	"testing"
+)
+
+// TestBridgeLifecycle 用 FakeNetlink 和 FakeFirewall 走一遍创建、连接、删除网络的流程，不需要 root 权限
+func TestBridgeLifecycle(t *testing.T) {
+	env := newFakeEnv(t)
+	fake, fw := env.nl, env.fw
+	m := env.manager(t, "")
+	nw, err := m.Create("bridge", "10.30.0.0/24", "testbr", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := nw.IpRange.IP
+	br, ok := fake.Link(0, "testbr")
+	if !ok || !br.Up || len(br.Addrs) != 1 || br.Addrs[0] != "10.30.0.1/24" {
+		t.Fatalf("unexpected bridge %+v", br)
+	}
+	if subnet, _ := fw.Masquerade("testbr"); subnet != "10.30.0.0/24" || !fw.Isolated("testbr") {
+		t.Fatalf("unexpected firewall rules: masquerade %q isolated %v", subnet, fw.Isolated("testbr"))
+	}
+
+	info := &container.ContainerInfo{Id: "abcdef123456", Pid: "4242", PortMapping: []string{"8080:80"}}
+	if err := m.Connect("testbr", info); err != nil {
+		t.Fatal(err)
+	}
+	hostVeth, ok := bridgePort(fake, br.Index)
+	if !ok || !hostVeth.Up || !strings.HasPrefix(hostVeth.Name, "veth") || len(hostVeth.Name) != 15 {
+		t.Fatalf("unexpected host veth %+v", hostVeth)
+	}
+	peer, ok := fake.Link(4242, "eth0")
+	if !ok || !peer.Up || len(peer.Addrs) != 1 || peer.Addrs[0] != "10.30.0.2/24" {
+		t.Fatalf("unexpected container veth %+v", peer)
+	}
+	if lo, _ := fake.Link(4242, "lo"); !lo.Up {
+		t.Fatalf("lo is not up in container")
+	}
+	routes := fake.Routes(4242)
+	if len(routes) != 1 || !routes[0].Gw.Equal(gateway) || routes[0].LinkIndex != peer.Index {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	want := network.FakePortMapping{Bridge: "testbr", IP: "10.30.0.2",
+		PortMapping: network.PortMapping{HostPort: 8080, ContainerPort: 80, Proto: "tcp"}}
+	if pms := fw.PortMappings("testbr"); len(pms) != 1 || pms[0] != want {
+		t.Fatalf("unexpected port mappings %+v", pms)
+	}
+	// 宿主机端口已经被这个容器占用，其他容器不能再映射，udp 不冲突
+	conflict := &container.ContainerInfo{Id: "0123456789ab", Pid: "4343", PortMapping: []string{"8080:81"}}
+	if err := m.Connect("testbr", conflict); err == nil {
+		t.Fatalf("expected error for allocated host port")
+	}
+	if err := m.CheckPortMappings("", []string{"8080:81/udp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连接第二个网络，容器中新增 eth1，不修改默认路由
+	if _, err := m.Create("bridge", "10.31.0.0/24", "otherbr", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := &container.ContainerInfo{Id: info.Id, Pid: info.Pid}
+	if err := m.Connect("otherbr", other); err != nil {
+		t.Fatal(err)
+	}
+	if eth1, ok := fake.Link(4242, "eth1"); !ok || len(eth1.Addrs) != 1 || eth1.Addrs[0] != "10.31.0.2/24" {
+		t.Fatalf("unexpected eth1 %+v", eth1)
+	}
+	if len(fake.Routes(4242)) != 1 {
+		t.Fatalf("unexpected routes %+v", fake.Routes(4242))
+	}
+	if err := m.Disconnect("otherbr", other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Link(4242, "eth1"); ok {
+		t.Fatalf("eth1 not removed")
+	}
+	otherBr, _ := fake.Link(0, "otherbr")
+	if _, ok := bridgePort(fake, otherBr.Index); ok {
+		t.Fatalf("host veth not removed")
+	}
+	if deleted := fake.ConntrackDeleted(); len(deleted) != 1 || deleted[0] != "10.31.0.2" {
+		t.Fatalf("unexpected conntrack deletions %v", deleted)
+	}
+	// 释放的地址可以重新分配
+	if err := m.Connect("otherbr", other); err != nil {
+		t.Fatal(err)
+	}
+	if eth1, _ := fake.Link(4242, "eth1"); len(eth1.Addrs) != 1 || eth1.Addrs[0] != "10.31.0.2/24" {
+		t.Fatalf("released ip not reused: %+v", eth1)
+	}
+
+	if err := m.Disconnect("testbr", info); err != nil {
+		t.Fatal(err)
+	}
+	if len(fw.PortMappings("testbr")) != 0 || len(fake.Routes(4242)) != 0 {
+		t.Fatalf("port mappings or routes not removed on disconnect")
+	}
+	if err := m.Delete("testbr"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Link(0, "testbr"); ok {
+		t.Fatalf("bridge not deleted")
+	}
+	if _, ok := fw.Masquerade("testbr"); ok || fw.Isolated("testbr") || len(fw.PortMappings("testbr")) != 0 {
+		t.Fatalf("firewall rules not flushed")
+	}
+}
+
+func TestParsePortMapping(t *testing.T) {
+	pm, err := network.ParsePortMapping("53:5353/udp")
+	if err != nil || pm != (network.PortMapping{HostPort: 53, ContainerPort: 5353, Proto: "udp"}) {
+		t.Fatalf("unexpected port mapping %+v, %v", pm, err)
+	}
+	for _, s := range []string{"80", "0:80", "80:80/sctp", "a:80"} {
+		if _, err := network.ParsePortMapping(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+// TestEndpointPersistence 端点保存在状态目录中，重新加载之后可以释放退出容器的地址
+func TestEndpointPersistence(t *testing.T) {
+	env := newFakeEnv(t)
+	fake, fw := env.nl, env.fw
+	m := env.manager(t, "")
+	if _, err := m.Create("bridge", "10.40.0.0/24", "persistbr", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	info := &container.ContainerInfo{Id: "fedcba654321", Pid: "100", PortMapping: []string{"8081:80"}}
+	if err := m.Connect("persistbr", info); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Connect("persistbr", info); err == nil {
+		t.Fatalf("expected error when connecting twice")
+	}
+
+	reloaded := env.manager(t, "")
+	endpoints := reloaded.Endpoints()
+	if len(endpoints) != 1 {
+		t.Fatalf("unexpected endpoints %+v", endpoints)
+	}
+	ep := endpoints[0]
+	if ep.ContainerID != info.Id || ep.NetworkName != "persistbr" || ep.IPAddress.String() != "10.40.0.2" ||
+		len(ep.HostVeth) != 15 || ep.IfName != "eth0" || len(ep.MacAddress) == 0 || ep.Network == nil {
+		t.Fatalf("unexpected endpoint %+v", ep)
+	}
+
+	// 容器退出之后 namespace 已经不存在，只靠保存的端点释放
+	if err := reloaded.DisconnectContainer(info.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Endpoints()) != 0 || len(env.manager(t, "").Endpoints()) != 0 {
+		t.Fatalf("endpoints not removed")
+	}
+	if _, ok := fake.Link(0, ep.HostVeth); ok || len(fw.PortMappings("persistbr")) != 0 {
+		t.Fatalf("host veth or port mappings not removed")
+	}
+	info.Pid = "101"
+	if err := reloaded.Connect("persistbr", info); err != nil {
+		t.Fatal(err)
+	}
+	if ep := reloaded.Endpoints()[0]; ep.IPAddress.String() != "10.40.0.2" {
+		t.Fatalf("released ip not reused, got %s", ep.IPAddress)
+	}
+}
+
+// TestIfPrefix 容器中的网卡名前缀可以配置，宿主机一端的名字在不同网络之间不冲突
+func TestIfPrefix(t *testing.T) {
+	env := newFakeEnv(t)
+	fake := env.nl
+	m := env.manager(t, "net")
+	info := &container.ContainerInfo{Id: "0123456789ab", Pid: "200"}
+	for i, subnet := range []string{"10.50.0.0/24", "10.51.0.0/24"} {
+		name := fmt.Sprintf("prefixbr%d", i)
+		if _, err := m.Create("bridge", subnet, name, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Connect(name, info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"net0", "net1"} {
+		if _, ok := fake.Link(200, name); !ok {
+			t.Fatalf("interface %s not found in container, got %+v", name, fake.Links(200))
+		}
+	}
+	endpoints := m.Endpoints()
+	if len(endpoints) != 2 || endpoints[0].HostVeth == endpoints[1].HostVeth {
+		t.Fatalf("unexpected endpoints %+v", endpoints)
+	}
+
+	_, err := network.NewManager(network.ManagerConfig{StateDir: env.dir, IfPrefix: "averylongprefix"})
+	if err == nil {
+		t.Fatalf("expected error for long interface prefix")
+	}
+}
+
+// TestBridgeOptions 通过 -o 指定网桥名和 MTU，关闭 ICC 和地址伪装
+func TestBridgeOptions(t *testing.T) {
+	env := newFakeEnv(t)
+	fake, fw := env.nl, env.fw
+	m := env.manager(t, "")
+	name := "averyveryverylongname"
+	if _, err := m.Create("bridge", "10.60.0.0/24", name, nil, nil); err == nil {
+		t.Fatalf("expected error for long bridge name")
+	}
+	for _, options := range []map[string]string{
+		{"unknown": "1"},
+		{network.BridgeMTUOption: "10"},
+		{network.BridgeICCOption: "maybe"},
+	} {
+		if _, err := m.Create("bridge", "10.60.0.0/24", "optbr", nil, options); err == nil {
+			t.Fatalf("expected error for options %v", options)
+		}
+	}
+
+	options := map[string]string{
+		network.BridgeNameOption:       "br-opt",
+		network.BridgeMTUOption:        "1450",
+		network.BridgeICCOption:        "false",
+		network.BridgeMasqueradeOption: "false",
+	}
+	if _, err := m.Create("bridge", "10.60.0.0/24", name, nil, options); err != nil {
+		t.Fatal(err)
+	}
+	br, ok := fake.Link(0, "br-opt")
+	if !ok || br.MTU != 1450 {
+		t.Fatalf("unexpected bridge %+v", br)
+	}
+	if _, ok := fw.Masquerade("br-opt"); ok {
+		t.Fatalf("masquerade should be disabled")
+	}
+	if !fw.ICCDisabled("br-opt") || !fw.Isolated("br-opt") {
+		t.Fatalf("unexpected firewall rules: icc disabled %v isolated %v", fw.ICCDisabled("br-opt"), fw.Isolated("br-opt"))
+	}
+
+	info := &container.ContainerInfo{Id: "fedcba654321", Pid: "300"}
+	if err := m.Connect(name, info); err != nil {
+		t.Fatal(err)
+	}
+	hostVeth, ok := bridgePort(fake, br.Index)
+	if !ok || hostVeth.MTU != 1450 {
+		t.Fatalf("unexpected host veth %+v", hostVeth)
+	}
+	if peer, ok := fake.Link(300, "eth0"); !ok || peer.MTU != 1450 {
+		t.Fatalf("unexpected container veth %+v", peer)
+	}
+
+	// 另一个网络不能使用同一个网桥
+	if _, err := m.Create("bridge", "10.61.0.0/24", "optbr2", nil, map[string]string{network.BridgeNameOption: "br-opt"}); err == nil {
+		t.Fatalf("expected error for duplicate bridge name")
+	}
+
+	if err := m.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Link(0, "br-opt"); ok {
+		t.Fatalf("bridge br-opt not removed")
+	}
+	if fw.ICCDisabled("br-opt") {
+		t.Fatalf("firewall rules of br-opt not flushed")
+	}
+}
+
+// TestBridgeNameExistingDevice 网桥名指向宿主机上已经存在的设备时拒绝创建，不能接管或者删除它
+func TestBridgeNameExistingDevice(t *testing.T) {
+	env := newFakeEnv(t)
+	m := env.manager(t, "")
+	if err := env.nl.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []string{"docker0", "lo"} {
+		options := map[string]string{network.BridgeNameOption: device}
+		if _, err := m.Create("bridge", "10.62.0.0/24", "existbr", nil, options); err == nil {
+			t.Fatalf("expected error for existing device %s", device)
+		}
+		l, ok := env.nl.Link(0, device)
+		if !ok || len(l.Addrs) != 0 {
+			t.Fatalf("existing device %s should be left untouched, got %+v", device, l)
+		}
+	}
+	// 失败时网关地址已经释放
+	nw, err := m.Create("bridge", "10.62.0.0/24", "existbr", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nw.IpRange.String() != "10.62.0.1/24" {
+		t.Fatalf("gateway not released, got %s", nw.IpRange)
+	}
+}
+
+// TestEndpointStats 流量统计从宿主机一端的 veth 读取，收发以容器的视角交换
+func TestEndpointStats(t *testing.T) {
+	env := newFakeEnv(t)
+	m := env.manager(t, "")
+	if _, err := m.Create("bridge", "10.63.0.0/24", "statsbr", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	info := &container.ContainerInfo{Id: "abcdef987654", Pid: "400"}
+	if err := m.Connect("statsbr", info); err != nil {
+		t.Fatal(err)
+	}
+	br, _ := env.nl.Link(0, "statsbr")
+	hostVeth, ok := bridgePort(env.nl, br.Index)
+	if !ok {
+		t.Fatalf("host veth not found")
+	}
+	env.nl.SetStatistics(0, hostVeth.Name, netlink.LinkStatistics{RxBytes: 100, RxPackets: 2, TxBytes: 300, TxPackets: 4})
+	stats, err := m.EndpointStats(400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := stats[hostVeth.Name]
+	if len(stats) != 1 || !ok || s.RxBytes != 300 || s.RxPackets != 4 || s.TxBytes != 100 || s.TxPackets != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// 没有连接网络的容器没有统计
+	if stats, err := m.EndpointStats(401); err != nil || len(stats) != 0 {
+		t.Fatalf("unexpected stats %+v, %v", stats, err)
+	}
+}
+
+// bridgePort 查找挂在网桥上的 veth
+func bridgePort(fake *network.FakeNetlink, bridgeIndex int) (network.FakeLink, bool) {
+	for _, l := range fake.Links(0) {
+		if l.Type == "veth" && l.MasterIndex == bridgeIndex {
+			return l, true
+		}
+	}
+	return network.FakeLink{}, false
+}
@@ -11,125 +11,152 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
 	"my-container/container"
 	"net"
-	"os"
-	"os/exec"
-	"runtime"
-	"strings"
+	"strconv"
 	"time"
 )
 
-func ConfigEndpointIpAddressAndRoute(ep *Endpoint, containerInfo *container.ContainerInfo) error {
-	peerLink, err := netlink.LinkByName(ep.Device.PeerName)
+// ConfigEndpointIpAddressAndRoute 把 veth 的另一端移到容器的 network namespace 中，配置地址，defaultRoute 时配置默认路由
+func ConfigEndpointIpAddressAndRoute(nl Netlink, ep *Endpoint, containerInfo *container.ContainerInfo, defaultRoute bool) error {
+	pid, err := strconv.Atoi(containerInfo.Pid)
 	if err != nil {
-		return fmt.Errorf("fail config endpoint: %v", err)
+		return fmt.Errorf("invalid container pid %q", containerInfo.Pid)
 	}
-
-	defer enterContainerNetNameSpace(&peerLink, containerInfo)()
-
-	interfaceIP := *ep.Network.IpRange
-	interfaceIP.IP = ep.IPAddress
-
-	if err = setInterfaceIP(ep.Device.PeerName, interfaceIP.String()); err != nil {
-		return fmt.Errorf("%v,%s", ep.Network, err)
+	peerLink, err := nl.LinkByName(ep.Device.PeerName)
+	if err != nil {
+		return fmt.Errorf("fail config endpoint: %v", err)
 	}
-
-	if err = setInterfaceUP(ep.Device.PeerName); err != nil {
-		return err
+	// 修改veth peer 另外一端移到容器的namespace中
+	if err = nl.LinkSetNsPid(peerLink, pid); err != nil {
+		return fmt.Errorf("error set link netns, %v", err)
 	}
 
-	if err = setInterfaceUP("lo"); err != nil {
-		return err
-	}
+	// 进入容器的 namespace 配置网络设备，执行完成之后再恢复到之前的namespace
+	return nl.InNetNs(pid, func(nl Netlink) error {
+		// 移动之后设备处于 down 状态，可以直接改名为 eth0、eth1 这样的网卡名，不会和宿主机上的设备冲突
+		peerLink, err := nl.LinkByName(ep.Device.PeerName)
+		if err != nil {
+			return err
+		}
+		if err := nl.LinkSetName(peerLink, ep.IfName); err != nil {
+			return fmt.Errorf("error rename %s to %s: %v", ep.Device.PeerName, ep.IfName, err)
+		}
+		ep.MacAddress = peerLink.Attrs().HardwareAddr
 
-	_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
+		interfaceIP := *ep.Network.IpRange
+		interfaceIP.IP = ep.IPAddress
 
-	defaultRoute := &netlink.Route{
-		LinkIndex: peerLink.Attrs().Index,
-		Gw:        ep.Network.IpRange.IP,
-		Dst:       cidr,
-	}
+		if err := setInterfaceIP(nl, ep.IfName, interfaceIP.String()); err != nil {
+			return fmt.Errorf("%v,%s", ep.Network, err)
+		}
 
-	if err = netlink.RouteAdd(defaultRoute); err != nil {
-		return err
-	}
+		if err := setInterfaceUP(nl, ep.IfName); err != nil {
+			return err
+		}
 
-	return nil
-}
+		if err := setInterfaceUP(nl, "lo"); err != nil {
+			return err
+		}
 
-func ConfigPortMapping(ep *Endpoint, containerInfo *container.ContainerInfo) error {
-	log.Info("端口映射为：", containerInfo.PortMapping)
-	for _, pm := range ep.PortMapping {
-		portMapping := strings.Split(pm, ":")
-		if len(portMapping) != 2 {
-			log.Errorf("port mapping format error, %v", pm)
-			continue
+		// 默认路由只配置在第一块网卡上，后面连接的网络只能访问各自的子网
+		if !defaultRoute {
+			return nil
 		}
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
-			portMapping[0], ep.IPAddress.String(), portMapping[1])
-		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-		// err := cmd.Run()
-		output, err := cmd.Output()
+
+		// 移动 namespace 之后设备的 index 会变化，重新查询
+		peerLink, err = nl.LinkByName(ep.IfName)
 		if err != nil {
-			log.Errorf("iptables Output, %v", output)
-			continue
+			return err
 		}
-	}
-	return nil
-}
 
-func enterContainerNetNameSpace(enLink *netlink.Link, containerInfo *container.ContainerInfo) func() {
-	f, err := os.OpenFile(fmt.Sprintf("/proc/%s/ns/net", containerInfo.Pid), os.O_RDONLY, 0)
-	if err != nil {
-		log.Errorf("error get container net namespace, %v", err)
-	}
+		_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
 
-	nsFD := f.Fd()
-	runtime.LockOSThread()
+		defaultRoute := &netlink.Route{
+			LinkIndex: peerLink.Attrs().Index,
+			Gw:        ep.Network.IpRange.IP,
+			Dst:       cidr,
+		}
 
-	// 修改veth peer 另外一端移到容器的namespace中
-	if err = netlink.LinkSetNsFd(*enLink, int(nsFD)); err != nil {
-		log.Errorf("error set link netns , %v", err)
-	}
+		return nl.RouteAdd(defaultRoute)
+	})
+}
 
-	// 获取当前的网络namespace
-	netNamespace, err := netns.Get()
-	if err != nil {
-		log.Errorf("error get current netns, %v", err)
-	}
+// nextIfName 返回容器中第一个没有使用的网卡名，比如前缀为 eth 时依次是 eth0、eth1，同时返回序号
+func nextIfName(nl Netlink, pid int, prefix string) (string, int, error) {
+	var (
+		name  string
+		index int
+	)
+	err := nl.InNetNs(pid, func(nl Netlink) error {
+		links, err := nl.LinkList()
+		if err != nil {
+			return err
+		}
+		used := map[string]bool{}
+		for _, l := range links {
+			used[l.Attrs().Name] = true
+		}
+		for index = 0; ; index++ {
+			if name = prefix + strconv.Itoa(index); !used[name] {
+				return nil
+			}
+		}
+	})
+	return name, index, err
+}
 
-	// 设置当前进程到新的网络namespace，并在函数执行完成之后再恢复到之前的namespace
-	if err = netns.Set(netns.NsHandle(nsFD)); err != nil {
-		log.Errorf("error set netns, %v", err)
-	}
-	return func() {
-		_ = netns.Set(netNamespace)
-		_ = netNamespace.Close()
-		runtime.UnlockOSThread()
-		_ = f.Close()
-	}
+// findEndpointIfName 在容器中查找地址属于 ipRange 的网卡，返回网卡名和地址
+func findEndpointIfName(nl Netlink, pid int, ipRange *net.IPNet) (string, net.IP, error) {
+	var (
+		name string
+		ip   net.IP
+	)
+	err := nl.InNetNs(pid, func(nl Netlink) error {
+		links, err := nl.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			addrs, err := nl.AddrList(l)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if ipRange.Contains(addr.IP) {
+					name, ip = l.Attrs().Name, addr.IP
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no interface in network %s", ipRange)
+	})
+	return name, ip, err
 }
 
 // 创建 link bridge
-func createBridgeInterface(bridgeName string) error {
-	// 先检查是否已经创建这个设备，通过 net.InterfaceByName 查询
-	_, err := net.InterfaceByName(bridgeName)
-	// 已存在则返回 nil，报错返回 err
-	if err == nil || !strings.Contains(err.Error(), "no such network interface") {
+func createBridgeInterface(nl Netlink, bridgeName string, mtu int) error {
+	// 先检查是否已经存在这个设备，其他错误直接返回
+	// 使用同一个网桥的网络已经在 Manager 中检查过，这里存在的设备不属于任何网络，可能是 docker0 或者物理网卡，
+	// 接管它会把网关地址配置到宿主机的设备上，删除网络时还会把它删掉，所以直接拒绝
+	_, err := nl.LinkByName(bridgeName)
+	if err == nil {
+		return fmt.Errorf("device %s already exists and is not managed by any network, remove it or choose another name with -o %s", bridgeName, BridgeNameOption)
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
 		return err
 	}
 
 	// new 一个 netlink 的 link 对象
 	la := netlink.NewLinkAttrs()
-	// 设置其 name 为 bridgeName
+	// 设置其 name 为 bridgeName，mtu 为 0 时使用内核的默认值
 	la.Name = bridgeName
+	la.MTU = mtu
 
 	// 创建一个 netlink的Bridge对象
 	br := &netlink.Bridge{LinkAttrs: la}
 	// 通过 LinkAdd 创建 虚拟网络设备Bridge。相当于 ip link add xxx
-	if err := netlink.LinkAdd(br); err != nil {
+	if err := nl.LinkAdd(br); err != nil {
 		return fmt.Errorf("bridge creation failed for bridge %s: %v", bridgeName, err)
 	}
 	return nil
@@ -137,13 +164,13 @@ func createBridgeInterface(bridgeName string) error {
 
 // Set the IP addr of a netlink interface
 // 设置一个网络接口的IP地址
-func setInterfaceIP(name string, rawIP string) error {
+func setInterfaceIP(nl Netlink, name string, rawIP string) error {
 	retries := 2
 	var ipLinkDriver netlink.Link
 	var err error
 	for i := 0; i < retries; i++ {
 		// 查找网络接口
-		ipLinkDriver, err = netlink.LinkByName(name)
+		ipLinkDriver, err = nl.LinkByName(name)
 		if err == nil {
 			break
 		}
@@ -162,36 +189,19 @@ func setInterfaceIP(name string, rawIP string) error {
 	// 同时如果配置了地址所在网段的信息，例如 192.168.0.0/24
 	// 还会配置路由表 192.168.0.0/24 转发到这个 bridge 的网络接口上
 	addr := &netlink.Addr{IPNet: ipNet, Peer: ipNet, Label: "", Flags: 0, Scope: 0, Broadcast: nil}
-	return netlink.AddrAdd(ipLinkDriver, addr)
+	return nl.AddrAdd(ipLinkDriver, addr)
 }
 
 // 设置网络接口为UP状态
-func setInterfaceUP(interfaceName string) error {
+func setInterfaceUP(nl Netlink, interfaceName string) error {
 	// 查询
-	ipLinkDriver, err := netlink.LinkByName(interfaceName)
+	ipLinkDriver, err := nl.LinkByName(interfaceName)
 	if err != nil {
-		return fmt.Errorf("error retrieving a link named [ %s ]: %v", ipLinkDriver.Attrs().Name, err)
+		return fmt.Errorf("error retrieving a link named [ %s ]: %v", interfaceName, err)
 	}
 	// 启动，相当于 ip link set xxx up
-	if err := netlink.LinkSetUp(ipLinkDriver); err != nil {
+	if err := nl.LinkSetUp(ipLinkDriver); err != nil {
 		return fmt.Errorf("error enabling interface for %s: %v", interfaceName, err)
 	}
 	return nil
 }
-
-// 设置 iptables 对应 bridge 的 MASQUERADE 规则 (地址伪装，也就是SNAT)
-/*
-iptables -t nat -A POSTROUTING
-只要是从这个网桥上出来的包，都会对其做源IP的转换
-保证了容器经过宿主机访问到宿主机外部网络请求的包转换成机器的IP，从而能正确的送达和接收
-*/
-func setupIPTables(bridgeName string, subnet *net.IPNet) error {
-	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), bridgeName)
-	cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-	// err := cmd.Run()
-	output, err := cmd.Output()
-	if err != nil {
-		log.Errorf("iptables Output, %v", output)
-	}
-	return err
-}
@@ -0,0 +1,118 @@
+/*
+@Time :    2022/3/17 20:40
+@Author :  liuzhi
+@File :    hooks
+@Software: GoLand
+*/
+
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os/exec"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 生命周期中的各个 hook 点
+const (
+	HookPrestart      = "prestart"
+	HookCreateRuntime = "createRuntime"
+	HookPoststart     = "poststart"
+	HookPoststop      = "poststop"
+)
+
+// Get 返回某个 hook 点配置的 hook 列表
+func (h *Hooks) Get(name string) []Hook {
+	if h == nil {
+		return nil
+	}
+	switch name {
+	case HookPrestart:
+		return h.Prestart
+	case HookCreateRuntime:
+		return h.CreateRuntime
+	case HookPoststart:
+		return h.Poststart
+	case HookPoststop:
+		return h.Poststop
+	}
+	return nil
+}
+
+// RunHooks 按顺序执行一个 hook 点的所有 hook，任意一个失败就返回错误，后面的 hook 不再执行
+func RunHooks(hooks *Hooks, name string, state *State) error {
+	for i, h := range hooks.Get(name) {
+		if err := h.Run(state); err != nil {
+			return fmt.Errorf("%s hook #%d: %v", name, i, err)
+		}
+	}
+	return nil
+}
+
+// RunHooksWarn 执行 hook，失败只打印日志并继续执行后面的 hook，poststart 和 poststop 使用
+func RunHooksWarn(hooks *Hooks, name string, state *State) {
+	for i, h := range hooks.Get(name) {
+		if err := h.Run(state); err != nil {
+			log.Warnf("%s hook #%d: %v", name, i, err)
+		}
+	}
+}
+
+// Run 执行一个 hook，容器状态的 JSON 从标准输入传给 hook
+// args 和 env 的语义与 execve 一致，args[0] 是程序名，env 不会继承 runtime 的环境变量
+func (h Hook) Run(state *State) error {
+	if !path.IsAbs(h.Path) {
+		return fmt.Errorf("hook path %s must be absolute", h.Path)
+	}
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if h.Timeout != nil && *h.Timeout <= 0 {
+		return fmt.Errorf("hook timeout must be greater than zero")
+	}
+	cmd := exec.Command(h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	cmd.Env = h.Env
+	if cmd.Env == nil {
+		cmd.Env = []string{}
+	}
+	cmd.Stdin = bytes.NewReader(stateJson)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// hook 自己创建的子进程可能持有输出管道，超时的时候需要杀掉整个进程组
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s error: %v", h.Path, err)
+	}
+	var timedOut int32
+	if h.Timeout != nil {
+		timer := time.AfterFunc(time.Duration(*h.Timeout)*time.Second, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("%s timed out after %ds", h.Path, *h.Timeout)
+	}
+	if err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%s: %v: %s", h.Path, err, out)
+		}
+		return fmt.Errorf("%s: %v", h.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+@Time :    2022/3/15 21:00
+@Author :  liuzhi
+@File :    spec
+@Software: GoLand
+*/
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"my-container/seccomp"
+	"path"
+)
+
+// Version 支持的 runtime-spec 版本
+const Version = "1.0.2"
+
+// ConfigName bundle 中配置文件的名称
+const ConfigName = "config.json"
+
+// Spec OCI runtime-spec 的 config.json，只定义了用到的字段
+type Spec struct {
+	Version     string            `json:"ociVersion"`
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Hooks       *Hooks            `json:"hooks,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux,omitempty"`
+}
+
+// Process 容器进程
+type Process struct {
+	Terminal        bool          `json:"terminal,omitempty"`
+	User            User          `json:"user"`
+	Args            []string      `json:"args,omitempty"`
+	Env             []string      `json:"env,omitempty"`
+	Cwd             string        `json:"cwd"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	Rlimits         []Rlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool          `json:"noNewPrivileges,omitempty"`
+}
+
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type Capabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+type Rlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type Root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type Mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// Hooks 生命周期钩子
+type Hooks struct {
+	Prestart        []Hook `json:"prestart,omitempty"`
+	CreateRuntime   []Hook `json:"createRuntime,omitempty"`
+	CreateContainer []Hook `json:"createContainer,omitempty"`
+	StartContainer  []Hook `json:"startContainer,omitempty"`
+	Poststart       []Hook `json:"poststart,omitempty"`
+	Poststop        []Hook `json:"poststop,omitempty"`
+}
+
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+type Linux struct {
+	UIDMappings   []IDMapping      `json:"uidMappings,omitempty"`
+	GIDMappings   []IDMapping      `json:"gidMappings,omitempty"`
+	Resources     *Resources       `json:"resources,omitempty"`
+	CgroupsPath   string           `json:"cgroupsPath,omitempty"`
+	Namespaces    []Namespace      `json:"namespaces,omitempty"`
+	Seccomp       *seccomp.Profile `json:"seccomp,omitempty"`
+	MaskedPaths   []string         `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string         `json:"readonlyPaths,omitempty"`
+}
+
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+type Namespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type Resources struct {
+	Memory *Memory `json:"memory,omitempty"`
+	CPU    *CPU    `json:"cpu,omitempty"`
+	Pids   *Pids   `json:"pids,omitempty"`
+}
+
+type Memory struct {
+	Limit *int64 `json:"limit,omitempty"`
+	Swap  *int64 `json:"swap,omitempty"`
+}
+
+type CPU struct {
+	Shares *uint64 `json:"shares,omitempty"`
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+	Cpus   string  `json:"cpus,omitempty"`
+	Mems   string  `json:"mems,omitempty"`
+}
+
+type Pids struct {
+	Limit int64 `json:"limit"`
+}
+
+// 容器状态，runtime-spec 中定义的四种状态，paused 是和 runc 一样的扩展
+const (
+	StateCreating = "creating"
+	StateCreated  = "created"
+	StateRunning  = "running"
+	StateStopped  = "stopped"
+	StatePaused   = "paused"
+)
+
+// State runtime-spec 定义的 state 输出
+type State struct {
+	Version     string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadSpec 读取 bundle 目录下的 config.json
+func LoadSpec(bundle string) (*Spec, error) {
+	data, err := ioutil.ReadFile(path.Join(bundle, ConfigName))
+	if err != nil {
+		return nil, fmt.Errorf("read bundle config error: %v", err)
+	}
+	spec := &Spec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("decode bundle config error: %v", err)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil, fmt.Errorf("bundle config: process.args must not be empty")
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, fmt.Errorf("bundle config: root.path must not be empty")
+	}
+	// root.path 可以是相对 bundle 的路径
+	if !path.IsAbs(spec.Root.Path) {
+		spec.Root.Path = path.Join(bundle, spec.Root.Path)
+	}
+	return spec, nil
+}
@@ -0,0 +1,71 @@
+/*
+@Time :    2022/3/17 21:30
+@Author :  liuzhi
+@File :    hooks_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"my-container/oci"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookStateAndEnv(t *testing.T) {
+	out := path.Join(t.TempDir(), "out")
+	hook := oci.Hook{
+		Path: "/bin/sh",
+		Args: []string{"sh", "-c", `cat > "$OUT"`},
+		Env:  []string{"OUT=" + out},
+	}
+	state := &oci.State{Version: oci.Version, ID: "test", Status: oci.StateCreating, Pid: 1, Bundle: "/bundle"}
+	if err := hook.Run(state); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &oci.State{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "test" || got.Status != oci.StateCreating || got.Bundle != "/bundle" {
+		t.Fatalf("unexpected state on stdin: %s", data)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	timeout := 1
+	// sleep 是 sh 的子进程，也会持有输出管道
+	hook := oci.Hook{Path: "/bin/sh", Args: []string{"sh", "-c", "sleep 30; true"}, Timeout: &timeout}
+	start := time.Now()
+	err := hook.Run(&oci.State{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("hook was not killed on timeout")
+	}
+}
+
+func TestRunHooksStopsOnError(t *testing.T) {
+	out := path.Join(t.TempDir(), "out")
+	hooks := &oci.Hooks{Prestart: []oci.Hook{
+		{Path: "/bin/sh", Args: []string{"sh", "-c", "echo failed; exit 1"}},
+		{Path: "/bin/sh", Args: []string{"sh", "-c", "touch " + out}},
+	}}
+	err := oci.RunHooks(hooks, oci.HookPrestart, &oci.State{})
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("expected hook error with output, got %v", err)
+	}
+	if _, err := ioutil.ReadFile(out); err == nil {
+		t.Fatalf("hooks after a failed hook should not run")
+	}
+}
@@ -0,0 +1,265 @@
+/*
+@Time :    2022/3/8 22:30
+@Author :  liuzhi
+@File :    bpf
+@Software: GoLand
+*/
+
+package seccomp
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// 用到的 BPF 指令，参考 linux/filter.h
+const (
+	bpfLdAbs  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	bpfJeq    = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJgt    = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+	bpfJge    = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+	bpfAnd    = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	bpfRet    = unix.BPF_RET | unix.BPF_K
+	bpfMaxLen = 4096
+)
+
+// seccomp 过滤器的返回值，参考 linux/seccomp.h
+const (
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+)
+
+// struct seccomp_data 各个字段的偏移
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// 规则块内的跳转目标：条件成立继续往下执行，不成立跳到块尾(也就是下一条规则)
+const (
+	targetNext = iota
+	targetPass
+	targetFail
+)
+
+type insn struct {
+	code   uint16
+	jt, jf int
+	k      uint32
+}
+
+// Compile 把 profile 编译成 BPF 程序
+// 程序结构：先校验架构，然后每条规则编译成一个独立的块，块内任何条件不满足就跳到块尾继续匹配下一条规则，
+// 所有规则都没命中时返回默认动作
+func Compile(profile *Profile) ([]unix.SockFilter, error) {
+	if nativeArch == 0 {
+		return nil, fmt.Errorf("seccomp is not supported on this architecture")
+	}
+	if !profile.supportNativeArch() {
+		return nil, fmt.Errorf("seccomp profile does not support current architecture %v", nativeArchNames)
+	}
+	defaultRet, err := actionRet(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	prog := []unix.SockFilter{
+		// 架构不匹配(比如 x86_64 上的 32 位调用)直接杀掉进程
+		stmt(bpfLdAbs, offsetArch),
+		jump(bpfJeq, nativeArch, 1, 0),
+		stmt(bpfRet, retKillProcess),
+	}
+	if x32SyscallBit != 0 {
+		// x32 的系统调用使用相同的 arch，只是调用号带上 x32SyscallBit，不拦截的话可以绕过按调用号匹配的规则
+		prog = append(prog,
+			stmt(bpfLdAbs, offsetNr),
+			jump(bpfJge, x32SyscallBit, 0, 1),
+			stmt(bpfRet, retKillProcess),
+		)
+	}
+
+	for _, rule := range profile.Syscalls {
+		ret, err := actionRet(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.names() {
+			nr, ok := syscallTable[name]
+			if !ok {
+				// 和 docker 一样，不认识的系统调用忽略掉，兼容不同内核版本的 profile
+				continue
+			}
+			block, err := compileRule(nr, rule.Args, ret)
+			if err != nil {
+				return nil, fmt.Errorf("syscall %s: %v", name, err)
+			}
+			prog = append(prog, block...)
+		}
+	}
+	prog = append(prog, stmt(bpfRet, defaultRet))
+
+	if len(prog) > bpfMaxLen {
+		return nil, fmt.Errorf("seccomp program too long: %d instructions", len(prog))
+	}
+	return prog, nil
+}
+
+// compileRule 编译一条规则：系统调用号相等并且所有参数条件成立，则返回 ret
+func compileRule(nr uint32, args []*Arg, ret uint32) ([]unix.SockFilter, error) {
+	block := []insn{
+		{code: bpfLdAbs, k: offsetNr},
+		{code: bpfJeq, k: nr, jt: targetNext, jf: targetFail},
+	}
+	// 每个条件编译出来的指令，其中 targetPass 指向这个条件的下一条指令
+	var passAt []int
+	for _, arg := range args {
+		cond, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, cond...)
+		for range cond {
+			passAt = append(passAt, len(block))
+		}
+	}
+	block = append(block, insn{code: bpfRet, k: ret})
+
+	// 把符号跳转目标换算成相对偏移，块尾就是 len(block)
+	out := make([]unix.SockFilter, 0, len(block))
+	for i, in := range block {
+		pass := i + 1
+		if i >= 2 && i < 2+len(passAt) {
+			pass = passAt[i-2]
+		}
+		resolve := func(target int) (uint8, error) {
+			var to int
+			switch target {
+			case targetNext:
+				to = i + 1
+			case targetPass:
+				to = pass
+			case targetFail:
+				to = len(block)
+			}
+			off := to - i - 1
+			if off < 0 || off > 255 {
+				return 0, fmt.Errorf("jump offset out of range")
+			}
+			return uint8(off), nil
+		}
+		jt, err := resolve(in.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := resolve(in.jf)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, unix.SockFilter{Code: in.code, Jt: jt, Jf: jf, K: in.k})
+	}
+	return out, nil
+}
+
+// compileArg 编译 64 位参数比较，BPF 只能处理 32 位，所以先比较高 32 位再比较低 32 位
+func compileArg(arg *Arg) ([]insn, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+	}
+	// 小端序下 args[i] 的低 32 位在前
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	vHi, vLo := uint32(arg.Value>>32), uint32(arg.Value)
+
+	switch arg.Op {
+	case OpEqualTo:
+		return []insn{
+			{code: bpfLdAbs, k: hi},
+			{code: bpfJeq, k: vHi, jt: targetNext, jf: targetFail},
+			{code: bpfLdAbs, k: lo},
+			{code: bpfJeq, k: vLo, jt: targetPass, jf: targetFail},
+		}, nil
+	case OpNotEqual:
+		return []insn{
+			{code: bpfLdAbs, k: hi},
+			{code: bpfJeq, k: vHi, jt: targetNext, jf: targetPass},
+			{code: bpfLdAbs, k: lo},
+			{code: bpfJeq, k: vLo, jt: targetFail, jf: targetPass},
+		}, nil
+	case OpGreaterThan, OpGreaterEqual:
+		loCode := uint16(bpfJgt)
+		if arg.Op == OpGreaterEqual {
+			loCode = bpfJge
+		}
+		return []insn{
+			{code: bpfLdAbs, k: hi},
+			{code: bpfJgt, k: vHi, jt: targetPass, jf: targetNext},
+			{code: bpfJeq, k: vHi, jt: targetNext, jf: targetFail},
+			{code: bpfLdAbs, k: lo},
+			{code: loCode, k: vLo, jt: targetPass, jf: targetFail},
+		}, nil
+	case OpLessThan, OpLessEqual:
+		// a < b 等价于 !(a >= b)，a <= b 等价于 !(a > b)
+		loCode := uint16(bpfJge)
+		if arg.Op == OpLessEqual {
+			loCode = bpfJgt
+		}
+		return []insn{
+			{code: bpfLdAbs, k: hi},
+			{code: bpfJgt, k: vHi, jt: targetFail, jf: targetNext},
+			{code: bpfJeq, k: vHi, jt: targetNext, jf: targetPass},
+			{code: bpfLdAbs, k: lo},
+			{code: loCode, k: vLo, jt: targetFail, jf: targetPass},
+		}, nil
+	case OpMaskedEqual:
+		mHi, mLo := uint32(arg.Value>>32), uint32(arg.Value)
+		eHi, eLo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		return []insn{
+			{code: bpfLdAbs, k: hi},
+			{code: bpfAnd, k: mHi},
+			{code: bpfJeq, k: eHi, jt: targetNext, jf: targetFail},
+			{code: bpfLdAbs, k: lo},
+			{code: bpfAnd, k: mLo},
+			{code: bpfJeq, k: eLo, jt: targetPass, jf: targetFail},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", arg.Op)
+}
+
+// actionRet 把动作转换成过滤器返回值，ERRNO 默认返回 EPERM
+func actionRet(action Action, errnoRet *uint) (uint32, error) {
+	data := uint32(unix.EPERM)
+	if errnoRet != nil {
+		data = uint32(*errnoRet)
+	}
+	switch action {
+	case ActKill, ActKillThread:
+		return retKillThread, nil
+	case ActKillProcess:
+		return retKillProcess, nil
+	case ActTrap:
+		return retTrap, nil
+	case ActErrno:
+		return retErrno | (data & 0xffff), nil
+	case ActTrace:
+		return retTrace | (data & 0xffff), nil
+	case ActLog:
+		return retLog, nil
+	case ActAllow:
+		return retAllow, nil
+	}
+	return 0, fmt.Errorf("unknown seccomp action %q", action)
+}
+
+func stmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
@@ -0,0 +1,111 @@
+/*
+@Time :    2022/3/9 20:15
+@Author :  liuzhi
+@File :    default
+@Software: GoLand
+*/
+
+package seccomp
+
+import "golang.org/x/sys/unix"
+
+// 默认禁用的系统调用，参考 docker 默认 profile 中不在白名单里的调用
+// 主要是内核模块、kexec、keyring、挂载、namespace 操作、时间修改以及调试类调用
+var defaultBlocked = []string{
+	"acct",
+	"add_key",
+	"bpf",
+	"clock_adjtime",
+	"clock_settime",
+	"create_module",
+	"delete_module",
+	"finit_module",
+	"fsconfig",
+	"fsmount",
+	"fsopen",
+	"fspick",
+	"get_kernel_syms",
+	"get_mempolicy",
+	"init_module",
+	"ioperm",
+	"iopl",
+	"kcmp",
+	"kexec_file_load",
+	"kexec_load",
+	"keyctl",
+	"lookup_dcookie",
+	"mbind",
+	"mount",
+	"mount_setattr",
+	"move_mount",
+	"move_pages",
+	"name_to_handle_at",
+	"nfsservctl",
+	"open_by_handle_at",
+	"open_tree",
+	"perf_event_open",
+	"pivot_root",
+	"process_vm_readv",
+	"process_vm_writev",
+	"ptrace",
+	"query_module",
+	"quotactl",
+	"reboot",
+	"request_key",
+	"set_mempolicy",
+	"setns",
+	"settimeofday",
+	"stime",
+	"swapoff",
+	"swapon",
+	"_sysctl",
+	"sysfs",
+	"umount",
+	"umount2",
+	"unshare",
+	"uselib",
+	"userfaultfd",
+	"ustat",
+	"vm86",
+	"vm86old",
+}
+
+// clone 的 flags 参数位置，支持的架构上都是第一个参数
+const cloneFlagsArgIndex = 0
+
+// clone 创建新 namespace 的标记，容器内不允许再创建 namespace (比如在 user namespace 里绕过限制再 mount)
+var defaultBlockedCloneFlags = []uint64{
+	unix.CLONE_NEWNS,
+	unix.CLONE_NEWUTS,
+	unix.CLONE_NEWIPC,
+	unix.CLONE_NEWUSER,
+	unix.CLONE_NEWPID,
+	unix.CLONE_NEWNET,
+	unix.CLONE_NEWCGROUP,
+}
+
+// DefaultProfile 内置的默认 profile，默认放行，命中黑名单返回 EPERM
+func DefaultProfile() *Profile {
+	profile := &Profile{
+		DefaultAction: ActAllow,
+		Architectures: nativeArchNames,
+		Syscalls: []*Syscall{
+			{Names: defaultBlocked, Action: ActErrno},
+			// clone3 的参数是结构体指针，BPF 没法检查，返回 ENOSYS 让 libc 回退到 clone
+			{Name: "clone3", Action: ActErrno, ErrnoRet: errnoRet(unix.ENOSYS)},
+		},
+	}
+	for _, flag := range defaultBlockedCloneFlags {
+		profile.Syscalls = append(profile.Syscalls, &Syscall{
+			Name:   "clone",
+			Action: ActErrno,
+			Args:   []*Arg{{Index: cloneFlagsArgIndex, Value: flag, ValueTwo: flag, Op: OpMaskedEqual}},
+		})
+	}
+	return profile
+}
+
+func errnoRet(errno unix.Errno) *uint {
+	ret := uint(errno)
+	return &ret
+}
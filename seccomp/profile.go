@@ -0,0 +1,123 @@
+/*
+@Time :    2022/3/8 21:10
+@Author :  liuzhi
+@File :    profile
+@Software: GoLand
+*/
+
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Action 命中规则后的动作，取值和 docker/OCI 的 seccomp profile 保持一致
+type Action string
+
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+	ActLog         Action = "SCMP_ACT_LOG"
+)
+
+// Operator 参数比较操作符
+type Operator string
+
+const (
+	OpNotEqual     Operator = "SCMP_CMP_NE"
+	OpLessThan     Operator = "SCMP_CMP_LT"
+	OpLessEqual    Operator = "SCMP_CMP_LE"
+	OpEqualTo      Operator = "SCMP_CMP_EQ"
+	OpGreaterEqual Operator = "SCMP_CMP_GE"
+	OpGreaterThan  Operator = "SCMP_CMP_GT"
+	OpMaskedEqual  Operator = "SCMP_CMP_MASKED_EQ"
+)
+
+// Profile seccomp 配置文件，也就是 --security-opt seccomp=profile.json 指定的内容
+type Profile struct {
+	DefaultAction   Action     `json:"defaultAction"`
+	DefaultErrnoRet *uint      `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string   `json:"architectures,omitempty"`
+	ArchMap         []Arch     `json:"archMap,omitempty"`
+	Syscalls        []*Syscall `json:"syscalls"`
+}
+
+// Arch docker 格式中的 archMap 项
+type Arch struct {
+	Arch      string   `json:"architecture"`
+	SubArches []string `json:"subArchitectures"`
+}
+
+// Syscall 一条系统调用规则，Name 是旧格式，Names 是新格式，两者都支持
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []*Arg   `json:"args,omitempty"`
+}
+
+// Arg 系统调用参数条件，同一条规则中的多个条件是"与"的关系
+// MASKED_EQ 的语义和 libseccomp 一致：(arg & Value) == ValueTwo
+type Arg struct {
+	Index    uint     `json:"index"`
+	Value    uint64   `json:"value"`
+	ValueTwo uint64   `json:"valueTwo"`
+	Op       Operator `json:"op"`
+}
+
+// LoadProfile 从文件读取 seccomp profile
+func LoadProfile(profilePath string) (*Profile, error) {
+	data, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		return nil, fmt.Errorf("read seccomp profile %s error: %v", profilePath, err)
+	}
+	return ParseProfile(data)
+}
+
+// ParseProfile 解析 json 格式的 seccomp profile
+func ParseProfile(data []byte) (*Profile, error) {
+	profile := &Profile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("decode seccomp profile error: %v", err)
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("seccomp profile missing defaultAction")
+	}
+	return profile, nil
+}
+
+// names 返回规则涉及的全部系统调用名
+func (s *Syscall) names() []string {
+	if s.Name == "" {
+		return s.Names
+	}
+	return append([]string{s.Name}, s.Names...)
+}
+
+// supportNativeArch 判断 profile 声明的架构里是否包含当前架构，没有声明架构则视为包含
+func (p *Profile) supportNativeArch() bool {
+	arches := append([]string{}, p.Architectures...)
+	for _, a := range p.ArchMap {
+		arches = append(arches, a.Arch)
+		arches = append(arches, a.SubArches...)
+	}
+	if len(arches) == 0 {
+		return true
+	}
+	for _, a := range arches {
+		for _, n := range nativeArchNames {
+			if a == n {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+/*
+@Time :    2022/3/8 23:05
+@Author :  liuzhi
+@File :    seccomp
+@Software: GoLand
+*/
+
+package seccomp
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// InitSeccomp 编译并在当前线程上安装 seccomp 过滤器
+// 调用方需要先 runtime.LockOSThread，并且在同一个线程上紧接着执行 exec，过滤器会被 exec 后的进程继承
+func InitSeccomp(profile *Profile) error {
+	if profile == nil {
+		return nil
+	}
+	filter, err := Compile(profile)
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	// 相当于 prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, &prog)
+	// 没有设置 no_new_privs 时需要 CAP_SYS_ADMIN，容器的 init 进程是 root，满足条件
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("install seccomp filter error: %v", err)
+	}
+	return nil
+}
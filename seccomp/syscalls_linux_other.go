@@ -0,0 +1,20 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+/*
+@Time :    2022/3/8 21:40
+@Author :  liuzhi
+@File :    syscalls_linux_other
+@Software: GoLand
+*/
+
+package seccomp
+
+// 暂不支持的架构，Compile 时会直接报错
+const nativeArch = 0
+
+const x32SyscallBit = 0
+
+var nativeArchNames []string
+
+var syscallTable = map[string]uint32{}
@@ -0,0 +1,143 @@
+/*
+@Time :    2022/3/9 22:10
+@Author :  liuzhi
+@File :    bpf_test
+@Software: GoLand
+*/
+
+package test
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"my-container/seccomp"
+	"runtime"
+	"testing"
+)
+
+const (
+	retKill  = 0x80000000
+	retAllow = 0x7fff0000
+	retEperm = 0x00050000 | uint32(unix.EPERM)
+)
+
+// run 一个简化的 BPF 解释器，只实现了 Compile 会生成的指令
+func run(t *testing.T, prog []unix.SockFilter, nr uint32, args ...uint64) uint32 {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data[0:], nr)
+	binary.LittleEndian.PutUint32(data[4:], nativeArch())
+	for i, a := range args {
+		binary.LittleEndian.PutUint64(data[16+8*i:], a)
+	}
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		switch in.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[in.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= in.K
+		case unix.BPF_RET | unix.BPF_K:
+			return in.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K,
+			unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K,
+			unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var ok bool
+			switch in.Code &^ (unix.BPF_JMP | unix.BPF_K) {
+			case unix.BPF_JEQ:
+				ok = acc == in.K
+			case unix.BPF_JGT:
+				ok = acc > in.K
+			case unix.BPF_JGE:
+				ok = acc >= in.K
+			}
+			if ok {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		default:
+			t.Fatalf("unexpected instruction %#x", in.Code)
+		}
+	}
+	t.Fatal("program fell off the end")
+	return 0
+}
+
+func nativeArch() uint32 {
+	// 测试只在 amd64/arm64 上运行，取架构校验指令里的常量
+	prog, _ := seccomp.Compile(&seccomp.Profile{DefaultAction: seccomp.ActAllow})
+	return prog[1].K
+}
+
+func TestDefaultProfile(t *testing.T) {
+	prog, err := seccomp.Compile(seccomp.DefaultProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := run(t, prog, unix.SYS_GETPID); ret != retAllow {
+		t.Errorf("getpid: got %#x", ret)
+	}
+	if ret := run(t, prog, unix.SYS_KEXEC_LOAD); ret != retEperm {
+		t.Errorf("kexec_load: got %#x", ret)
+	}
+	if ret := run(t, prog, unix.SYS_CLONE, uint64(unix.SIGCHLD)); ret != retAllow {
+		t.Errorf("clone: got %#x", ret)
+	}
+	if ret := run(t, prog, unix.SYS_CLONE, unix.CLONE_NEWUSER|uint64(unix.SIGCHLD)); ret != retEperm {
+		t.Errorf("clone(CLONE_NEWUSER): got %#x", ret)
+	}
+}
+
+// TestX32Syscall amd64 上 x32 的调用号和 x86_64 共用 arch，必须单独拦截，否则可以绕过 kexec_load 等规则
+func TestX32Syscall(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("x32 ABI only exists on amd64")
+	}
+	prog, err := seccomp.Compile(seccomp.DefaultProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nr := range []uint32{unix.SYS_KEXEC_LOAD, unix.SYS_MOUNT, unix.SYS_GETPID} {
+		if ret := run(t, prog, nr|0x40000000); ret != retKill {
+			t.Errorf("x32 syscall %d: got %#x", nr, ret)
+		}
+	}
+}
+
+func TestArgCompare(t *testing.T) {
+	profile, err := seccomp.ParseProfile([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"syscalls": [
+			{"names": ["read"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 3, "op": "SCMP_CMP_LT"}]},
+			{"names": ["write"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 1, "value": 4294967296, "op": "SCMP_CMP_GE"}]},
+			{"names": ["close"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 7, "op": "SCMP_CMP_NE"}]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := seccomp.Compile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		nr   uint32
+		args []uint64
+		want uint32
+	}{
+		{unix.SYS_READ, []uint64{2}, retAllow},
+		{unix.SYS_READ, []uint64{3}, retEperm},
+		{unix.SYS_READ, []uint64{1 << 32}, retEperm},
+		{unix.SYS_WRITE, []uint64{0, 1 << 32}, retAllow},
+		{unix.SYS_WRITE, []uint64{0, 1<<32 - 1}, retEperm},
+		{unix.SYS_CLOSE, []uint64{7}, retEperm},
+		{unix.SYS_CLOSE, []uint64{7 | 1<<32}, retAllow},
+		{unix.SYS_GETPID, nil, retEperm},
+	}
+	for _, c := range cases {
+		if got := run(t, prog, c.nr, c.args...); got != c.want {
+			t.Errorf("nr %d args %v: got %#x want %#x", c.nr, c.args, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+@Time :    2022/3/21 22:00
+@Author :  liuzhi
+@File :    cp
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"io"
+	"my-container/archive"
+	"my-container/container"
+	"my-container/oci"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// copyEndpoint cp 命令的一端，container 为空表示宿主机
+type copyEndpoint struct {
+	container string
+	path      string
+}
+
+// parseCopyEndpoint 解析 <container>:<path>，不带容器名或者以 / . 开头的路径都视为宿主机路径
+func parseCopyEndpoint(arg string) copyEndpoint {
+	if arg == "-" || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return copyEndpoint{path: arg}
+	}
+	if i := strings.Index(arg, ":"); i > 0 {
+		return copyEndpoint{container: arg[:i], path: arg[i+1:]}
+	}
+	return copyEndpoint{path: arg}
+}
+
+// copyFiles 在宿主机和容器之间复制文件，两端不能都是容器
+// "-" 表示从标准输入读取 tar 流或者把 tar 流写到标准输出
+func copyFiles(srcArg, dstArg string) error {
+	src, dst := parseCopyEndpoint(srcArg), parseCopyEndpoint(dstArg)
+	if src.container != "" && dst.container != "" {
+		return fmt.Errorf("copying between containers is not supported")
+	}
+	if src.container == "" && dst.container == "" {
+		return fmt.Errorf("must specify at least one container source")
+	}
+
+	srcRoot, srcPath, srcMap, err := resolveCopyEndpoint(src)
+	if err != nil {
+		return err
+	}
+	dstRoot, dstPath, dstMap, err := resolveCopyEndpoint(dst)
+	if err != nil {
+		return err
+	}
+
+	if src.path == "-" {
+		// 标准输入的 tar 流只能解压到已经存在的目录中
+		dir, err := archive.SecureJoin(dstRoot, dstPath)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("destination %s must be an existing directory", dst.path)
+		}
+		return archive.Untar(os.Stdin, dstRoot, dstPath, dstMap)
+	}
+
+	copyContents := strings.HasSuffix(src.path, "/.")
+	srcClean := filepath.Clean("/" + srcPath)
+	// srcFull 只用来判断源的类型，打包时 Tar 在 srcRoot 中重新逐级打开，不按这个路径读取
+	// /proc/<pid>/root 本身是软链接，末尾加上 / 让 Lstat 跟随
+	srcFull := srcRoot + "/"
+	if srcClean == "/" {
+		copyContents = true
+	} else if srcFull, err = archive.SecureParent(srcRoot, srcClean); err != nil {
+		return err
+	}
+	srcInfo, err := os.Lstat(srcFull)
+	if err != nil {
+		return fmt.Errorf("no such file or directory: %s", src.path)
+	}
+	if copyContents && !srcInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", src.path)
+	}
+
+	if dst.path == "-" {
+		name := filepath.Base(srcClean)
+		if copyContents {
+			name = ""
+		}
+		return archive.Tar(os.Stdout, srcRoot, srcClean, name, srcMap)
+	}
+	destDir, name, err := copyDestination(dstRoot, dstPath, dst.path, srcInfo.IsDir())
+	if err != nil {
+		return err
+	}
+	if name == "" && !copyContents {
+		name = filepath.Base(srcClean)
+	}
+
+	// 打包和解压通过管道流式进行，不需要临时文件
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.Tar(writer, srcRoot, srcClean, name, srcMap))
+	}()
+	err = archive.Untar(reader, dstRoot, destDir, dstMap)
+	_ = reader.CloseWithError(err)
+	return err
+}
+
+// copyDestination 和 docker cp 一样确定解压的目录和名称
+// 目标是已经存在的目录时复制到目录中，name 返回空表示沿用源的名称或者只复制目录中的内容
+// 目标不存在时以目标路径的最后一级作为新的名称
+func copyDestination(root, dstPath, display string, srcIsDir bool) (string, string, error) {
+	full, err := archive.SecureJoin(root, dstPath)
+	if err != nil {
+		return "", "", err
+	}
+	fi, err := os.Stat(full)
+	switch {
+	case err == nil && fi.IsDir():
+		return dstPath, "", nil
+	case err == nil && srcIsDir:
+		return "", "", fmt.Errorf("cannot copy a directory to file %s", display)
+	case err != nil && !os.IsNotExist(err):
+		return "", "", err
+	case err != nil && strings.HasSuffix(display, "/") && !srcIsDir:
+		return "", "", fmt.Errorf("destination directory %s does not exist", display)
+	}
+	parent, err := archive.SecureJoin(root, filepath.Dir(dstPath))
+	if err != nil {
+		return "", "", err
+	}
+	if pfi, err := os.Stat(parent); err != nil || !pfi.IsDir() {
+		return "", "", fmt.Errorf("destination directory %s does not exist", filepath.Dir(display))
+	}
+	return filepath.Dir(dstPath), filepath.Base(dstPath), nil
+}
+
+// resolveCopyEndpoint 返回文件系统的根目录、相对于根目录的路径和 id 映射
+// 宿主机的根目录是 /，运行中的容器通过 /proc/<pid>/root 访问，这样容器中的挂载也能看到
+// 停止的容器使用 rootfs 目录，没有单独 rootfs 的容器和宿主机共享根目录
+func resolveCopyEndpoint(ep copyEndpoint) (string, string, *archive.IDMap, error) {
+	if ep.container == "" {
+		if ep.path == "-" {
+			return "/", "", nil, nil
+		}
+		abs, err := filepath.Abs(ep.path)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return "/", abs, nil, nil
+	}
+	info, err := container.GetContainerInfo(ep.container)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if err := checkNotPaused(info); err != nil {
+		return "", "", nil, err
+	}
+	var idMap *archive.IDMap
+	root := "/"
+	if info.Bundle != "" {
+		spec, err := oci.LoadSpec(info.Bundle)
+		if err != nil {
+			return "", "", nil, err
+		}
+		root = spec.Root.Path
+		if spec.Linux != nil && len(spec.Linux.UIDMappings) > 0 {
+			idMap = &archive.IDMap{
+				UIDs: toArchiveMappings(spec.Linux.UIDMappings),
+				GIDs: toArchiveMappings(spec.Linux.GIDMappings),
+			}
+		}
+	} else if conf, err := container.LoadInitConfig(info.Id); err == nil && conf.Rootfs != "" {
+		root = conf.Rootfs
+	}
+	if pid, _ := strconv.Atoi(info.Pid); container.ProcessAlive(pid) {
+		root = fmt.Sprintf("/proc/%d/root", pid)
+	}
+	return root, ep.path, idMap, nil
+}
+
+func toArchiveMappings(mappings []oci.IDMapping) []archive.IDMapping {
+	var result []archive.IDMapping
+	for _, m := range mappings {
+		result = append(result, archive.IDMapping{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+	}
+	return result
+}
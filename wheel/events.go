@@ -0,0 +1,54 @@
+/*
+@Time :    2022/3/23 21:10
+@Author :  liuzhi
+@File :    events
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"my-container/container"
+	"my-container/events"
+	"time"
+)
+
+// publishContainerEvent 发布容器事件，附带容器的标签、容器名和额外的属性，events 可以按标签过滤
+func publishContainerEvent(info *container.ContainerInfo, action string, attributes map[string]string) {
+	attrs := map[string]string{}
+	for k, v := range info.Labels {
+		attrs[k] = v
+	}
+	attrs["name"] = info.Name
+	for k, v := range attributes {
+		attrs[k] = v
+	}
+	events.Publish(events.ContainerEvent, action, info.Id, attrs)
+}
+
+// streamEvents 输出 [since, until] 范围内的事件，每行一个 json，没有指定 until 时持续跟踪新事件
+func streamEvents(since, until string, filters []string) error {
+	now := time.Now()
+	sinceTime, err := events.ParseTime(since, now)
+	if err != nil {
+		return err
+	}
+	untilTime, err := events.ParseTime(until, now)
+	if err != nil {
+		return err
+	}
+	filter, err := events.ParseFilter(filters)
+	if err != nil {
+		return err
+	}
+	return events.Subscribe(sinceTime, untilTime, filter, untilTime.IsZero(), func(ev *events.Event) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	})
+}
@@ -0,0 +1,50 @@
+/*
+@Time :    2022/3/14 21:00
+@Author :  liuzhi
+@File :    health
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	log "github.com/sirupsen/logrus"
+	"my-container/container"
+	"time"
+)
+
+// monitorHealth 按照配置周期性地在容器中执行检查命令，直到 done 关闭
+// 容器变为不健康并且配置了 RestartOnUnhealthy 时调用 onUnhealthy 并退出
+func monitorHealth(id string, pid string, hc *container.HealthConfig, done <-chan struct{}, onUnhealthy func()) {
+	startedAt := time.Now()
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		// 暂停中的容器无法执行检查命令，跳过这一轮
+		if info, err := container.GetContainerInfo(id); err == nil && info.Status == container.Paused {
+			continue
+		}
+		result := container.RunHealthCommand(container.ExecCommand(pid, hc.Test), hc.Timeout)
+		inStartPeriod := time.Since(startedAt) < hc.StartPeriod
+		info, err := container.UpdateContainerInfo(id, func(info *container.ContainerInfo) {
+			if info.Health == nil {
+				info.Health = &container.HealthState{Status: container.HealthStarting}
+			}
+			info.Health.AddResult(result, hc.Retries, inStartPeriod)
+		})
+		if err != nil {
+			log.Errorf("update container %s health error %v", id, err)
+			continue
+		}
+		if info.Health.Status == container.HealthUnhealthy && hc.RestartOnUnhealthy {
+			log.Infof("container %s is unhealthy, restart it", id)
+			onUnhealthy()
+			return
+		}
+	}
+}
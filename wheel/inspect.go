@@ -0,0 +1,291 @@
+/*
+@Time :    2022/3/22 20:50
+@Author :  liuzhi
+@File :    inspect
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"my-container/cgroups"
+	"my-container/container"
+	"my-container/format"
+	"my-container/network"
+	"my-container/oci"
+	"net"
+	"os"
+	"strconv"
+)
+
+// inspect 支持的对象类型
+const (
+	inspectContainerType = "container"
+	inspectNetworkType   = "network"
+	inspectVolumeType    = "volume"
+	inspectImageType     = "image"
+)
+
+// containerInspect inspect 容器时输出的内容，字段名和 docker inspect 保持一致，方便编写 --format 模板
+type containerInspect struct {
+	Id              string
+	Name            string
+	Created         string
+	Path            string
+	Args            []string
+	State           containerState
+	RestartCount    int
+	Bundle          string `json:",omitempty"`
+	Config          containerConfig
+	HostConfig      hostConfig
+	Mounts          []container.Mount
+	NetworkSettings networkSettings
+}
+
+type containerState struct {
+	Status     string
+	Running    bool
+	Paused     bool
+	Restarting bool
+	Pid        int
+	ExitCode   int
+	Health     *container.HealthState `json:",omitempty"`
+}
+
+type containerConfig struct {
+	Hostname    string
+	Env         []string
+	WorkingDir  string
+	User        *container.User
+	Healthcheck *container.HealthConfig `json:",omitempty"`
+}
+
+type hostConfig struct {
+	RestartPolicy   container.RestartPolicy
+	ReadonlyRootfs  bool
+	Capabilities    *container.Capabilities
+	NoNewPrivileges bool
+	MaskedPaths     []string
+	ReadonlyPaths   []string
+	Tmpfs           map[string]string
+	PortBindings    []string
+	CgroupPath      string
+	Resources       *cgroups.Resources
+}
+
+// networkSettings 第一个网络的地址同时放在顶层，和 docker 一样可以直接使用 {{.NetworkSettings.IPAddress}}
+type networkSettings struct {
+	IPAddress  string
+	MacAddress string
+	Gateway    string
+	Ports      []string
+	Networks   map[string]*endpointSettings
+}
+
+type endpointSettings struct {
+	EndpointID  string
+	IPAddress   string
+	IPPrefixLen int
+	MacAddress  string
+	Gateway     string
+}
+
+// networkInspect inspect 网络时输出的内容
+type networkInspect struct {
+	Name       string
+	Driver     string
+	Scope      string
+	EnableIPv6 bool
+	Subnet     string
+	Gateway    string
+	Labels     map[string]string
+	Options    map[string]string
+	Containers map[string]*networkContainer
+}
+
+// networkContainer 连接到网络的容器，key 是容器 ID
+type networkContainer struct {
+	Name        string
+	EndpointID  string
+	MacAddress  string
+	IPv4Address string
+}
+
+// inspectObjects 依次查找每个名称对应的对象，没有指定类型时先找容器再找网络
+// 没有指定模板时把所有对象作为一个 json 数组输出
+func inspectObjects(names []string, objectType, tmpl string) error {
+	switch objectType {
+	case "", inspectContainerType, inspectNetworkType:
+	case inspectVolumeType, inspectImageType:
+		return fmt.Errorf("%s objects are not managed by this runtime", objectType)
+	default:
+		return fmt.Errorf("unknown object type: %s", objectType)
+	}
+	var objects []interface{}
+	for _, name := range names {
+		obj, err := inspectObject(name, objectType)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, obj)
+	}
+	if tmpl == "" {
+		return format.Object(os.Stdout, "", objects)
+	}
+	for _, obj := range objects {
+		if err := format.Object(os.Stdout, tmpl, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inspectObject(name, objectType string) (interface{}, error) {
+	if objectType == "" || objectType == inspectContainerType {
+		info, err := container.GetContainerInfo(name)
+		if err == nil {
+			return newContainerInspect(info), nil
+		}
+		if objectType == inspectContainerType {
+			return nil, err
+		}
+	}
+	if err := network.Init(); err != nil {
+		return nil, err
+	}
+	nw, err := network.GetNetwork(name)
+	if err != nil {
+		return nil, fmt.Errorf("no such object: %s", name)
+	}
+	return newNetworkInspect(nw), nil
+}
+
+// newContainerInspect 汇总容器信息、init 配置和 cgroup 中的资源限制
+func newContainerInspect(info *container.ContainerInfo) *containerInspect {
+	pid, _ := strconv.Atoi(info.Pid)
+	alive := container.ProcessAlive(pid)
+	c := &containerInspect{
+		Id:           info.Id,
+		Name:         info.Name,
+		Created:      info.CreatedTime,
+		Path:         info.Command,
+		RestartCount: info.RestartCount,
+		Bundle:       info.Bundle,
+		State: containerState{
+			Status:     info.Status,
+			Running:    alive && (info.Status == container.Running || info.Status == container.Paused),
+			Paused:     alive && info.Status == container.Paused,
+			Restarting: info.Status == container.Restarting,
+			ExitCode:   info.ExitCode,
+			Health:     info.Health,
+		},
+		Config: containerConfig{Healthcheck: info.Healthcheck},
+		HostConfig: hostConfig{
+			RestartPolicy: info.RestartPolicy,
+			PortBindings:  info.PortMapping,
+			CgroupPath:    info.CgroupPath,
+		},
+		NetworkSettings: networkSettings{
+			Ports:    info.PortMapping,
+			Networks: map[string]*endpointSettings{},
+		},
+	}
+	if alive {
+		c.State.Pid = pid
+	}
+
+	// run 命令创建的容器保存了 init 配置，oci 命令创建的容器从 bundle 中转换
+	conf, err := container.LoadInitConfig(info.Id)
+	if err != nil && info.Bundle != "" {
+		if spec, specErr := oci.LoadSpec(info.Bundle); specErr == nil {
+			conf, _, err = specToInitConfig(spec)
+		}
+	}
+	if err == nil {
+		c.Args = conf.Args
+		c.Config.Hostname = conf.Hostname
+		c.Config.Env = conf.Env
+		c.Config.WorkingDir = conf.Cwd
+		c.Config.User = conf.User
+		c.HostConfig.ReadonlyRootfs = conf.ReadonlyRootfs
+		c.HostConfig.Capabilities = conf.Capabilities
+		c.HostConfig.NoNewPrivileges = conf.NoNewPrivileges
+		c.HostConfig.MaskedPaths = conf.MaskedPaths
+		c.HostConfig.ReadonlyPaths = conf.ReadonlyPaths
+		c.HostConfig.Tmpfs = conf.Tmpfs
+		c.Mounts = conf.Mounts
+	}
+
+	if info.CgroupPath != "" {
+		if m := cgroups.NewManager(info.CgroupPath); m.Exists() {
+			c.HostConfig.Resources, _ = m.GetResources()
+		}
+	}
+	fillNetworkSettings(&c.NetworkSettings, info)
+	return c
+}
+
+// fillNetworkSettings 从保存的端点中读取容器在每个网络上的地址，按照连接的顺序第一个网络的地址放在顶层
+func fillNetworkSettings(settings *networkSettings, info *container.ContainerInfo) {
+	if len(info.Networks) == 0 {
+		return
+	}
+	if err := network.Init(); err != nil {
+		return
+	}
+	endpoints, err := network.ListEndpoints()
+	if err != nil {
+		return
+	}
+	for _, ep := range endpoints {
+		if ep.ContainerID != info.Id || ep.Network == nil {
+			continue
+		}
+		prefixLen, _ := ep.Network.IpRange.Mask.Size()
+		settings.Networks[ep.NetworkName] = &endpointSettings{
+			EndpointID:  ep.ID,
+			IPAddress:   ep.IPAddress.String(),
+			IPPrefixLen: prefixLen,
+			MacAddress:  ep.MacAddress.String(),
+			Gateway:     ep.Network.IpRange.IP.String(),
+		}
+	}
+	for _, name := range info.Networks {
+		if ep, ok := settings.Networks[name]; ok {
+			settings.IPAddress = ep.IPAddress
+			settings.MacAddress = ep.MacAddress
+			settings.Gateway = ep.Gateway
+			break
+		}
+	}
+}
+
+func newNetworkInspect(nw *network.Network) *networkInspect {
+	n := &networkInspect{Name: nw.Name, Driver: nw.Driver, Labels: nw.Labels, Options: nw.Options, Containers: map[string]*networkContainer{}}
+	if d, err := network.GetDriver(nw.Driver); err == nil {
+		n.Scope = d.Capability().Scope
+	}
+	if nw.IpRange != nil {
+		// IpRange 中的 IP 是网关地址
+		n.Gateway = nw.IpRange.IP.String()
+		subnet := net.IPNet{IP: nw.IpRange.IP.Mask(nw.IpRange.Mask), Mask: nw.IpRange.Mask}
+		n.Subnet = subnet.String()
+		n.EnableIPv6 = nw.IpRange.IP.To4() == nil
+	}
+	endpoints, _ := network.ListEndpoints()
+	for _, ep := range endpoints {
+		if ep.NetworkName != nw.Name {
+			continue
+		}
+		c := &networkContainer{EndpointID: ep.ID, MacAddress: ep.MacAddress.String()}
+		if info, err := container.GetContainerInfo(ep.ContainerID); err == nil {
+			c.Name = info.Name
+		}
+		if nw.IpRange != nil {
+			c.IPv4Address = (&net.IPNet{IP: ep.IPAddress, Mask: nw.IpRange.Mask}).String()
+		}
+		n.Containers[ep.ContainerID] = c
+	}
+	return n
+}
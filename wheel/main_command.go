@@ -12,6 +12,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"my-container/container"
+	"my-container/network"
+	"strings"
+	"time"
 )
 
 var RunCommand = cli.Command{
@@ -22,6 +25,82 @@ var RunCommand = cli.Command{
 			Name:  "ti",
 			Usage: "enable tty(类型docker的 -ti)",
 		},
+		cli.BoolFlag{
+			Name:  "d",
+			Usage: "detach container",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "container name",
+		},
+		cli.StringFlag{
+			Name:  "restart",
+			Usage: "restart policy: no, on-failure[:max-retries], always, unless-stopped",
+			Value: "no",
+		},
+		cli.StringFlag{
+			Name:  "health-cmd",
+			Usage: "command to run to check health",
+		},
+		cli.DurationFlag{
+			Name:  "health-interval",
+			Usage: "time between running the check",
+			Value: 30 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "health-timeout",
+			Usage: "maximum time to allow one check to run",
+			Value: 30 * time.Second,
+		},
+		cli.IntFlag{
+			Name:  "health-retries",
+			Usage: "consecutive failures needed to report unhealthy",
+			Value: 3,
+		},
+		cli.DurationFlag{
+			Name:  "health-start-period",
+			Usage: "start period for the container to initialize before counting retries",
+		},
+		cli.BoolFlag{
+			Name:  "health-restart",
+			Usage: "restart the container when it becomes unhealthy",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-opt",
+			Usage: "security options, e.g. seccomp=profile.json, seccomp=unconfined, no-new-privileges=false, landlock=policy.json, systempaths=unconfined, unmask=/proc/sys",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "add Linux capabilities, e.g. --cap-add NET_ADMIN",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "drop Linux capabilities, e.g. --cap-drop ALL",
+		},
+		cli.BoolFlag{
+			Name:  "privileged",
+			Usage: "give extended privileges to this container",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "mount the container's root filesystem as read only, volumes and tmpfs mounts stay writable",
+		},
+		cli.StringSliceFlag{
+			Name:  "tmpfs",
+			Usage: "mount a tmpfs on an existing directory, e.g. --tmpfs /mnt:size=64m,noexec",
+		},
+		cli.StringSliceFlag{
+			Name:  "label, l",
+			Usage: "set metadata on a container, e.g. --label env=prod",
+		},
+		cli.StringFlag{
+			Name:  "net",
+			Usage: "connect the container to a network created by network create",
+		},
+		cli.StringSliceFlag{
+			Name:  "p",
+			Usage: "publish a container's port to the host, e.g. -p 8080:80 or -p 53:53/udp, requires --net",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		if len(ctx.Args()) < 1 {
@@ -29,10 +108,71 @@ var RunCommand = cli.Command{
 		}
 		cmd := ctx.Args().Get(0)
 		tty := ctx.Bool("ti")
+		detach := ctx.Bool("d")
+		if tty && detach {
+			return fmt.Errorf("ti and d parameter can not both provided")
+		}
+		restartPolicy, err := container.ParseRestartPolicy(ctx.String("restart"))
+		if err != nil {
+			return err
+		}
+		labels, err := container.ParseLabels(ctx.StringSlice("label"))
+		if err != nil {
+			return err
+		}
+		info := &container.ContainerInfo{
+			Name:          ctx.String("name"),
+			Command:       cmd,
+			RestartPolicy: restartPolicy,
+			Labels:        labels,
+		}
+		if info.PortMapping, err = parsePortMappings(ctx.StringSlice("p")); err != nil {
+			return err
+		}
+		if netName := ctx.String("net"); netName != "" {
+			// 提前检查网络是否存在，容器启动之后才真正连接
+			if err := network.Init(); err != nil {
+				return err
+			}
+			if _, err := network.GetNetwork(netName); err != nil {
+				return err
+			}
+			if err := network.CheckPortMappings(info.Id, info.PortMapping); err != nil {
+				return err
+			}
+			info.Networks = []string{netName}
+		} else if len(info.PortMapping) > 0 {
+			return fmt.Errorf("port mapping requires a network, use --net")
+		}
+		if healthCmd := ctx.String("health-cmd"); healthCmd != "" {
+			if ctx.Duration("health-interval") <= 0 || ctx.Duration("health-timeout") <= 0 || ctx.Int("health-retries") <= 0 {
+				return fmt.Errorf("health-interval, health-timeout and health-retries must be positive")
+			}
+			info.Healthcheck = &container.HealthConfig{
+				Test:               healthCmd,
+				Interval:           ctx.Duration("health-interval"),
+				Timeout:            ctx.Duration("health-timeout"),
+				Retries:            ctx.Int("health-retries"),
+				StartPeriod:        ctx.Duration("health-start-period"),
+				RestartOnUnhealthy: ctx.Bool("health-restart"),
+			}
+		}
+		privileged := ctx.Bool("privileged")
+		conf := &container.InitConfig{}
+		if err := parseSecurityOpts(ctx.StringSlice("security-opt"), privileged, conf); err != nil {
+			return err
+		}
+		caps, err := container.TweakCapabilities(ctx.StringSlice("cap-add"), ctx.StringSlice("cap-drop"), privileged)
+		if err != nil {
+			return err
+		}
+		conf.Capabilities = container.NewCapabilities(caps)
+		if err := parseTmpfs(ctx.StringSlice("tmpfs"), ctx.Bool("read-only"), conf); err != nil {
+			return err
+		}
 		// 准备启动容器
 		log.Info("参数校验ok，准备运行container")
-		Run(tty, cmd)
-		return nil
+		return Run(tty, detach, info, conf)
 	},
 }
 
@@ -47,3 +187,449 @@ var InitCommand = cli.Command{
 		return err
 	},
 }
+
+var ShimCommand = cli.Command{
+	Name:  "shim",
+	Usage: "Supervise a detached container, used by run -d",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		id := ctx.Args().Get(0)
+		conf, err := container.LoadInitConfig(id)
+		if err != nil {
+			return err
+		}
+		superviseContainer(id, false, conf)
+		return nil
+	},
+}
+
+var StopCommand = cli.Command{
+	Name:  "stop",
+	Usage: "Stop a container",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "t",
+			Usage: "seconds to wait for stop before killing it",
+			Value: 10,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		for _, nameOrId := range ctx.Args() {
+			if err := stopContainer(nameOrId, time.Duration(ctx.Int("t"))*time.Second); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var PauseCommand = cli.Command{
+	Name:  "pause",
+	Usage: "Pause all processes within a container",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		for _, nameOrId := range ctx.Args() {
+			if err := pauseContainer(nameOrId); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var UnpauseCommand = cli.Command{
+	Name:  "unpause",
+	Usage: "Unpause all processes within a container",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		for _, nameOrId := range ctx.Args() {
+			if err := unpauseContainer(nameOrId); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var ListCommand = cli.Command{
+	Name:  "ps",
+	Usage: "List all the containers",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format the output using a Go template, e.g. 'table {{.ID}}\\t{{.Name}}', or json",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "only display container IDs",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter, f",
+			Usage: "filter output based on conditions provided, e.g. label=k=v, status=running, name=web, network=br0",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return ListContainers(ctx.String("format"), ctx.Bool("quiet"), ctx.StringSlice("filter"))
+	},
+}
+
+var RemoveCommand = cli.Command{
+	Name:      "rm",
+	Usage:     "Remove one or more containers",
+	ArgsUsage: "<container>...",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "force the removal of a running container (uses SIGKILL)",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		// 和 docker rm 一样，某个容器删除失败不影响其他容器
+		var failed bool
+		for _, nameOrId := range ctx.Args() {
+			if err := removeContainer(nameOrId, ctx.Bool("force")); err != nil {
+				log.Error(err)
+				failed = true
+				continue
+			}
+			fmt.Println(nameOrId)
+		}
+		if failed {
+			return fmt.Errorf("failed to remove some containers")
+		}
+		return nil
+	},
+}
+
+var StatsCommand = cli.Command{
+	Name:      "stats",
+	Usage:     "Display a live stream of container resource usage",
+	ArgsUsage: "[containers...]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-stream",
+			Usage: "print the first result and exit",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format: table or json",
+			Value: "table",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return containerStatsLoop(ctx.Args(), ctx.Bool("no-stream"), ctx.String("format"))
+	},
+}
+
+var EventsCommand = cli.Command{
+	Name:  "events",
+	Usage: "Get real time events from the runtime",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "show all events created since timestamp",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "stream events until this timestamp",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter, f",
+			Usage: "filter output based on conditions provided, e.g. type=container, event=die, container=<name>",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return streamEvents(ctx.String("since"), ctx.String("until"), ctx.StringSlice("filter"))
+	},
+}
+
+var TopCommand = cli.Command{
+	Name:      "top",
+	Usage:     "Display the running processes of a container",
+	ArgsUsage: "<container> [ps options]",
+	// ps 的参数原样传递，不作为 top 的 flag 解析
+	SkipFlagParsing: true,
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container name")
+		}
+		return topContainer(ctx.Args().Get(0), ctx.Args().Tail())
+	},
+}
+
+var CopyCommand = cli.Command{
+	Name:      "cp",
+	Usage:     "Copy files/folders between a container and the local filesystem",
+	ArgsUsage: "<container>:<src-path> <dest-path>|-  or  <src-path>|- <container>:<dest-path>",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 2 {
+			return fmt.Errorf("cp requires exactly 2 arguments")
+		}
+		return copyFiles(ctx.Args().Get(0), ctx.Args().Get(1))
+	},
+}
+
+var InspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "Display detailed information on containers or networks",
+	ArgsUsage: "<container|network>...",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format, f",
+			Usage: "format the output using a Go template, e.g. '{{.NetworkSettings.IPAddress}}'",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "only inspect objects of the given type: container, network, volume or image",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing object name")
+		}
+		return inspectObjects(ctx.Args(), ctx.String("type"), ctx.String("format"))
+	},
+}
+
+var NetworkCommand = cli.Command{
+	Name:  "network",
+	Usage: "Manage networks",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create a network",
+			ArgsUsage: "<network>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "driver, d",
+					Usage: "network driver, one of: " + strings.Join(network.Drivers(), ", "),
+					Value: "bridge",
+				},
+				cli.StringFlag{
+					Name:  "subnet",
+					Usage: "subnet in CIDR format, e.g. 192.168.0.0/24",
+				},
+				cli.StringSliceFlag{
+					Name:  "label, l",
+					Usage: "set metadata on a network, e.g. --label env=prod",
+				},
+				cli.StringSliceFlag{
+					Name: "opt, o",
+					Usage: "set driver specific options, e.g. -o " + network.BridgeNameOption + "=br0 -o " +
+						network.BridgeMTUOption + "=1450 -o " + network.BridgeICCOption + "=false -o " +
+						network.BridgeMasqueradeOption + "=false",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) != 1 {
+					return fmt.Errorf("network create requires exactly 1 argument")
+				}
+				if ctx.String("subnet") == "" {
+					return fmt.Errorf("missing --subnet")
+				}
+				labels, err := container.ParseLabels(ctx.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+				options, err := parseNetworkOptions(ctx.StringSlice("opt"))
+				if err != nil {
+					return err
+				}
+				if err := network.Init(); err != nil {
+					return err
+				}
+				name := ctx.Args().Get(0)
+				if err := network.CreateNetwork(ctx.String("driver"), ctx.String("subnet"), name, labels, options); err != nil {
+					return fmt.Errorf("create network error: %v", err)
+				}
+				fmt.Println(name)
+				return nil
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "Remove one or more networks",
+			ArgsUsage: "<network>...",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				if err := network.Init(); err != nil {
+					return err
+				}
+				for _, name := range ctx.Args() {
+					if err := removeNetwork(name); err != nil {
+						return err
+					}
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "connect",
+			Usage:     "Connect a running container to a network",
+			ArgsUsage: "<network> <container>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) != 2 {
+					return fmt.Errorf("network connect requires exactly 2 arguments")
+				}
+				if err := network.Init(); err != nil {
+					return err
+				}
+				return connectContainer(ctx.Args().Get(0), ctx.Args().Get(1))
+			},
+		},
+		{
+			Name:      "disconnect",
+			Usage:     "Disconnect a running container from a network",
+			ArgsUsage: "<network> <container>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) != 2 {
+					return fmt.Errorf("network disconnect requires exactly 2 arguments")
+				}
+				if err := network.Init(); err != nil {
+					return err
+				}
+				return disconnectContainer(ctx.Args().Get(0), ctx.Args().Get(1))
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "List networks",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "format the output using a Go template, or json",
+				},
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "only display network names",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter, f",
+					Usage: "filter output based on conditions provided, e.g. label=k=v, name=br, driver=bridge",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if err := network.Init(); err != nil {
+					return err
+				}
+				return network.ListNetwork(ctx.String("format"), ctx.Bool("quiet"), ctx.StringSlice("filter"))
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "Display detailed information on networks",
+			ArgsUsage: "<network>...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "format the output using a Go template",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				return inspectObjects(ctx.Args(), inspectNetworkType, ctx.String("format"))
+			},
+		},
+	},
+}
+
+// OciCommand 兼容 OCI runtime-spec 的底层命令，用法和 runc 类似
+var OciCommand = cli.Command{
+	Name:  "oci",
+	Usage: "OCI runtime-spec compatible low-level commands",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create a container from an OCI bundle",
+			ArgsUsage: "<container-id>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bundle, b",
+					Usage: "path to the bundle directory containing config.json",
+					Value: ".",
+				},
+				cli.StringFlag{
+					Name:  "pid-file",
+					Usage: "file to write the container init process id to",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				return ociCreate(ctx.Args().Get(0), ctx.String("bundle"), ctx.String("pid-file"))
+			},
+		},
+		{
+			Name:      "start",
+			Usage:     "Run the user process of a created container",
+			ArgsUsage: "<container-id>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				return ociStart(ctx.Args().Get(0))
+			},
+		},
+		{
+			Name:      "state",
+			Usage:     "Output the state of a container",
+			ArgsUsage: "<container-id>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				return ociState(ctx.Args().Get(0))
+			},
+		},
+		{
+			Name:      "kill",
+			Usage:     "Send a signal to the container init process",
+			ArgsUsage: "<container-id> [signal]",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				sig := "SIGTERM"
+				if len(ctx.Args()) > 1 {
+					sig = ctx.Args().Get(1)
+				}
+				return ociKill(ctx.Args().Get(0), sig)
+			},
+		},
+		{
+			Name:      "delete",
+			Usage:     "Delete a stopped container",
+			ArgsUsage: "<container-id>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "kill the container if it is still running",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				return ociDelete(ctx.Args().Get(0), ctx.Bool("force"))
+			},
+		},
+	},
+}
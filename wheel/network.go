@@ -0,0 +1,158 @@
+/*
+@Time :    2022/3/25 20:10
+@Author :  liuzhi
+@File :    network
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"my-container/container"
+	"my-container/network"
+	"strconv"
+	"strings"
+)
+
+// parsePortMappings 校验 -p 参数，格式为 宿主机端口:容器端口[/协议]
+func parsePortMappings(mappings []string) ([]string, error) {
+	var result []string
+	for _, pm := range mappings {
+		if _, err := network.ParsePortMapping(pm); err != nil {
+			return nil, err
+		}
+		result = append(result, pm)
+	}
+	return result, nil
+}
+
+// parseNetworkOptions 解析 network create -o key=value，具体的选项由驱动校验
+func parseNetworkOptions(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	options := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid network option %q, expected key=value", arg)
+		}
+		options[parts[0]] = parts[1]
+	}
+	return options, nil
+}
+
+// connectNetworks 把容器连接到 run --net 指定的网络，需要在容器进程创建之后、用户命令执行之前调用
+func connectNetworks(info *container.ContainerInfo) error {
+	if len(info.Networks) == 0 {
+		return nil
+	}
+	if err := network.Init(); err != nil {
+		return err
+	}
+	// 重启时上一次运行的 network namespace 已经销毁，先释放之前分配的地址和端口映射
+	if err := network.DisconnectContainer(info.Id); err != nil {
+		return fmt.Errorf("release endpoints of container %s error: %v", info.Id, err)
+	}
+	for i, name := range info.Networks {
+		// -p 只发布在 run --net 指定的网络上，之后通过 network connect 加入的网络不做端口映射
+		ep := info
+		if i > 0 {
+			copied := *info
+			copied.PortMapping = nil
+			ep = &copied
+		}
+		if err := network.Connect(name, ep); err != nil {
+			return fmt.Errorf("connect container %s to network %s error: %v", info.Id, name, err)
+		}
+	}
+	return nil
+}
+
+// runningContainer 查找运行中的容器，网络的热插拔需要进入容器的 network namespace
+func runningContainer(nameOrId string) (*container.ContainerInfo, error) {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return nil, err
+	}
+	pid, _ := strconv.Atoi(info.Pid)
+	if !container.ProcessAlive(pid) {
+		return nil, fmt.Errorf("container %s is not running", info.Name)
+	}
+	return info, nil
+}
+
+// connectContainer 把运行中的容器连接到网络，容器中新增一块 ethN 网卡
+func connectContainer(networkName, nameOrId string) error {
+	info, err := runningContainer(nameOrId)
+	if err != nil {
+		return err
+	}
+	for _, nw := range info.Networks {
+		if nw == networkName {
+			return fmt.Errorf("container %s is already connected to network %s", info.Name, networkName)
+		}
+	}
+	copied := *info
+	copied.PortMapping = nil
+	if err := network.Connect(networkName, &copied); err != nil {
+		return err
+	}
+	// 记录到容器信息中，shim 重启容器时会重新连接
+	_, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		info.Networks = append(info.Networks, networkName)
+	})
+	return err
+}
+
+// disconnectContainer 断开运行中的容器和网络的连接
+func disconnectContainer(networkName, nameOrId string) error {
+	info, err := runningContainer(nameOrId)
+	if err != nil {
+		return err
+	}
+	connected := false
+	for _, nw := range info.Networks {
+		connected = connected || nw == networkName
+	}
+	if !connected {
+		return fmt.Errorf("container %s is not connected to network %s", info.Name, networkName)
+	}
+	if err := network.Disconnect(networkName, info); err != nil {
+		return err
+	}
+	_, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		networks := info.Networks[:0]
+		for _, nw := range info.Networks {
+			if nw != networkName {
+				networks = append(networks, nw)
+			}
+		}
+		info.Networks = networks
+	})
+	return err
+}
+
+// removeNetwork 删除网络，还有运行中的容器连接着这个网络时拒绝删除
+func removeNetwork(name string) error {
+	if _, err := network.GetNetwork(name); err != nil {
+		return err
+	}
+	infos, err := container.ListContainerInfos()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		pid, _ := strconv.Atoi(info.Pid)
+		if !container.ProcessAlive(pid) {
+			continue
+		}
+		for _, nw := range info.Networks {
+			if nw == name {
+				return fmt.Errorf("network %s has active endpoints, container %s is still connected", name, info.Name)
+			}
+		}
+	}
+	return network.DeleteNetwork(name)
+}
@@ -0,0 +1,469 @@
+/*
+@Time :    2022/3/16 20:30
+@Author :  liuzhi
+@File :    oci
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"my-container/cgroups"
+	"my-container/container"
+	"my-container/oci"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exec fifo 的文件名，存在表示容器处于 created 状态
+const execFifoName = "exec.fifo"
+
+// spec 中的 namespace 类型 -> clone flag
+var namespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+	"mount":   syscall.CLONE_NEWNS,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"user":    syscall.CLONE_NEWUSER,
+	"cgroup":  unix.CLONE_NEWCGROUP,
+}
+
+// spec 中的 rlimit 类型 -> RLIMIT_* 数值
+var rlimitTypes = map[string]int{
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+}
+
+// specToInitConfig 把 bundle 的配置转换成 init 配置和 clone flag
+func specToInitConfig(spec *oci.Spec) (*container.InitConfig, uintptr, error) {
+	process := spec.Process
+	conf := &container.InitConfig{
+		Args:            process.Args,
+		Env:             process.Env,
+		Cwd:             process.Cwd,
+		Hostname:        spec.Hostname,
+		Rootfs:          spec.Root.Path,
+		ReadonlyRootfs:  spec.Root.Readonly,
+		NoNewPrivileges: process.NoNewPrivileges,
+		User: &container.User{
+			Uid:            process.User.UID,
+			Gid:            process.User.GID,
+			AdditionalGids: process.User.AdditionalGids,
+		},
+		// 没有配置 capabilities 时不保留任何 capability
+		Capabilities: &container.Capabilities{},
+	}
+	if conf.Env == nil {
+		conf.Env = []string{}
+	}
+	for _, m := range spec.Mounts {
+		conf.Mounts = append(conf.Mounts, container.Mount{
+			Source:      m.Source,
+			Destination: m.Destination,
+			Type:        m.Type,
+			Options:     m.Options,
+		})
+	}
+	// 五组 capability 分别设置，ambient 只包含 spec 中列出的
+	if c := process.Capabilities; c != nil {
+		sets := []*[]string{&conf.Capabilities.Bounding, &conf.Capabilities.Effective, &conf.Capabilities.Inheritable,
+			&conf.Capabilities.Permitted, &conf.Capabilities.Ambient}
+		for i, names := range [][]string{c.Bounding, c.Effective, c.Inheritable, c.Permitted, c.Ambient} {
+			caps, err := container.ParseCapabilities(names)
+			if err != nil {
+				return nil, 0, err
+			}
+			*sets[i] = caps
+		}
+	}
+	for _, r := range process.Rlimits {
+		t, ok := rlimitTypes[r.Type]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown rlimit type: %s", r.Type)
+		}
+		conf.Rlimits = append(conf.Rlimits, container.Rlimit{Type: t, Hard: r.Hard, Soft: r.Soft})
+	}
+
+	var flags uintptr
+	if spec.Linux != nil {
+		conf.Seccomp = spec.Linux.Seccomp
+		conf.MaskedPaths = spec.Linux.MaskedPaths
+		conf.ReadonlyPaths = spec.Linux.ReadonlyPaths
+		for _, ns := range spec.Linux.Namespaces {
+			flag, ok := namespaceFlags[ns.Type]
+			if !ok {
+				return nil, 0, fmt.Errorf("unknown namespace type: %s", ns.Type)
+			}
+			// 加入已有的 namespace 需要在 clone 之前 setns，Go 的多线程模型下做不到
+			if ns.Path != "" {
+				return nil, 0, fmt.Errorf("joining an existing %s namespace is not supported", ns.Type)
+			}
+			flags |= flag
+		}
+	}
+	if flags&syscall.CLONE_NEWNS == 0 {
+		return nil, 0, fmt.Errorf("mount namespace is required")
+	}
+	return conf, flags, nil
+}
+
+// specToResources 把 linux.resources 转换成 cgroup 的资源限制
+func specToResources(spec *oci.Spec) *cgroups.Resources {
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		return nil
+	}
+	r := spec.Linux.Resources
+	res := &cgroups.Resources{}
+	if r.Memory != nil {
+		if r.Memory.Limit != nil {
+			res.Memory = *r.Memory.Limit
+		}
+		if r.Memory.Swap != nil {
+			res.MemorySwap = *r.Memory.Swap
+		}
+	}
+	if r.CPU != nil {
+		if r.CPU.Shares != nil {
+			res.CpuShares = *r.CPU.Shares
+		}
+		if r.CPU.Quota != nil {
+			res.CpuQuota = *r.CPU.Quota
+		}
+		if r.CPU.Period != nil {
+			res.CpuPeriod = *r.CPU.Period
+		}
+		res.CpusetCpus = r.CPU.Cpus
+		res.CpusetMems = r.CPU.Mems
+	}
+	if r.Pids != nil {
+		res.PidsLimit = r.Pids.Limit
+	}
+	return res
+}
+
+// ociCreate 创建容器：启动 init 进程完成所有初始化，然后阻塞在 exec fifo 上等待 start
+func ociCreate(id, bundle, pidFile string) error {
+	if _, err := container.GetContainerInfo(id); err == nil {
+		return fmt.Errorf("container %s already exists", id)
+	}
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return err
+	}
+	spec, err := oci.LoadSpec(bundle)
+	if err != nil {
+		return err
+	}
+	conf, flags, err := specToInitConfig(spec)
+	if err != nil {
+		return err
+	}
+	// 这两种 hook 需要在容器的 namespace 中执行，暂不支持
+	if spec.Hooks != nil && (len(spec.Hooks.CreateContainer) > 0 || len(spec.Hooks.StartContainer) > 0) {
+		log.Warnf("createContainer and startContainer hooks are not supported, ignored")
+	}
+	cgroupPath := path.Join(cgroups.DefaultParent, id)
+	if spec.Linux != nil && spec.Linux.CgroupsPath != "" {
+		cgroupPath = spec.Linux.CgroupsPath
+	}
+	info := &container.ContainerInfo{
+		Id:          id,
+		Name:        id,
+		Command:     strings.Join(spec.Process.Args, " "),
+		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
+		Status:      container.Created,
+		Bundle:      bundle,
+		CgroupPath:  cgroupPath,
+	}
+	if err := info.Dump(); err != nil {
+		return err
+	}
+	if err := createOciProcess(info, spec, conf, flags, pidFile); err != nil {
+		_ = info.Remove()
+		return err
+	}
+	return nil
+}
+
+func createOciProcess(info *container.ContainerInfo, spec *oci.Spec, conf *container.InitConfig, flags uintptr, pidFile string) error {
+	fifo := path.Join(info.Dir(), execFifoName)
+	if err := unix.Mkfifo(fifo, 0622); err != nil {
+		return fmt.Errorf("create exec fifo error: %v", err)
+	}
+	conf.ExecFifo = fifo
+
+	parent, pipe := container.NewParentProcess(false, conf.Args[0])
+	if parent == nil {
+		return fmt.Errorf("create container process error")
+	}
+	parent.SysProcAttr.Cloneflags = flags
+	for _, m := range spec.Linux.UIDMappings {
+		parent.SysProcAttr.UidMappings = append(parent.SysProcAttr.UidMappings,
+			syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+	}
+	for _, m := range spec.Linux.GIDMappings {
+		parent.SysProcAttr.GidMappings = append(parent.SysProcAttr.GidMappings,
+			syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+	}
+	// 和 runc 一样，容器直接使用调用方的标准输入输出
+	parent.Stdin = os.Stdin
+	parent.Stdout = os.Stdout
+	parent.Stderr = os.Stderr
+	if err := parent.Start(); err != nil {
+		pipe.Close()
+		return fmt.Errorf("start container process error: %v", err)
+	}
+	pipe.CloseChild()
+	defer pipe.Close()
+
+	// init 进程在收到 procRun 之前不会做任何事情，先把它放进 cgroup
+	cgroupManager := cgroups.NewManager(info.CgroupPath)
+	abort := func(err error) error {
+		_ = parent.Process.Kill()
+		pipe.Close()
+		_ = parent.Wait()
+		_ = cgroupManager.Destroy()
+		return err
+	}
+	if err := pipe.SendConfig(conf); err != nil {
+		return abort(err)
+	}
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+		return abort(err)
+	}
+	if err := cgroupManager.Set(specToResources(spec)); err != nil {
+		return abort(err)
+	}
+
+	// namespace 已经创建，init 还没有切换根目录，这时候执行 prestart 和 createRuntime hook
+	// hook 失败时停止容器，并执行 poststop hook
+	state := newOciState(info, spec, oci.StateCreating)
+	state.Pid = parent.Process.Pid
+	for _, name := range []string{oci.HookPrestart, oci.HookCreateRuntime} {
+		if err := oci.RunHooks(spec.Hooks, name, state); err != nil {
+			err = abort(err)
+			state.Status = oci.StateStopped
+			oci.RunHooksWarn(spec.Hooks, oci.HookPoststop, state)
+			return err
+		}
+	}
+	// init 完成初始化之后阻塞在 exec fifo 上，初始化失败的原因通过同步管道返回
+	if err := pipe.Run(); err != nil {
+		return abort(err)
+	}
+	if err := pipe.WaitReady(); err != nil {
+		return abort(err)
+	}
+
+	info.Pid = strconv.Itoa(parent.Process.Pid)
+	if err := info.Dump(); err != nil {
+		return err
+	}
+	if pidFile != "" {
+		if err := ioutil.WriteFile(pidFile, []byte(info.Pid), 0644); err != nil {
+			return err
+		}
+	}
+	publishContainerEvent(info, "create", map[string]string{"bundle": info.Bundle})
+	return parent.Process.Release()
+}
+
+// ociStatus 根据进程和 exec fifo 推断容器状态
+func ociStatus(info *container.ContainerInfo) string {
+	pid, _ := strconv.Atoi(info.Pid)
+	if !container.ProcessAlive(pid) {
+		return oci.StateStopped
+	}
+	if info.Status == container.Paused {
+		return oci.StatePaused
+	}
+	if _, err := os.Stat(path.Join(info.Dir(), execFifoName)); err == nil {
+		return oci.StateCreated
+	}
+	return oci.StateRunning
+}
+
+// ociStart 打开 exec fifo 让 init 进程继续执行用户进程
+func ociStart(id string) error {
+	info, err := container.GetContainerInfo(id)
+	if err != nil {
+		return err
+	}
+	if status := ociStatus(info); status != oci.StateCreated {
+		return fmt.Errorf("cannot start a container in the %s state", status)
+	}
+	fifo := path.Join(info.Dir(), execFifoName)
+	// 以读方式打开 fifo 会阻塞到 init 以写方式打开，期间 init 退出的话不能一直等下去
+	opened := make(chan *os.File, 1)
+	openErr := make(chan error, 1)
+	go func() {
+		f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+		if err != nil {
+			openErr <- err
+			return
+		}
+		opened <- f
+	}()
+	pid, _ := strconv.Atoi(info.Pid)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case f := <-opened:
+			data, err := ioutil.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				return fmt.Errorf("container init exited before start")
+			}
+			_ = os.Remove(fifo)
+			info, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+				info.Status = container.Running
+			})
+			if err != nil {
+				return err
+			}
+			publishContainerEvent(info, "start", nil)
+			// 用户进程已经开始执行，poststart hook 失败只打印日志
+			if spec, err := oci.LoadSpec(info.Bundle); err == nil {
+				oci.RunHooksWarn(spec.Hooks, oci.HookPoststart, newOciState(info, spec, oci.StateRunning))
+			}
+			return nil
+		case err := <-openErr:
+			return fmt.Errorf("open exec fifo error: %v", err)
+		case <-ticker.C:
+			if !container.ProcessAlive(pid) {
+				return fmt.Errorf("container init exited before start")
+			}
+		}
+	}
+}
+
+// newOciState 构造传给 hook 和 state 命令的容器状态，stopped 状态下没有 pid
+func newOciState(info *container.ContainerInfo, spec *oci.Spec, status string) *oci.State {
+	state := &oci.State{
+		Version: oci.Version,
+		ID:      info.Id,
+		Status:  status,
+		Bundle:  info.Bundle,
+	}
+	if status != oci.StateStopped {
+		state.Pid, _ = strconv.Atoi(info.Pid)
+	}
+	if spec != nil {
+		state.Annotations = spec.Annotations
+	}
+	return state
+}
+
+// ociState 按照 runtime-spec 的格式输出容器状态
+func ociState(id string) error {
+	info, err := container.GetContainerInfo(id)
+	if err != nil {
+		return err
+	}
+	spec, _ := oci.LoadSpec(info.Bundle)
+	state := newOciState(info, spec, ociStatus(info))
+	stateJson, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(stateJson))
+	return nil
+}
+
+// ociKill 给容器的 init 进程发送信号
+func ociKill(id string, sig string) error {
+	info, err := container.GetContainerInfo(id)
+	if err != nil {
+		return err
+	}
+	if status := ociStatus(info); status == oci.StateStopped {
+		return fmt.Errorf("cannot kill a container in the %s state", status)
+	}
+	signal, err := parseSignal(sig)
+	if err != nil {
+		return err
+	}
+	pid, _ := strconv.Atoi(info.Pid)
+	if err := syscall.Kill(pid, signal); err != nil {
+		return err
+	}
+	publishContainerEvent(info, "kill", map[string]string{"signal": strconv.Itoa(int(signal))})
+	return nil
+}
+
+// ociDelete 删除已经停止的容器，force 时先杀掉容器进程
+func ociDelete(id string, force bool) error {
+	info, err := container.GetContainerInfo(id)
+	if err != nil {
+		return err
+	}
+	if status := ociStatus(info); status != oci.StateStopped {
+		if !force {
+			return fmt.Errorf("cannot delete a container in the %s state", status)
+		}
+		pid, _ := strconv.Atoi(info.Pid)
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		publishContainerEvent(info, "kill", map[string]string{"signal": strconv.Itoa(int(syscall.SIGKILL))})
+		for i := 0; i < 50 && container.ProcessAlive(pid); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if info.CgroupPath != "" {
+		if err := cgroups.NewManager(info.CgroupPath).Destroy(); err != nil {
+			log.Warnf("delete container %s: %v", id, err)
+		}
+	}
+	if err := info.Remove(); err != nil {
+		return err
+	}
+	publishContainerEvent(info, "destroy", nil)
+	// 容器删除之后执行 poststop hook，失败只打印日志
+	if spec, err := oci.LoadSpec(info.Bundle); err == nil {
+		oci.RunHooksWarn(spec.Hooks, oci.HookPoststop, newOciState(info, spec, oci.StateStopped))
+	}
+	return nil
+}
+
+// parseSignal 支持 9、KILL、SIGKILL 这几种写法
+func parseSignal(sig string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(sig); err == nil {
+		return syscall.Signal(n), nil
+	}
+	sig = strings.ToUpper(sig)
+	if !strings.HasPrefix(sig, "SIG") {
+		sig = "SIG" + sig
+	}
+	if s := unix.SignalNum(sig); s != 0 {
+		return s, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", sig)
+}
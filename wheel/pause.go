@@ -0,0 +1,78 @@
+/*
+@Time :    2022/3/18 21:00
+@Author :  liuzhi
+@File :    pause
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"my-container/cgroups"
+	"my-container/container"
+	"strconv"
+)
+
+// pauseContainer 通过 cgroup freezer 冻结容器中的所有进程
+func pauseContainer(nameOrId string) error {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return err
+	}
+	if info.Status == container.Paused {
+		return fmt.Errorf("container %s is already paused", info.Id)
+	}
+	pid, _ := strconv.Atoi(info.Pid)
+	if info.Status != container.Running || !container.ProcessAlive(pid) {
+		return fmt.Errorf("container %s is not running", info.Id)
+	}
+	if info.CgroupPath == "" {
+		return fmt.Errorf("container %s has no cgroup, can not be paused", info.Id)
+	}
+	if err := cgroups.NewManager(info.CgroupPath).Freeze(); err != nil {
+		return fmt.Errorf("pause container %s error: %v", info.Id, err)
+	}
+	_, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		info.Status = container.Paused
+	})
+	publishContainerEvent(info, "pause", nil)
+	return err
+}
+
+// unpauseContainer 解冻容器
+func unpauseContainer(nameOrId string) error {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return err
+	}
+	if info.Status != container.Paused {
+		return fmt.Errorf("container %s is not paused", info.Id)
+	}
+	return thawContainer(info)
+}
+
+// checkNotPaused 暂停中的容器统一处理：stop 需要进程响应信号，会先自动解冻；
+// cp 这类需要在容器中读写文件的命令直接拒绝，需要用户先 unpause，以后加入的 exec 也按这个规则处理
+// top 只读取 cgroup.procs 和 /proc，和 docker top 一样在容器暂停时也可以使用
+func checkNotPaused(info *container.ContainerInfo) error {
+	pid, _ := strconv.Atoi(info.Pid)
+	if info.Status == container.Paused && container.ProcessAlive(pid) {
+		return fmt.Errorf("container %s is paused, unpause the container first", info.Id)
+	}
+	return nil
+}
+
+// thawContainer 解冻容器并把状态改回 running，stop 停止暂停中的容器时也会调用
+func thawContainer(info *container.ContainerInfo) error {
+	if err := cgroups.NewManager(info.CgroupPath).Thaw(); err != nil {
+		return fmt.Errorf("unpause container %s error: %v", info.Id, err)
+	}
+	_, err := container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		if info.Status == container.Paused {
+			info.Status = container.Running
+		}
+	})
+	publishContainerEvent(info, "unpause", nil)
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+@Time :    2022/3/14 21:40
+@Author :  liuzhi
+@File :    ps
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"my-container/container"
+	"my-container/filters"
+	formatter "my-container/format"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ps 默认的输出格式
+const defaultPsFormat = "table {{.ID}}\t{{.Name}}\t{{.Pid}}\t{{.Status}}\t{{.Command}}\t{{.Created}}"
+
+// containerRow ps 输出的一行，也是 --format 模板中可以使用的字段
+type containerRow struct {
+	ID       string
+	Name     string
+	Pid      string
+	Status   string
+	Command  string
+	Created  string
+	Ports    string
+	Labels   string
+	Networks string
+}
+
+// ps --filter 支持的条件
+var psFilters = []string{"id", "name", "label", "status", "network"}
+
+// ListContainers 按照 format 打印匹配 filterArgs 的容器信息，format 为空时输出默认的表格
+// quiet 时只输出容器 ID，方便 rm $(ps -q --filter ...) 这样的批量操作
+func ListContainers(format string, quiet bool, filterArgs []string) error {
+	filter, err := filters.Parse(filterArgs, psFilters...)
+	if err != nil {
+		return err
+	}
+	for _, status := range filter.Get("status") {
+		if !validStatus(status) {
+			return fmt.Errorf("invalid filter 'status=%s'", status)
+		}
+	}
+	infos, err := container.ListContainerInfos()
+	if err != nil {
+		return fmt.Errorf("list containers error: %v", err)
+	}
+	rows := make([]interface{}, 0, len(infos))
+	for _, info := range infos {
+		if !matchContainer(filter, info) {
+			continue
+		}
+		if quiet {
+			fmt.Println(info.Id)
+			continue
+		}
+		rows = append(rows, &containerRow{
+			ID:       info.Id,
+			Name:     info.Name,
+			Pid:      info.Pid,
+			Status:   displayStatus(info),
+			Command:  info.Command,
+			Created:  info.CreatedTime,
+			Ports:    strings.Join(info.PortMapping, ", "),
+			Labels:   joinLabels(info.Labels),
+			Networks: strings.Join(info.Networks, ","),
+		})
+	}
+	if quiet {
+		return nil
+	}
+	headers := map[string]string{
+		"ID": "ID", "Name": "NAME", "Pid": "PID", "Status": "STATUS",
+		"Command": "COMMAND", "Created": "CREATED", "Ports": "PORTS",
+		"Labels": "LABELS", "Networks": "NETWORKS",
+	}
+	return formatter.Table(os.Stdout, format, defaultPsFormat, headers, rows)
+}
+
+// displayStatus 运行中的容器如果配置了健康检查，在状态后面附上健康状态，比如 running (healthy)
+func displayStatus(info *container.ContainerInfo) string {
+	if info.Status == container.Running && info.Health != nil {
+		return fmt.Sprintf("%s (%s)", info.Status, info.Health.Status)
+	}
+	return info.Status
+}
+
+// matchContainer id 按前缀匹配，name 按子串匹配，和 docker ps 一致
+func matchContainer(filter filters.Args, info *container.ContainerInfo) bool {
+	if ids := filter.Get("id"); len(ids) > 0 {
+		matched := false
+		for _, id := range ids {
+			if strings.HasPrefix(info.Id, id) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return filter.MatchSubstring("name", info.Name) &&
+		filter.Match("status", info.Status) &&
+		filter.MatchAny("network", info.Networks...) &&
+		filter.MatchLabels("label", info.Labels)
+}
+
+func validStatus(status string) bool {
+	switch status {
+	case container.Created, container.Running, container.Paused, container.Restarting, container.Stopped, container.Exited:
+		return true
+	}
+	return false
+}
+
+// joinLabels 按 key 排序输出 k=v,k2=v2
+func joinLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,68 @@
+/*
+@Time :    2022/3/24 21:00
+@Author :  liuzhi
+@File :    rm
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"my-container/cgroups"
+	"my-container/container"
+	"my-container/network"
+	"strconv"
+	"time"
+)
+
+// removeContainer 删除容器的信息目录和 cgroup，运行中的容器需要 force，先 SIGKILL 再删除
+func removeContainer(nameOrId string, force bool) error {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return err
+	}
+	// oci 命令创建的容器按照 runtime-spec 的流程删除，需要执行 poststop hook
+	if info.Bundle != "" {
+		return ociDelete(info.Id, force)
+	}
+	pid, _ := strconv.Atoi(info.Pid)
+	shimPid, _ := strconv.Atoi(info.ShimPid)
+	if container.ProcessAlive(pid) || container.ProcessAlive(shimPid) {
+		if !force {
+			return fmt.Errorf("you cannot remove a %s container %s, stop the container before attempting removal or force remove", info.Status, info.Id)
+		}
+		if err := stopContainer(info.Id, 0); err != nil {
+			return err
+		}
+		// 等 shim 写完最终状态退出，否则 shim 之后写入的容器信息会重新创建目录
+		for i := 0; i < 50 && container.ProcessAlive(shimPid); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if container.ProcessAlive(shimPid) {
+			return fmt.Errorf("shim of container %s did not exit", info.Id)
+		}
+	}
+	// 释放容器在各个网络上的地址和端口映射
+	if len(info.Networks) > 0 {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		if err := network.DisconnectContainer(info.Id); err != nil {
+			log.Warnf("remove container %s: %v", info.Id, err)
+		}
+	}
+	if info.CgroupPath != "" {
+		if m := cgroups.NewManager(info.CgroupPath); m.Exists() {
+			if err := m.Destroy(); err != nil {
+				log.Warnf("remove container %s: %v", info.Id, err)
+			}
+		}
+	}
+	if err := info.Remove(); err != nil {
+		return fmt.Errorf("remove container %s error: %v", info.Id, err)
+	}
+	publishContainerEvent(info, "destroy", nil)
+	return nil
+}
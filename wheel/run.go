@@ -8,20 +8,68 @@
 package wheel
 
 import (
-	log "github.com/sirupsen/logrus"
+	"fmt"
+	"my-container/cgroups"
+	"my-container/config"
 	"my-container/container"
 	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"time"
 )
 
-func Run(tty bool, command string) {
-	parent := container.NewParentProcess(tty, command)
-	if err := parent.Start(); err != nil {
-		log.Error("返回配置好的command对象发生异常")
-		log.Error(err)
+func Run(tty bool, detach bool, info *container.ContainerInfo, conf *container.InitConfig) error {
+	// 容器名和 ID 都可以用来查找容器，名字不能和已有容器的名字或 ID 重复
+	if info.Name != "" {
+		if existing, err := container.GetContainerInfo(info.Name); err == nil {
+			return fmt.Errorf("container name %s is already in use by container %s", info.Name, existing.Id)
+		}
 	}
-	err := parent.Wait()
+	info.Id = container.NewContainerId()
+	if info.Name == "" {
+		info.Name = info.Id
+	}
+	info.CreatedTime = time.Now().Format("2006-01-02 15:04:05")
+	info.Status = container.Created
+	info.CgroupPath = path.Join(cgroups.DefaultParent, info.Id)
+	// 记录容器信息和 init 配置，shim 重启容器时从这里读取
+	if err := info.Dump(); err != nil {
+		return fmt.Errorf("record container info error: %v", err)
+	}
+	if err := container.DumpInitConfig(info.Id, conf); err != nil {
+		return fmt.Errorf("record container init config error: %v", err)
+	}
+	publishContainerEvent(info, "create", nil)
+
+	if detach {
+		// 后台运行时由独立的 shim 进程监管容器，run 命令直接返回
+		if err := startShim(info); err != nil {
+			return err
+		}
+		fmt.Println(info.Id)
+		return nil
+	}
+	exitCode := superviseContainer(info.Id, tty, conf)
+	os.Exit(exitCode)
+	return nil
+}
+
+// startShim 启动 shim 进程，shim 脱离当前会话，输出写入容器日志
+func startShim(info *container.ContainerInfo) error {
+	logFile, err := os.OpenFile(path.Join(info.Dir(), container.ContainerLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		log.Error("执行Run命令失败, ERROR:", err)
+		return err
+	}
+	defer func(logFile *os.File) {
+		_ = logFile.Close()
+	}(logFile)
+	shim := exec.Command("/proc/self/exe", "--config", config.Path(), "shim", info.Id)
+	shim.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	shim.Stdout = logFile
+	shim.Stderr = logFile
+	if err := shim.Start(); err != nil {
+		return fmt.Errorf("start shim error: %v", err)
 	}
-	os.Exit(1)
+	return shim.Process.Release()
 }
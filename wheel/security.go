@@ -0,0 +1,120 @@
+/*
+@Time :    2022/3/9 21:00
+@Author :  liuzhi
+@File :    security
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	"my-container/container"
+	"my-container/landlock"
+	"my-container/seccomp"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parseSecurityOpts 解析 --security-opt 参数，格式为 key=value，结果写入 InitConfig
+// 特权容器默认不启用 seccomp，也不屏蔽系统路径，显式指定的 profile 仍然生效
+func parseSecurityOpts(opts []string, privileged bool, conf *container.InitConfig) error {
+	// 没有指定时使用内置的默认 seccomp profile，并且默认开启 no_new_privs
+	conf.Seccomp = seccomp.DefaultProfile()
+	conf.MaskedPaths = append([]string{}, container.DefaultMaskedPaths...)
+	conf.ReadonlyPaths = append([]string{}, container.DefaultReadonlyPaths...)
+	if privileged {
+		conf.Seccomp = nil
+		conf.MaskedPaths = nil
+		conf.ReadonlyPaths = nil
+	}
+	conf.NoNewPrivileges = true
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		// no-new-privileges 可以不带值，等价于 no-new-privileges=true
+		if len(kv) == 1 && kv[0] == "no-new-privileges" {
+			kv = append(kv, "true")
+		}
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid --security-opt: %s", opt)
+		}
+		switch kv[0] {
+		case "no-new-privileges":
+			nnp, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return fmt.Errorf("invalid --security-opt: %s", opt)
+			}
+			conf.NoNewPrivileges = nnp
+		case "seccomp":
+			if kv[1] == "unconfined" {
+				conf.Seccomp = nil
+				continue
+			}
+			profile, err := seccomp.LoadProfile(kv[1])
+			if err != nil {
+				return err
+			}
+			conf.Seccomp = profile
+		case "landlock":
+			policy, err := landlock.LoadPolicy(kv[1])
+			if err != nil {
+				return err
+			}
+			conf.Landlock = policy
+		case "systempaths":
+			// 和 docker 一样，systempaths=unconfined 关闭路径屏蔽和只读路径
+			if kv[1] != "unconfined" {
+				return fmt.Errorf("invalid --security-opt: %s", opt)
+			}
+			conf.MaskedPaths = nil
+			conf.ReadonlyPaths = nil
+		case "unmask":
+			// 单独放开某个路径，比如 unmask=/proc/sys
+			conf.MaskedPaths = removePath(conf.MaskedPaths, kv[1])
+			conf.ReadonlyPaths = removePath(conf.ReadonlyPaths, kv[1])
+		default:
+			return fmt.Errorf("unknown --security-opt: %s", kv[0])
+		}
+	}
+	return nil
+}
+
+// parseTmpfs 解析 --tmpfs 参数，格式为 /path 或者 /path:opts，只读 rootfs 时补上 /tmp 和 /run
+func parseTmpfs(mounts []string, readonlyRootfs bool, conf *container.InitConfig) error {
+	conf.ReadonlyRootfs = readonlyRootfs
+	conf.Tmpfs = map[string]string{}
+	for _, m := range mounts {
+		kv := strings.SplitN(m, ":", 2)
+		if !path.IsAbs(kv[0]) {
+			return fmt.Errorf("invalid --tmpfs, path must be absolute: %s", m)
+		}
+		options := ""
+		if len(kv) == 2 {
+			options = kv[1]
+		}
+		if _, _, err := container.ParseMountOptions(options); err != nil {
+			return fmt.Errorf("invalid --tmpfs %s: %v", m, err)
+		}
+		conf.Tmpfs[path.Clean(kv[0])] = options
+	}
+	if readonlyRootfs {
+		for _, p := range container.ReadonlyRootfsTmpfs {
+			if _, ok := conf.Tmpfs[p]; !ok {
+				conf.Tmpfs[p] = "mode=1777"
+			}
+		}
+	}
+	return nil
+}
+
+func removePath(paths []string, target string) []string {
+	target = path.Clean(target)
+	var result []string
+	for _, p := range paths {
+		if p != target {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,216 @@
+/*
+@Time :    2022/3/13 21:30
+@Author :  liuzhi
+@File :    shim
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	log "github.com/sirupsen/logrus"
+	"my-container/cgroups"
+	"my-container/container"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// 重启的退避时间从 100ms 开始每次翻倍，最长 1 分钟
+	minRestartBackoff = 100 * time.Millisecond
+	maxRestartBackoff = time.Minute
+	// 容器运行超过这个时间再退出，认为之前的崩溃已经恢复，退避时间重新计算
+	restartResetAfter = 10 * time.Second
+)
+
+// superviseContainer 启动容器进程并等待退出，按照重启策略决定是否重新拉起，返回最后一次的退出码
+// stop 命令会先标记 StoppedByUser 再结束容器进程，然后发送 SIGUSR1 打断退避等待
+func superviseContainer(id string, tty bool, conf *container.InitConfig) int {
+	wakeup := make(chan os.Signal, 1)
+	signal.Notify(wakeup, syscall.SIGUSR1)
+	defer signal.Stop(wakeup)
+
+	backoff := minRestartBackoff
+	for {
+		info, err := container.GetContainerInfo(id)
+		if err != nil {
+			log.Errorf("load container info error %v", err)
+			return 1
+		}
+		startedAt := time.Now()
+		exitCode, unhealthy := runContainerOnce(info, tty, conf)
+
+		info, err = container.UpdateContainerInfo(id, func(info *container.ContainerInfo) {
+			info.Pid = ""
+			info.ExitCode = exitCode
+			info.Status = container.Exited
+			if info.StoppedByUser {
+				info.Status = container.Stopped
+			}
+		})
+		if err != nil {
+			log.Errorf("update container info error %v", err)
+			return exitCode
+		}
+		// 因为不健康被杀掉的容器，不管重启策略如何都重新拉起
+		restart := info.RestartPolicy.ShouldRestart(exitCode, info.RestartCount, info.StoppedByUser)
+		if !restart && !(unhealthy && !info.StoppedByUser) {
+			return exitCode
+		}
+
+		if time.Since(startedAt) > restartResetAfter {
+			backoff = minRestartBackoff
+		}
+		log.Infof("container %s exited with code %d, restart in %v", id, exitCode, backoff)
+		_, _ = container.UpdateContainerInfo(id, func(info *container.ContainerInfo) {
+			info.Status = container.Restarting
+		})
+		select {
+		case <-time.After(backoff):
+		case <-wakeup:
+		}
+		info, err = container.UpdateContainerInfo(id, func(info *container.ContainerInfo) {
+			if info.StoppedByUser {
+				info.Status = container.Stopped
+				return
+			}
+			info.RestartCount++
+		})
+		if err != nil || info.StoppedByUser {
+			return exitCode
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// runContainerOnce 启动一次容器进程并等待退出，返回退出码，以及是否因为健康检查失败被杀掉
+func runContainerOnce(info *container.ContainerInfo, tty bool, conf *container.InitConfig) (int, bool) {
+	parent, pipe := container.NewParentProcess(tty, info.Command)
+	if parent == nil {
+		log.Error("创建容器进程失败")
+		return 1, false
+	}
+	// 非交互模式下容器的输出写入日志文件
+	if !tty {
+		logFile, err := os.OpenFile(path.Join(info.Dir(), container.ContainerLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Errorf("open container log error %v", err)
+		} else {
+			defer func(logFile *os.File) {
+				_ = logFile.Close()
+			}(logFile)
+			parent.Stdout = logFile
+			parent.Stderr = logFile
+		}
+	}
+	if err := parent.Start(); err != nil {
+		log.Error("返回配置好的command对象发生异常")
+		log.Error(err)
+		pipe.Close()
+		return 1, false
+	}
+	pipe.CloseChild()
+	defer pipe.Close()
+	if err := pipe.SendConfig(conf); err != nil {
+		log.Error(err)
+	}
+	// 容器进程加入自己的 cgroup，pause 等功能依赖 cgroup，不可用时只打印日志
+	cgroupManager := cgroups.NewManager(info.CgroupPath)
+	if info.CgroupPath != "" {
+		if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+			log.Warnf("apply cgroup for container %s error %v", info.Id, err)
+		}
+	}
+	pid := strconv.Itoa(parent.Process.Pid)
+	updated, err := container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		info.Pid = pid
+		info.ShimPid = strconv.Itoa(os.Getpid())
+		info.Status = container.Running
+		if info.Healthcheck != nil {
+			info.Health = &container.HealthState{Status: container.HealthStarting}
+		}
+	})
+	if err != nil {
+		log.Errorf("update container info error %v", err)
+	} else {
+		info = updated
+	}
+	// init 收到 procRun 之前不会继续初始化，先把网络配置好，失败时关闭管道让 init 退出
+	if err := connectNetworks(info); err != nil {
+		log.Error(err)
+		pipe.Close()
+		_ = parent.Wait()
+		if info.CgroupPath != "" {
+			destroyCgroup(cgroupManager)
+		}
+		return 1, false
+	}
+	// init 初始化失败时会自己退出，这里只记录原因，退出码由下面的 Wait 得到
+	err = pipe.Run()
+	if err == nil {
+		if err = pipe.WaitReady(); err == nil {
+			err = pipe.WaitExec()
+		}
+	}
+	if err != nil {
+		log.Errorf("start container %s error: %v", info.Id, err)
+	} else {
+		publishContainerEvent(info, "start", nil)
+	}
+
+	var unhealthy int32
+	done := make(chan struct{})
+	if info.Healthcheck != nil {
+		go monitorHealth(info.Id, pid, info.Healthcheck, done, func() {
+			atomic.StoreInt32(&unhealthy, 1)
+			_ = parent.Process.Kill()
+		})
+	}
+	if err := parent.Wait(); err != nil {
+		log.Info("容器进程退出, ", err)
+	}
+	close(done)
+	code := exitCode(parent)
+	if info.CgroupPath != "" {
+		// cgroup 每次启动都重新创建，计数不为 0 说明这次运行中发生过 OOM
+		if count, err := cgroupManager.OOMKillCount(); err == nil && count > 0 {
+			publishContainerEvent(info, "oom", nil)
+		}
+		destroyCgroup(cgroupManager)
+	}
+	publishContainerEvent(info, "die", map[string]string{"exitCode": strconv.Itoa(code)})
+	return code, atomic.LoadInt32(&unhealthy) == 1
+}
+
+// exitCode 和 docker 一样，被信号杀掉的进程退出码为 128 + 信号值
+func exitCode(cmd *exec.Cmd) int {
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return cmd.ProcessState.ExitCode()
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// destroyCgroup 删除容器的 cgroup，init 退出后内核异步杀掉容器中剩余的进程，需要稍微等待
+func destroyCgroup(m *cgroups.Manager) {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = m.Destroy(); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Warnf("destroy cgroup error %v", err)
+}
@@ -0,0 +1,226 @@
+/*
+@Time :    2022/3/19 21:10
+@Author :  liuzhi
+@File :    stats
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"my-container/cgroups"
+	"my-container/container"
+	"my-container/network"
+	"os"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// 两次采样之间的间隔，也是刷新的间隔
+const statsInterval = time.Second
+
+// containerStats 一个容器某一时刻的资源使用情况
+type containerStats struct {
+	ID            string                            `json:"id"`
+	Name          string                            `json:"name"`
+	Read          time.Time                         `json:"read"`
+	CPUPercent    float64                           `json:"cpuPercent"`
+	MemoryUsage   uint64                            `json:"memoryUsage"`
+	MemoryLimit   uint64                            `json:"memoryLimit"`
+	MemoryPercent float64                           `json:"memoryPercent"`
+	Networks      map[string]network.InterfaceStats `json:"networks"`
+	Cgroup        *cgroups.Stats                    `json:"cgroup"`
+}
+
+// statsCollector 保存上一次的 cpu 采样，用来计算两次采样之间的 cpu 使用率
+type statsCollector struct {
+	prevUsage map[string]uint64
+	prevRead  map[string]time.Time
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{prevUsage: map[string]uint64{}, prevRead: map[string]time.Time{}}
+}
+
+// collect 采样一个容器，第一次采样时 cpu 使用率为 0
+func (c *statsCollector) collect(info *container.ContainerInfo) (*containerStats, error) {
+	if info.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup", info.Id)
+	}
+	cgroupStats, err := cgroups.NewManager(info.CgroupPath).Stats()
+	if err != nil {
+		return nil, err
+	}
+	stats := &containerStats{
+		ID:     info.Id,
+		Name:   info.Name,
+		Read:   time.Now(),
+		Cgroup: cgroupStats,
+	}
+
+	if prev, ok := c.prevRead[info.Id]; ok {
+		elapsed := stats.Read.Sub(prev).Microseconds()
+		usage := cgroupStats.CPU.UsageUsec
+		if elapsed > 0 && usage >= c.prevUsage[info.Id] {
+			// 和 docker 一样，多核时可以超过 100%
+			stats.CPUPercent = float64(usage-c.prevUsage[info.Id]) / float64(elapsed) * 100
+		}
+	}
+	c.prevUsage[info.Id] = cgroupStats.CPU.UsageUsec
+	c.prevRead[info.Id] = stats.Read
+
+	// 和 docker 一样，不把可以回收的文件缓存计算在内
+	stats.MemoryUsage = cgroupStats.Memory.Usage
+	if inactive := cgroupStats.Memory.Stat["inactive_file"]; inactive < stats.MemoryUsage {
+		stats.MemoryUsage -= inactive
+	}
+	stats.MemoryLimit = cgroupStats.Memory.Limit
+	if stats.MemoryLimit == 0 {
+		stats.MemoryLimit = hostMemory()
+	}
+	if stats.MemoryLimit > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	pid, _ := strconv.Atoi(info.Pid)
+	if stats.Networks, err = network.EndpointStats(pid); err != nil {
+		log.Debugf("read container %s network stats error %v", info.Id, err)
+	}
+	return stats, nil
+}
+
+// statsTargets 指定了容器时返回指定的容器，否则返回所有运行中的容器
+func statsTargets(names []string) ([]*container.ContainerInfo, error) {
+	if len(names) > 0 {
+		var infos []*container.ContainerInfo
+		for _, name := range names {
+			info, err := container.GetContainerInfo(name)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+	}
+	all, err := container.ListContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	var infos []*container.ContainerInfo
+	for _, info := range all {
+		pid, _ := strconv.Atoi(info.Pid)
+		if (info.Status == container.Running || info.Status == container.Paused) && container.ProcessAlive(pid) {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// containerStatsLoop 每隔 statsInterval 采样一次并输出，noStream 时只输出一次
+// 没有指定容器时每次都重新获取运行中的容器列表
+func containerStatsLoop(names []string, noStream bool, format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	collector := newStatsCollector()
+	// 先采样一次，作为计算 cpu 使用率的基准
+	if infos, err := statsTargets(names); err == nil {
+		for _, info := range infos {
+			_, _ = collector.collect(info)
+		}
+	}
+	for {
+		time.Sleep(statsInterval)
+		infos, err := statsTargets(names)
+		if err != nil {
+			return err
+		}
+		var all []*containerStats
+		for _, info := range infos {
+			stats, err := collector.collect(info)
+			if err != nil {
+				log.Warnf("read container %s stats error %v", info.Id, err)
+				continue
+			}
+			all = append(all, stats)
+		}
+		if format == "json" {
+			printStatsJson(all)
+		} else {
+			if !noStream {
+				// 清屏并把光标移到左上角
+				fmt.Print("\033[2J\033[H")
+			}
+			printStatsTable(all)
+		}
+		if noStream {
+			return nil
+		}
+	}
+}
+
+// printStatsJson 每个容器输出一行 json
+func printStatsJson(all []*containerStats) {
+	for _, stats := range all {
+		statsJson, err := json.Marshal(stats)
+		if err != nil {
+			log.Errorf("marshal stats error %v", err)
+			continue
+		}
+		fmt.Println(string(statsJson))
+	}
+}
+
+func printStatsTable(all []*containerStats) {
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\tPIDS\n")
+	for _, s := range all {
+		var rx, tx uint64
+		for _, n := range s.Networks {
+			rx += n.RxBytes
+			tx += n.TxBytes
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%s / %s\t%s / %s\t%d\n",
+			s.ID,
+			s.Name,
+			s.CPUPercent,
+			formatBytes(s.MemoryUsage), formatBytes(s.MemoryLimit),
+			s.MemoryPercent,
+			formatBytes(rx), formatBytes(tx),
+			formatBytes(s.Cgroup.IO.ReadBytes), formatBytes(s.Cgroup.IO.WriteBytes),
+			s.Cgroup.Pids.Current,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+}
+
+// formatBytes 转换成 1.5MiB 这样便于阅读的格式
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
+
+// hostMemory 宿主机的内存总量，容器没有内存限制时作为上限
+func hostMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
@@ -0,0 +1,69 @@
+/*
+@Time :    2022/3/13 22:10
+@Author :  liuzhi
+@File :    stop
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"my-container/container"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// stopContainer 停止容器：先标记为用户主动停止，避免 shim 按重启策略拉起，
+// 然后发送 SIGTERM，超时后 SIGKILL，暂停中的容器会先自动解冻
+func stopContainer(nameOrId string, timeout time.Duration) error {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return err
+	}
+	info, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		info.StoppedByUser = true
+	})
+	if err != nil {
+		return fmt.Errorf("update container %s info error: %v", nameOrId, err)
+	}
+
+	pid, _ := strconv.Atoi(info.Pid)
+	// 冻结的进程收不到 SIGTERM，停止之前先解冻
+	if info.Status == container.Paused && container.ProcessAlive(pid) {
+		if err := thawContainer(info); err != nil {
+			return err
+		}
+	}
+	if container.ProcessAlive(pid) {
+		publishContainerEvent(info, "kill", map[string]string{"signal": strconv.Itoa(int(syscall.SIGTERM))})
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Errorf("send SIGTERM to container %s error %v", info.Id, err)
+		}
+		deadline := time.Now().Add(timeout)
+		for container.ProcessAlive(pid) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if container.ProcessAlive(pid) {
+			log.Infof("container %s did not exit in %v, kill it", info.Id, timeout)
+			publishContainerEvent(info, "kill", map[string]string{"signal": strconv.Itoa(int(syscall.SIGKILL))})
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				return fmt.Errorf("kill container %s error: %v", info.Id, err)
+			}
+		}
+	}
+
+	shimPid, _ := strconv.Atoi(info.ShimPid)
+	if container.ProcessAlive(shimPid) {
+		// 唤醒处于重启退避中的 shim，由 shim 更新最终状态
+		return syscall.Kill(shimPid, syscall.SIGUSR1)
+	}
+	// shim 已经不在了，直接更新状态
+	_, err = container.UpdateContainerInfo(info.Id, func(info *container.ContainerInfo) {
+		info.Pid = ""
+		info.Status = container.Stopped
+	})
+	return err
+}
@@ -0,0 +1,270 @@
+/*
+@Time :    2022/3/20 20:20
+@Author :  liuzhi
+@File :    top
+@Software: GoLand
+*/
+
+package wheel
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"my-container/cgroups"
+	"my-container/container"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// /proc/<pid>/stat 中的时间单位，Linux 上基本都是 100
+const clockTicks = 100
+
+// processInfo top 命令展示的进程信息
+type processInfo struct {
+	Pid     int
+	Ppid    int
+	NsPid   string // 容器 pid namespace 中的 pid
+	Uid     string
+	CPUTime time.Duration
+	CPU     float64
+	Memory  float64
+	Rss     uint64
+	Command string
+}
+
+// topContainer 列出容器中的进程，指定了 ps 参数时调用宿主机的 ps 并过滤出容器中的进程
+func topContainer(nameOrId string, psArgs []string) error {
+	info, err := container.GetContainerInfo(nameOrId)
+	if err != nil {
+		return err
+	}
+	initPid, _ := strconv.Atoi(info.Pid)
+	if !container.ProcessAlive(initPid) {
+		return fmt.Errorf("container %s is not running", info.Id)
+	}
+	pids, err := containerPids(info, initPid)
+	if err != nil {
+		return err
+	}
+	if len(psArgs) > 0 {
+		return runPs(pids, psArgs)
+	}
+
+	var procs []*processInfo
+	for _, pid := range pids {
+		p, err := readProcessInfo(pid)
+		if err != nil {
+			// 读取的过程中进程可能已经退出
+			log.Debugf("read process %d error %v", pid, err)
+			continue
+		}
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].Pid < procs[j].Pid
+	})
+
+	// 用户名从容器的 /etc/passwd 中查找，镜像中的用户和宿主机不一定一致
+	users := readPasswd(fmt.Sprintf("/proc/%d/root/etc/passwd", initPid))
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "USER\tPID\tCPID\tPPID\t%CPU\t%MEM\tRSS\tTIME\tCOMMAND\n")
+	for _, p := range procs {
+		user := p.Uid
+		if name, ok := users[p.Uid]; ok {
+			user = name
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%.1f\t%.1f\t%s\t%s\t%s\n",
+			user,
+			p.Pid,
+			p.NsPid,
+			p.Ppid,
+			p.CPU,
+			p.Memory,
+			formatBytes(p.Rss),
+			formatCPUTime(p.CPUTime),
+			p.Command,
+		)
+	}
+	return w.Flush()
+}
+
+// containerPids 优先从容器的 cgroup 中获取进程，没有 cgroup 时扫描 /proc 找出同一个 pid namespace 中的进程
+func containerPids(info *container.ContainerInfo, initPid int) ([]int, error) {
+	if info.CgroupPath != "" {
+		m := cgroups.NewManager(info.CgroupPath)
+		if m.Exists() {
+			return m.Pids()
+		}
+	}
+	initNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", initPid))
+	if err != nil {
+		return nil, fmt.Errorf("read pid namespace of container %s error: %v", info.Id, err)
+	}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err == nil && ns == initNs {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// readProcessInfo 从 /proc/<pid>/stat 和 /proc/<pid>/status 中读取进程信息
+func readProcessInfo(pid int) (*processInfo, error) {
+	p := &processInfo{Pid: pid}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// 格式为 pid (comm) state ppid ...，comm 中可能有空格，从最后一个 ')' 之后开始解析
+	commEnd := strings.LastIndex(string(stat), ")")
+	commStart := strings.Index(string(stat), "(")
+	if commStart < 0 || commEnd < commStart {
+		return nil, fmt.Errorf("invalid stat format")
+	}
+	fields := strings.Fields(string(stat[commEnd+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("invalid stat format")
+	}
+	// fields[0] 是第 3 个字段 state，下标和 proc(5) 中的编号相差 3
+	p.Ppid, _ = strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	startTime, _ := strconv.ParseUint(fields[19], 10, 64)
+	rssPages, _ := strconv.ParseUint(fields[21], 10, 64)
+
+	ticks := utime + stime
+	p.CPUTime = time.Duration(ticks) * time.Second / clockTicks
+	if uptime := systemUptime(); uptime > 0 {
+		if elapsed := uptime - float64(startTime)/clockTicks; elapsed > 0 {
+			p.CPU = float64(ticks) / clockTicks / elapsed * 100
+		}
+	}
+	p.Rss = rssPages * uint64(os.Getpagesize())
+	if total := hostMemory(); total > 0 {
+		p.Memory = float64(p.Rss) / float64(total) * 100
+	}
+
+	status, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer func(status *os.File) {
+		_ = status.Close()
+	}(status)
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Uid:"):
+			// 依次是 real、effective、saved、filesystem，展示 effective uid
+			if f := strings.Fields(line); len(f) > 2 {
+				p.Uid = f[2]
+			}
+		case strings.HasPrefix(line, "NSpid:"):
+			// 从外到内每一层 pid namespace 中的 pid，最后一个就是容器中的 pid
+			if f := strings.Fields(line); len(f) > 1 {
+				p.NsPid = f[len(f)-1]
+			}
+		}
+	}
+
+	// cmdline 以 \0 分隔，内核线程的 cmdline 为空，用 [comm] 代替
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil && len(cmdline) > 0 {
+		p.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	} else {
+		p.Command = "[" + string(stat[commStart+1:commEnd]) + "]"
+	}
+	return p, nil
+}
+
+// readPasswd 读取 passwd 文件中 uid -> 用户名的映射，读取失败返回空 map
+func readPasswd(file string) map[string]string {
+	users := map[string]string{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return users
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Split(line, ":")
+		if len(parts) < 3 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := users[parts[2]]; !ok {
+			users[parts[2]] = parts[0]
+		}
+	}
+	return users
+}
+
+// systemUptime 读取 /proc/uptime，单位秒
+func systemUptime() float64 {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	uptime, _ := strconv.ParseFloat(fields[0], 64)
+	return uptime
+}
+
+// formatCPUTime 格式化成 ps 的 [DD-]hh:mm:ss 格式
+func formatCPUTime(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	days := seconds / 86400
+	seconds %= 86400
+	if days > 0 {
+		return fmt.Sprintf("%d-%02d:%02d:%02d", days, seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+}
+
+// runPs 和 docker top 一样执行宿主机的 ps，根据表头中的 PID 列过滤出容器中的进程
+func runPs(pids []int, psArgs []string) error {
+	output, err := exec.Command("ps", psArgs...).Output()
+	if err != nil {
+		return fmt.Errorf("run ps %s error: %v", strings.Join(psArgs, " "), err)
+	}
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	pidIndex := -1
+	for i, name := range strings.Fields(lines[0]) {
+		if name == "PID" {
+			pidIndex = i
+			break
+		}
+	}
+	if pidIndex < 0 {
+		return fmt.Errorf("couldn't find PID field in ps output")
+	}
+	inContainer := map[string]bool{}
+	for _, pid := range pids {
+		inContainer[strconv.Itoa(pid)] = true
+	}
+	fmt.Println(lines[0])
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > pidIndex && inContainer[fields[pidIndex]] {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}